@@ -0,0 +1,329 @@
+package usrsvc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// maxBatchItems is the most users a batch request may carry. Repositories
+// are called with chunks of at most datastoreBatchSize users.
+const maxBatchItems = 10000
+
+// batch create
+type userBatchCreateRequest struct {
+	Users []*User `json:"users"`
+}
+
+// batch get and batch delete
+type userBatchIdsRequest struct {
+	Ids []string `json:"ids"`
+}
+
+type userBatchResponse struct {
+	Results []*batchItemResult `json:"results"`
+}
+
+// batchItemResult is the outcome for one item of a batch request, in the
+// order of the request: the user, or the error of that item.
+type batchItemResult struct {
+	Id    string          `json:"id"`
+	User  *User           `json:"user,omitempty"`
+	Error *batchItemError `json:"error,omitempty"`
+}
+
+// batchItemError carries the status and code the item would have had as a
+// single request.
+type batchItemError struct {
+	Status int          `json:"status"`
+	Code   string       `json:"code"`
+	Detail string       `json:"detail,omitempty"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+func newBatchItemError(err error, detail string) *batchItemError {
+	itemError := &batchItemError{
+		Status: statusCodeFromError(err),
+		Code:   errorCodeFromError(err),
+		Detail: detail,
+	}
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		itemError.Errors = verr.Fields
+	}
+	return itemError
+}
+
+// multiRepository returns the repository of s as a BatchUserRepository.
+func (s *Service) multiRepository() (BatchUserRepository, error) {
+	repository, ok := s.repository.(BatchUserRepository)
+	if !ok {
+		return nil, fmt.Errorf("%w: the repository does not support batches", errors.ErrUnsupported)
+	}
+	return repository, nil
+}
+
+// chunkResults calls f with the results in chunks of datastoreBatchSize.
+func chunkResults(results []*batchItemResult, f func(chunk []*batchItemResult)) {
+	for start := 0; start < len(results); start += datastoreBatchSize {
+		f(results[start:min(start+datastoreBatchSize, len(results))])
+	}
+}
+
+func (s *Service) batchCreateUsers(w http.ResponseWriter, r *http.Request) {
+	ctx := s.newContext(r)
+
+	var p userBatchCreateRequest
+	err := decodeRequestBody(r.Body, &p)
+	if err != nil {
+		writeBadRequestResponse(w, r, err.Error())
+		return
+	}
+	if len(p.Users) == 0 || len(p.Users) > maxBatchItems {
+		writeBadRequestResponse(w, r, fmt.Sprintf("users must have between 1 and %d users", maxBatchItems))
+		return
+	}
+
+	repository, err := s.multiRepository()
+	if err != nil {
+		writeErrorResponse(w, r, err, "Can not create users")
+		return
+	}
+
+	// CreateMulti stores users as they are, so set what Create would.
+	now := time.Now()
+	results := make([]*batchItemResult, len(p.Users))
+	var validResults []*batchItemResult
+	for i, u := range p.Users {
+		result := &batchItemResult{}
+		results[i] = result
+		if u == nil {
+			result.Error = newBatchItemError(&ValidationError{Fields: []FieldError{{Field: "", Code: "REQUIRED", Detail: "user is null"}}}, "Invalid user")
+			continue
+		}
+		id, err := s.idGenerator.NewID()
+		if err != nil {
+			log.Printf("NewID	err:%v", err)
+			result.Error = newBatchItemError(err, "Can not create user")
+			continue
+		}
+		user := &User{
+			Id:        id,
+			Name:      u.Name,
+			CreatedAt: now,
+			UpdatedAt: now,
+			Version:   1,
+		}
+		if err := user.isValid(); err != nil {
+			result.Error = newBatchItemError(err, "Invalid user")
+			continue
+		}
+		result.Id = user.Id
+		result.User = user
+		validResults = append(validResults, result)
+	}
+
+	chunkResults(validResults, func(chunk []*batchItemResult) {
+		userList := make([]*User, len(chunk))
+		for i, result := range chunk {
+			userList[i] = result.User
+		}
+		userResults, err := repository.CreateMulti(ctx, userList)
+		if err != nil {
+			log.Printf("BatchCreateUsers	err:%v", err)
+			for _, result := range chunk {
+				result.User = nil
+				result.Error = newBatchItemError(err, "Can not create user")
+			}
+			return
+		}
+		for i, result := range chunk {
+			if userResults[i].Err != nil {
+				log.Printf("BatchCreateUsers	err:%v", userResults[i].Err)
+				result.User = nil
+				result.Error = newBatchItemError(userResults[i].Err, "Can not create user")
+			}
+		}
+	})
+
+	json.NewEncoder(w).Encode(userBatchResponse{Results: results})
+}
+
+func (s *Service) batchGetUsers(w http.ResponseWriter, r *http.Request) {
+	ctx := s.newContext(r)
+
+	include, err := includeDeleted(r)
+	if err != nil {
+		writeInvalidParameterResponse(w, r, err.Error())
+		return
+	}
+	if include {
+		if err := s.requireAdmin(ctx); err != nil {
+			writeErrorResponse(w, r, err, "Only admins can include deleted users")
+			return
+		}
+	}
+
+	results, repository, ok := s.decodeBatchIds(w, r)
+	if !ok {
+		return
+	}
+
+	chunkResults(results, func(chunk []*batchItemResult) {
+		findUsers(ctx, repository, chunk)
+	})
+	for _, result := range results {
+		if result.User != nil && result.User.isDeleted() && !include {
+			result.User = nil
+			result.Error = newBatchItemError(ErrNotFound, "Can not find user")
+		}
+	}
+
+	json.NewEncoder(w).Encode(userBatchResponse{Results: results})
+}
+
+// batchDeleteUsers soft deletes the users like DELETE /v1/users/{id}, so
+// they stay restorable until purged. Every chunk is read with FindMulti and
+// written with one UpdateMulti.
+func (s *Service) batchDeleteUsers(w http.ResponseWriter, r *http.Request) {
+	ctx := s.newContext(r)
+
+	results, repository, ok := s.decodeBatchIds(w, r)
+	if !ok {
+		return
+	}
+	rejectRepeatedIds(results)
+
+	now := time.Now()
+	chunkResults(results, func(chunk []*batchItemResult) {
+		findUsers(ctx, repository, chunk)
+		softDeleteUsers(ctx, repository, chunk, now)
+	})
+
+	json.NewEncoder(w).Encode(userBatchResponse{Results: results})
+}
+
+// rejectRepeatedIds sets an error on every repetition of an id, which the
+// first one already covers.
+func rejectRepeatedIds(results []*batchItemResult) {
+	ids := make(map[string]bool, len(results))
+	for _, result := range results {
+		if result.Error != nil {
+			continue
+		}
+		if ids[result.Id] {
+			result.Error = newBatchItemError(&ValidationError{Fields: []FieldError{{Field: "id", Code: "DUPLICATE", Detail: "user id is repeated"}}}, "Invalid user")
+			continue
+		}
+		ids[result.Id] = true
+	}
+}
+
+// softDeleteUsers soft deletes the users found for chunk. UpdateMulti fails
+// the users changed since FindMulti.
+func softDeleteUsers(ctx context.Context, repository BatchUserRepository, chunk []*batchItemResult, now time.Time) {
+	var pending []*batchItemResult
+	var userList []*User
+	for _, result := range chunk {
+		if result.User == nil {
+			continue
+		}
+		if result.User.isDeleted() {
+			result.User = nil
+			result.Error = newBatchItemError(ErrNotFound, "Can not find user")
+			continue
+		}
+		result.User.DeletedAt = now
+		pending = append(pending, result)
+		userList = append(userList, result.User)
+	}
+	if len(userList) == 0 {
+		return
+	}
+
+	userResults, err := repository.UpdateMulti(ctx, userList)
+	if err != nil {
+		log.Printf("SoftDeleteUsers	err:%v", err)
+		for _, result := range pending {
+			result.User = nil
+			result.Error = newBatchItemError(err, "Can not delete user")
+		}
+		return
+	}
+	for i, result := range pending {
+		if userResults[i].Err != nil {
+			log.Printf("SoftDeleteUsers	err:%v", userResults[i].Err)
+			result.User = nil
+			result.Error = newBatchItemError(userResults[i].Err, "Can not delete user")
+			continue
+		}
+		result.User = userResults[i].User
+	}
+}
+
+// decodeBatchIds decodes the ids of a batch request into results, setting
+// the error of the empty ones. It writes the problem and returns false when
+// the request can not be served.
+func (s *Service) decodeBatchIds(w http.ResponseWriter, r *http.Request) ([]*batchItemResult, BatchUserRepository, bool) {
+	var p userBatchIdsRequest
+	err := decodeRequestBody(r.Body, &p)
+	if err != nil {
+		writeBadRequestResponse(w, r, err.Error())
+		return nil, nil, false
+	}
+	if len(p.Ids) == 0 || len(p.Ids) > maxBatchItems {
+		writeBadRequestResponse(w, r, fmt.Sprintf("ids must have between 1 and %d ids", maxBatchItems))
+		return nil, nil, false
+	}
+
+	repository, err := s.multiRepository()
+	if err != nil {
+		writeErrorResponse(w, r, err, "Can not serve the batch")
+		return nil, nil, false
+	}
+
+	results := make([]*batchItemResult, len(p.Ids))
+	for i, id := range p.Ids {
+		results[i] = &batchItemResult{Id: id}
+		if id == "" {
+			results[i].Error = newBatchItemError(&ValidationError{Fields: []FieldError{{Field: "id", Code: "REQUIRED", Detail: "user id is empty"}}}, "Invalid user")
+		}
+	}
+	return results, repository, true
+}
+
+// findUsers sets the user or the error of every result of chunk without an
+// error yet.
+func findUsers(ctx context.Context, repository BatchUserRepository, chunk []*batchItemResult) {
+	var pending []*batchItemResult
+	var ids []string
+	for _, result := range chunk {
+		if result.Error == nil {
+			pending = append(pending, result)
+			ids = append(ids, result.Id)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	userResults, err := repository.FindMulti(ctx, ids)
+	if err != nil {
+		log.Printf("FindUsers	err:%v", err)
+		for _, result := range pending {
+			result.Error = newBatchItemError(err, "Can not find user")
+		}
+		return
+	}
+	for i, result := range pending {
+		if userResults[i].Err != nil {
+			result.Error = newBatchItemError(userResults[i].Err, "Can not find user")
+			continue
+		}
+		result.User = userResults[i].User
+	}
+}
@@ -0,0 +1,214 @@
+package usrsvc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// chunkRecordingRepository records the size of every Multi call.
+type chunkRecordingRepository struct {
+	BatchUserRepository
+	chunks map[string][]int
+}
+
+func (repository *chunkRecordingRepository) CreateMulti(ctx context.Context, userList []*User) ([]*UserResult, error) {
+	repository.chunks["CreateMulti"] = append(repository.chunks["CreateMulti"], len(userList))
+	return repository.BatchUserRepository.CreateMulti(ctx, userList)
+}
+
+func (repository *chunkRecordingRepository) FindMulti(ctx context.Context, ids []string) ([]*UserResult, error) {
+	repository.chunks["FindMulti"] = append(repository.chunks["FindMulti"], len(ids))
+	return repository.BatchUserRepository.FindMulti(ctx, ids)
+}
+
+func (repository *chunkRecordingRepository) DeleteMulti(ctx context.Context, userList []*User) ([]*UserResult, error) {
+	repository.chunks["DeleteMulti"] = append(repository.chunks["DeleteMulti"], len(userList))
+	return repository.BatchUserRepository.DeleteMulti(ctx, userList)
+}
+
+func (repository *chunkRecordingRepository) UpdateMulti(ctx context.Context, userList []*User) ([]*UserResult, error) {
+	repository.chunks["UpdateMulti"] = append(repository.chunks["UpdateMulti"], len(userList))
+	return repository.BatchUserRepository.UpdateMulti(ctx, userList)
+}
+
+func TestUserBatchRoutes(t *testing.T) {
+	newContext := WithContextFunc(func(r *http.Request) context.Context {
+		return r.Context()
+	})
+
+	tests := []struct {
+		name string
+		wrap func(repository IUserRepository) IUserRepository
+	}{
+		{name: "Batch_WhenPassingMoreUsersThanABatch_CallTheRepositoryInChunks", wrap: func(repository IUserRepository) IUserRepository { return repository }},
+		{name: "Batch_WhenCached_CallTheRepositoryInChunks", wrap: func(repository IUserRepository) IUserRepository { return NewCachingRepository(repository) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			origin := &chunkRecordingRepository{BatchUserRepository: newMemoryRepository(), chunks: map[string][]int{}}
+			r := mux.NewRouter()
+			RegisterService(r, NewService(tt.wrap(origin), newContext))
+
+			var createRequest userBatchCreateRequest
+			for i := 0; i < 2*datastoreBatchSize+1; i++ {
+				createRequest.Users = append(createRequest.Users, &User{Name: "Alice"})
+			}
+			created := serveBatch(t, r, "/v1/users:batchCreate", createRequest)
+
+			var idsRequest userBatchIdsRequest
+			for _, result := range created.Results {
+				if result.User == nil {
+					t.Fatalf("User should be created	result:%+v", result)
+				}
+				idsRequest.Ids = append(idsRequest.Ids, result.Id)
+			}
+			for _, url := range []string{"/v1/users:batchGet", "/v1/users:batchDelete"} {
+				for _, result := range serveBatch(t, r, url, idsRequest).Results {
+					if result.User == nil || result.Error != nil {
+						t.Fatalf("User should be found	url:%v	result:%+v", url, result)
+					}
+				}
+			}
+
+			expectedChunks := []int{datastoreBatchSize, datastoreBatchSize, 1}
+			expected := map[string][]int{
+				"CreateMulti": expectedChunks,
+				"FindMulti":   append(append([]int{}, expectedChunks...), expectedChunks...),
+				"UpdateMulti": expectedChunks,
+			}
+			if !reflect.DeepEqual(origin.chunks, expected) {
+				t.Errorf("Unexpected chunks	chunks:%v", origin.chunks)
+			}
+			userResults, err := origin.BatchUserRepository.FindMulti(context.Background(), idsRequest.Ids)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			for _, result := range userResults {
+				if result.Err != nil || !result.User.isDeleted() {
+					t.Fatalf("Users should be soft deleted	result:%+v", result)
+				}
+			}
+		})
+	}
+}
+
+func TestUserBatchCreate_RecordTheCreateRevision(t *testing.T) {
+	newContext := WithContextFunc(func(r *http.Request) context.Context {
+		return r.Context()
+	})
+	r := mux.NewRouter()
+	RegisterService(r, NewService(newMemoryRepository(), newContext))
+
+	created := serveBatch(t, r, "/v1/users:batchCreate", userBatchCreateRequest{Users: []*User{{Name: "Alice"}, {Name: "Bob"}}})
+	for _, result := range created.Results {
+		if result.User == nil {
+			t.Fatalf("User should be created	result:%+v", result)
+		}
+
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/users/"+result.Id+"/revisions", nil))
+		var response userRevisionListResponse
+		decodeResponseBody(rr.Body.Bytes(), &response)
+		if rr.Code != http.StatusOK || len(response.Revisions) != 1 || response.Revisions[0].Action != RevisionActionCreate || response.Revisions[0].User.Name != result.User.Name {
+			t.Errorf("Revisions should be the creation	code:%v	body:%v", rr.Code, rr.Body.String())
+		}
+
+		rr = httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/users/"+result.Id+"/revisions/1:revert", nil))
+		if rr.Code != http.StatusOK {
+			t.Errorf("Version 1 should be revertible	code:%v	body:%v", rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestUserBatchDelete(t *testing.T) {
+	newContext := WithContextFunc(func(r *http.Request) context.Context {
+		return r.Context()
+	})
+	repository := newMemoryRepository()
+	r := mux.NewRouter()
+	RegisterService(r, NewService(repository, newContext))
+
+	user := createTestUser(context.Background(), t, repository)
+	request := userBatchIdsRequest{Ids: []string{user.Id, "not-existing-id", user.Id}}
+
+	tests := []struct {
+		name           string
+		expectedErrors []string
+	}{
+		{name: "BatchDelete_WhenUserExists_SoftDeleteIt", expectedErrors: []string{"", ErrorCodeUserNotFound, ErrorCodeInvalidUser}},
+		{name: "BatchDelete_WhenUserIsAlreadyDeleted_ReturnNotFound", expectedErrors: []string{ErrorCodeUserNotFound, ErrorCodeUserNotFound, ErrorCodeInvalidUser}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, result := range serveBatch(t, r, "/v1/users:batchDelete", request).Results {
+				code := ""
+				if result.Error != nil {
+					code = result.Error.Code
+				}
+				if code != tt.expectedErrors[i] {
+					t.Errorf("Unexpected result	result:%+v	expected:%v", result, tt.expectedErrors[i])
+				}
+			}
+
+			foundUser, err := repository.Find(context.Background(), user.Id)
+			if err != nil {
+				t.Fatalf("Soft deleted user should be kept	err:%v", err)
+			}
+			if !foundUser.isDeleted() || len(repository.revisions[user.Id]) != 2 {
+				t.Errorf("User should be soft deleted once	foundUser:%v	revisions:%d", foundUser, len(repository.revisions[user.Id]))
+			}
+		})
+	}
+}
+
+func TestUserBatchGet_WhenIncludingDeletedUsers_RequireAnAdmin(t *testing.T) {
+	r := mux.NewRouter()
+	RegisterService(r, NewService(newMemoryRepository(), WithContextFunc(func(r *http.Request) context.Context {
+		return r.Context()
+	}), WithActorFunc(IAPActor), WithAdmins(testAdmin)))
+
+	tests := []struct {
+		name               string
+		headers            map[string]string
+		expectedStatusCode int
+	}{
+		{name: "BatchGet_WhenActorIsAdmin_ServeTheRequest", headers: adminHeaders, expectedStatusCode: http.StatusOK},
+		{name: "BatchGet_WhenActorIsNotAdmin_ReturnForbidden", expectedStatusCode: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/v1/users:batchGet?includeDeleted=true", encodeRequestBody(userBatchIdsRequest{Ids: []string{"DummyId"}}))
+			req.Header.Set("Content-Type", "application/json")
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+			if rr.Code != tt.expectedStatusCode {
+				t.Errorf("Unexpected status	code:%v	body:%v", rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+func serveBatch(t *testing.T, r *mux.Router, url string, request interface{}) userBatchResponse {
+	req := httptest.NewRequest("POST", url, encodeRequestBody(request))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Unexpected status	url:%v	code:%v	body:%v", url, rr.Code, rr.Body.String())
+	}
+	var response userBatchResponse
+	decodeResponseBody(rr.Body.Bytes(), &response)
+	return response
+}
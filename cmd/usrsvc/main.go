@@ -0,0 +1,333 @@
+// Command usrsvc serves the user APIs over plain net/http, without the
+// App Engine runtime.
+//
+// Every flag can also be set with an environment variable:
+//
+//	-addr                 USRSVC_ADDR (defaults to :$PORT or :8080)
+//	-storage              USRSVC_STORAGE
+//	-project              USRSVC_PROJECT (defaults to $DATASTORE_PROJECT_ID)
+//	-database-url         USRSVC_DATABASE_URL
+//	-sqlite-path          USRSVC_SQLITE_PATH
+//	-sqlite-busy-timeout  USRSVC_SQLITE_BUSY_TIMEOUT
+//	-bolt-path            USRSVC_BOLT_PATH
+//	-cache-size           USRSVC_CACHE_SIZE (0 disables the cache)
+//	-cache-ttl            USRSVC_CACHE_TTL
+//	-retention            USRSVC_RETENTION
+//	-purge-interval       USRSVC_PURGE_INTERVAL (0 disables purging)
+//	-idempotency-window   USRSVC_IDEMPOTENCY_WINDOW
+//	-user-id-pattern      USRSVC_USER_ID_PATTERN
+//	-id-generator         USRSVC_ID_GENERATOR
+//	-admins               USRSVC_ADMINS (comma separated actors, requires -trust-iap)
+//	-trust-iap            USRSVC_TRUST_IAP
+//	-read-timeout         USRSVC_READ_TIMEOUT
+//	-write-timeout        USRSVC_WRITE_TIMEOUT
+//	-idle-timeout         USRSVC_IDLE_TIMEOUT
+//	-shutdown-timeout     USRSVC_SHUTDOWN_TIMEOUT
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/gorilla/mux"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	usrsvc "github.com/yusuke0913/app-engine-golang-user-crud-api"
+)
+
+type config struct {
+	addr              string
+	storage           string
+	project           string
+	databaseURL       string
+	sqlitePath        string
+	sqliteBusyTimeout time.Duration
+	boltPath          string
+	cacheSize         int
+	cacheTTL          time.Duration
+	retention         time.Duration
+	purgeInterval     time.Duration
+	idempotencyWindow time.Duration
+	userIdPattern     *regexp.Regexp
+	idGenerator       usrsvc.IDGenerator
+	admins            []string
+	trustIAP          bool
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	shutdownTimeout   time.Duration
+}
+
+func loadConfig(args []string, getenv func(string) string) (*config, error) {
+	defaultAddr := ":8080"
+	if port := getenv("PORT"); port != "" {
+		defaultAddr = ":" + port
+	}
+
+	fs := flag.NewFlagSet("usrsvc", flag.ContinueOnError)
+	cfg := &config{}
+	fs.StringVar(&cfg.addr, "addr", stringEnv(getenv, "USRSVC_ADDR", defaultAddr), "listen address")
+	fs.StringVar(&cfg.storage, "storage", stringEnv(getenv, "USRSVC_STORAGE", "memory"), "storage backend: memory, clouddatastore, postgres, sqlite, bolt")
+	fs.StringVar(&cfg.project, "project", stringEnv(getenv, "USRSVC_PROJECT", getenv("DATASTORE_PROJECT_ID")), "Google Cloud project ID for clouddatastore")
+	fs.StringVar(&cfg.databaseURL, "database-url", stringEnv(getenv, "USRSVC_DATABASE_URL", ""), "database URL for postgres")
+	fs.StringVar(&cfg.sqlitePath, "sqlite-path", stringEnv(getenv, "USRSVC_SQLITE_PATH", "usrsvc.db"), "database file for sqlite")
+	fs.StringVar(&cfg.boltPath, "bolt-path", stringEnv(getenv, "USRSVC_BOLT_PATH", "usrsvc.bolt"), "database file for bolt")
+
+	durations := []struct {
+		p    *time.Duration
+		name string
+		env  string
+		def  time.Duration
+	}{
+		{&cfg.readTimeout, "read-timeout", "USRSVC_READ_TIMEOUT", 10 * time.Second},
+		{&cfg.writeTimeout, "write-timeout", "USRSVC_WRITE_TIMEOUT", 30 * time.Second},
+		{&cfg.idleTimeout, "idle-timeout", "USRSVC_IDLE_TIMEOUT", 120 * time.Second},
+		{&cfg.shutdownTimeout, "shutdown-timeout", "USRSVC_SHUTDOWN_TIMEOUT", 30 * time.Second},
+		{&cfg.sqliteBusyTimeout, "sqlite-busy-timeout", "USRSVC_SQLITE_BUSY_TIMEOUT", 5 * time.Second},
+		{&cfg.cacheTTL, "cache-ttl", "USRSVC_CACHE_TTL", time.Minute},
+		{&cfg.retention, "retention", "USRSVC_RETENTION", 30 * 24 * time.Hour},
+		{&cfg.purgeInterval, "purge-interval", "USRSVC_PURGE_INTERVAL", time.Hour},
+		{&cfg.idempotencyWindow, "idempotency-window", "USRSVC_IDEMPOTENCY_WINDOW", 24 * time.Hour},
+	}
+	for _, d := range durations {
+		def := d.def
+		if v := getenv(d.env); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", d.env, err)
+			}
+			def = parsed
+		}
+		fs.DurationVar(d.p, d.name, def, d.name)
+	}
+
+	cacheSize, err := strconv.Atoi(stringEnv(getenv, "USRSVC_CACHE_SIZE", "0"))
+	if err != nil {
+		return nil, fmt.Errorf("USRSVC_CACHE_SIZE: %v", err)
+	}
+	fs.IntVar(&cfg.cacheSize, "cache-size", cacheSize, "number of users cached in memory, 0 disables the cache")
+
+	trustIAP, err := strconv.ParseBool(stringEnv(getenv, "USRSVC_TRUST_IAP", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("USRSVC_TRUST_IAP: %v", err)
+	}
+	fs.BoolVar(&cfg.trustIAP, "trust-iap", trustIAP, "identify actors by the Identity-Aware Proxy header, only safe when every request goes through IAP")
+
+	var idGenerator, userIdPattern, admins string
+	fs.StringVar(&idGenerator, "id-generator", stringEnv(getenv, "USRSVC_ID_GENERATOR", "uuidv4"), "user id format: uuidv4, uuidv7, ulid, ksuid")
+	fs.StringVar(&userIdPattern, "user-id-pattern", stringEnv(getenv, "USRSVC_USER_ID_PATTERN", ""), "regular expression for the user ids clients choose with PUT, empty for the default")
+	fs.StringVar(&admins, "admins", stringEnv(getenv, "USRSVC_ADMINS", ""), "comma separated actors allowed to list, restore and purge deleted users")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	cfg.idGenerator, err = newIDGenerator(idGenerator)
+	if err != nil {
+		return nil, err
+	}
+	if admins != "" {
+		if !cfg.trustIAP {
+			return nil, errors.New("admins requires -trust-iap, since admins are identified by the Identity-Aware Proxy header")
+		}
+		cfg.admins = strings.Split(admins, ",")
+	}
+	if userIdPattern != "" {
+		cfg.userIdPattern, err = regexp.Compile(userIdPattern)
+		if err != nil {
+			return nil, fmt.Errorf("user-id-pattern: %v", err)
+		}
+	}
+	return cfg, nil
+}
+
+func stringEnv(getenv func(string) string, key string, def string) string {
+	if v := getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// newRepository returns the repository selected by cfg.storage and a func
+// which releases its resources.
+func newRepository(ctx context.Context, cfg *config) (usrsvc.IUserRepository, func() error, error) {
+	switch cfg.storage {
+	case "memory":
+		return usrsvc.NewMemoryRepository(), func() error { return nil }, nil
+	case "clouddatastore":
+		if cfg.project == "" {
+			return nil, nil, errors.New("clouddatastore requires -project")
+		}
+		client, err := datastore.NewClient(ctx, cfg.project)
+		if err != nil {
+			return nil, nil, err
+		}
+		return usrsvc.NewCloudDatastoreRepository(client), client.Close, nil
+	case "postgres":
+		if cfg.databaseURL == "" {
+			return nil, nil, errors.New("postgres requires -database-url")
+		}
+		db, err := sql.Open("pgx", cfg.databaseURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := usrsvc.MigratePostgres(ctx, db); err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		return usrsvc.NewPostgresRepository(db), db.Close, nil
+	case "sqlite":
+		db, err := usrsvc.OpenSQLite(cfg.sqlitePath, cfg.sqliteBusyTimeout)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := usrsvc.MigrateSQLite(ctx, db); err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		return usrsvc.NewSQLiteRepository(db), db.Close, nil
+	case "bolt":
+		db, err := usrsvc.OpenBolt(cfg.boltPath, 5*time.Second)
+		if err != nil {
+			return nil, nil, err
+		}
+		return usrsvc.NewBoltRepository(db), db.Close, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown storage %q", cfg.storage)
+	}
+}
+
+// newIDGenerator returns the IDGenerator of the -id-generator flag.
+func newIDGenerator(name string) (usrsvc.IDGenerator, error) {
+	switch name {
+	case "uuidv4":
+		return usrsvc.NewUUIDv4Generator(), nil
+	case "uuidv7":
+		return usrsvc.NewUUIDv7Generator(), nil
+	case "ulid":
+		return usrsvc.NewULIDGenerator(), nil
+	case "ksuid":
+		return usrsvc.NewKSUIDGenerator(), nil
+	default:
+		return nil, fmt.Errorf("unknown id generator %q", name)
+	}
+}
+
+func newServer(cfg *config, repository usrsvc.IUserRepository) *http.Server {
+	r := mux.NewRouter()
+	opts := []usrsvc.ServiceOption{
+		usrsvc.WithContextFunc(func(r *http.Request) context.Context {
+			return r.Context()
+		}),
+		usrsvc.WithRetention(cfg.retention),
+		usrsvc.WithIdempotencyWindow(cfg.idempotencyWindow),
+		usrsvc.WithIDGenerator(cfg.idGenerator),
+	}
+	// Without IAP in front of the server, the header could be set by
+	// anybody, so actors and admins stay unidentified.
+	if cfg.trustIAP {
+		opts = append(opts, usrsvc.WithActorFunc(usrsvc.IAPActor), usrsvc.WithAdmins(cfg.admins...))
+	}
+	if cfg.userIdPattern != nil {
+		opts = append(opts, usrsvc.WithUserIdPattern(cfg.userIdPattern))
+	}
+	s := usrsvc.NewService(repository, opts...)
+	usrsvc.RegisterService(r, s)
+
+	return &http.Server{
+		Addr:         cfg.addr,
+		Handler:      r,
+		ReadTimeout:  cfg.readTimeout,
+		WriteTimeout: cfg.writeTimeout,
+		IdleTimeout:  cfg.idleTimeout,
+	}
+}
+
+// run serves until ctx is done, then waits for in-flight requests for at
+// most cfg.shutdownTimeout.
+func run(ctx context.Context, cfg *config) error {
+	repository, closeRepository, err := newRepository(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer closeRepository()
+	if cfg.cacheSize > 0 {
+		repository = usrsvc.NewCachingRepository(repository, usrsvc.WithCacheSize(cfg.cacheSize), usrsvc.WithCacheTTL(cfg.cacheTTL))
+	}
+
+	if cfg.purgeInterval > 0 {
+		go purgePeriodically(ctx, cfg, repository)
+	}
+
+	server := newServer(cfg, repository)
+	errc := make(chan error, 1)
+	go func() {
+		log.Printf("Listening	addr:%s	storage:%s", cfg.addr, cfg.storage)
+		errc <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down	timeout:%v", cfg.shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// purgePeriodically purges the users deleted longer than cfg.retention ago
+// every cfg.purgeInterval until ctx is done.
+func purgePeriodically(ctx context.Context, cfg *config, repository usrsvc.IUserRepository) {
+	ticker := time.NewTicker(cfg.purgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purged, err := usrsvc.PurgeDeletedUsers(ctx, repository, time.Now().Add(-cfg.retention))
+			if err != nil {
+				log.Printf("Purge error	purged:%d	err:%v", purged, err)
+				continue
+			}
+			log.Printf("Purged deleted users	purged:%d", purged)
+		}
+	}
+}
+
+func main() {
+	cfg, err := loadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		log.Fatalf("Invalid configuration	err:%v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if err := run(ctx, cfg); err != nil {
+		log.Fatalf("Server error	err:%v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	env := map[string]string{
+		"PORT":                 "9090",
+		"USRSVC_READ_TIMEOUT":  "3s",
+		"USRSVC_WRITE_TIMEOUT": "4s",
+		"USRSVC_ADMINS":        "a@example.com,b@example.com",
+		"USRSVC_TRUST_IAP":     "true",
+	}
+	cfg, err := loadConfig([]string{"-write-timeout", "5s"}, func(key string) string { return env[key] })
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	if cfg.addr != ":9090" || cfg.storage != "memory" {
+		t.Errorf("Defaults should come from the environment	cfg:%+v", cfg)
+	}
+	if cfg.readTimeout != 3*time.Second || cfg.writeTimeout != 5*time.Second {
+		t.Errorf("Flags should override the environment	cfg:%+v", cfg)
+	}
+	if len(cfg.admins) != 2 || cfg.admins[1] != "b@example.com" {
+		t.Errorf("Admins should be split on commas	admins:%v", cfg.admins)
+	}
+
+	if _, err := loadConfig([]string{"-admins", "a@example.com"}, func(key string) string { return "" }); err == nil {
+		t.Errorf("Error must be thrown for admins without a trusted actor")
+	}
+	if _, err := loadConfig(nil, func(key string) string { return "invalid" }); err == nil {
+		t.Errorf("Error must be thrown for an invalid duration")
+	}
+	if _, err := loadConfig([]string{"-user-id-pattern", "("}, func(key string) string { return "" }); err == nil {
+		t.Errorf("Error must be thrown for an invalid user id pattern")
+	}
+	if _, err := loadConfig([]string{"-id-generator", "snowflake"}, func(key string) string { return "" }); err == nil {
+		t.Errorf("Error must be thrown for an unknown id generator")
+	}
+}
+
+func TestServer(t *testing.T) {
+	cfg, err := loadConfig(nil, func(key string) string { return "" })
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	repository, closeRepository, err := newRepository(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer closeRepository()
+
+	ts := httptest.NewServer(newServer(cfg, repository).Handler)
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"/v1/users", "application/json", strings.NewReader(`{"user":{"name":"Alice"}}`))
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("User should be created without App Engine	status:%v", res.StatusCode)
+	}
+}
+
+func TestRun_WhenContextIsDone_ShutDown(t *testing.T) {
+	cfg, err := loadConfig([]string{"-addr", "127.0.0.1:0"}, func(key string) string { return "" })
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, cfg) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("err:%v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Server should shut down")
+	}
+}
+
+func TestNewRepository_WhenStorageIsSQLite_MigrateTheDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	cfg, err := loadConfig([]string{"-storage", "sqlite", "-sqlite-path", path}, func(key string) string { return "" })
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	repository, closeRepository, err := newRepository(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer closeRepository()
+
+	if _, err := repository.List(context.Background()); err != nil {
+		t.Errorf("Users table should be created	err:%v", err)
+	}
+}
+
+func TestNewRepository_WhenSettingsAreMissing_ReturnError(t *testing.T) {
+	for _, storage := range []string{"clouddatastore", "postgres", "unknown"} {
+		cfg, err := loadConfig([]string{"-storage", storage}, func(key string) string { return "" })
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		if _, _, err := newRepository(context.Background(), cfg); err == nil {
+			t.Errorf("Error must be thrown	storage:%s", storage)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package usrsvc_test
+
+import (
+	"context"
+	"errors"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine/aetest"
+
+	usrsvc "github.com/yusuke0913/app-engine-golang-user-crud-api"
+	"github.com/yusuke0913/app-engine-golang-user-crud-api/usrsvctest"
+)
+
+func TestUserMemoryRepository(t *testing.T) {
+	usrsvctest.RunRepositoryConformance(t, context.Background(), usrsvc.NewMemoryRepository)
+}
+
+func TestCachingRepository(t *testing.T) {
+	usrsvctest.RunRepositoryConformance(t, context.Background(), func() usrsvc.IUserRepository {
+		return usrsvc.NewCachingRepository(usrsvc.NewMemoryRepository())
+	})
+}
+
+func TestUserBoltRepository(t *testing.T) {
+	usrsvctest.RunRepositoryConformance(t, context.Background(), func() usrsvc.IUserRepository {
+		db, err := usrsvc.OpenBolt(filepath.Join(t.TempDir(), "users.db"), time.Second)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return usrsvc.NewBoltRepository(db)
+	})
+}
+
+func TestUserSQLiteRepository(t *testing.T) {
+	ctx := context.Background()
+	db, err := usrsvc.OpenSQLite(filepath.Join(t.TempDir(), "users.db"), 5*time.Second)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer db.Close()
+	if err := usrsvc.MigrateSQLite(ctx, db); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	usrsvctest.RunRepositoryConformance(t, ctx, func() usrsvc.IUserRepository {
+		if _, err := db.ExecContext(ctx, "DELETE FROM users"); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		return usrsvc.NewSQLiteRepository(db)
+	})
+}
+
+func TestUserDatastoreRepository(t *testing.T) {
+	log.Print("Setup	AppEngine	Context")
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Skipf("aetest is not available	err:%v", err)
+	}
+	defer done()
+
+	usrsvctest.RunRepositoryConformance(t, ctx, func() usrsvc.IUserRepository {
+		repository := usrsvc.NewDatastoreRepository().(usrsvc.BatchUserRepository)
+		deleteAllUsers(ctx, t, repository)
+		return repository
+	})
+}
+
+// deleteAllUsers hard deletes every user of repository, soft deleted ones
+// included, a page at a time.
+func deleteAllUsers(ctx context.Context, t *testing.T, repository usrsvc.BatchUserRepository) {
+	for {
+		page, err := repository.ListWithOptions(ctx, usrsvc.ListOptions{Limit: 100, IncludeDeleted: true})
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		if len(page.Users) == 0 {
+			return
+		}
+
+		results, err := repository.DeleteMulti(ctx, page.Users)
+		if err != nil {
+			t.Fatalf("err:%v", err)
+		}
+		for _, result := range results {
+			// A query may still return a user deleted by the previous round.
+			if result.Err != nil && !errors.Is(result.Err, usrsvc.ErrNotFound) {
+				t.Fatalf("err:%v", result.Err)
+			}
+		}
+	}
+}
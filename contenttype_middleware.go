@@ -7,15 +7,49 @@ import (
 	"github.com/gorilla/mux"
 )
 
+// acceptContentType rejects request bodies which are not JSON. Requests
+// without a body, such as POST /v1/users/{id}:restore, need no Content-Type.
 func acceptContentType() mux.MiddlewareFunc {
 	return func(h http.Handler) http.Handler {
-		return handlers.ContentTypeHandler(h, []string{"application/json"}...)
+		contentTypeHandler := handlers.ContentTypeHandler(h, []string{"application/json", contentTypeMergePatchJson, contentTypeJsonPatchJson}...)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength == 0 && r.Header.Get("Content-Type") == "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+			contentTypeHandler.ServeHTTP(w, r)
+		})
 	}
 }
 
+// addContentTypeMiddleware defaults the response Content-Type to
+// application/json, keeping the one set by the handler such as
+// application/problem+json for errors.
 func addContentTypeMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Add("Content-Type", "application/json")
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(&contentTypeResponseWriter{ResponseWriter: w, contentType: "application/json"}, r)
 	})
 }
+
+type contentTypeResponseWriter struct {
+	http.ResponseWriter
+	contentType string
+	wroteHeader bool
+}
+
+func (w *contentTypeResponseWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", w.contentType)
+		}
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *contentTypeResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
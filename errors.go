@@ -0,0 +1,91 @@
+package usrsvc
+
+import (
+	"errors"
+	"net/http"
+)
+
+var (
+	// ErrNotFound is returned when the requested user does not exist.
+	ErrNotFound = errors.New("usrsvc: user not found")
+
+	// ErrInvalidUser is returned when a user or its id fails validation.
+	ErrInvalidUser = errors.New("usrsvc: invalid user")
+
+	// ErrConflict is returned when a user with the same id already exists.
+	ErrConflict = errors.New("usrsvc: user already exists")
+
+	// ErrVersionMismatch is returned when a user was changed since it was read.
+	ErrVersionMismatch = errors.New("usrsvc: user version mismatch")
+
+	// ErrInvalidCursor is returned when a list cursor can not be decoded.
+	ErrInvalidCursor = errors.New("usrsvc: invalid cursor")
+
+	// ErrInvalidListOptions is returned when list filters or sort are not supported.
+	ErrInvalidListOptions = errors.New("usrsvc: invalid list options")
+
+	// ErrRevisionNotFound is returned when the requested revision does not exist.
+	ErrRevisionNotFound = errors.New("usrsvc: revision not found")
+
+	// ErrIdempotencyKeyReused is returned when an Idempotency-Key is sent
+	// again with a different request.
+	ErrIdempotencyKeyReused = errors.New("usrsvc: idempotency key reused with a different request")
+
+	// ErrIdempotencyKeyInUse is returned when the request first made with an
+	// Idempotency-Key has not completed yet.
+	ErrIdempotencyKeyInUse = errors.New("usrsvc: idempotency key in use")
+
+	// ErrForbidden is returned when the actor is not allowed to make the
+	// request.
+	ErrForbidden = errors.New("usrsvc: forbidden")
+)
+
+func statusCodeFromError(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrRevisionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidUser), errors.Is(err, errInvalidPatch), errors.Is(err, ErrIdempotencyKeyReused):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrConflict), errors.Is(err, ErrIdempotencyKeyInUse):
+		return http.StatusConflict
+	case errors.Is(err, ErrVersionMismatch):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, ErrInvalidCursor), errors.Is(err, ErrInvalidListOptions):
+		return http.StatusBadRequest
+	case errors.Is(err, errors.ErrUnsupported):
+		return http.StatusNotImplemented
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func errorCodeFromError(err error) string {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return ErrorCodeUserNotFound
+	case errors.Is(err, ErrRevisionNotFound):
+		return ErrorCodeRevisionNotFound
+	case errors.Is(err, ErrInvalidUser):
+		return ErrorCodeInvalidUser
+	case errors.Is(err, errInvalidPatch):
+		return ErrorCodePatchFailed
+	case errors.Is(err, ErrConflict):
+		return ErrorCodeUserConflict
+	case errors.Is(err, ErrVersionMismatch):
+		return ErrorCodeVersionMismatch
+	case errors.Is(err, ErrIdempotencyKeyReused):
+		return ErrorCodeIdempotencyKeyReused
+	case errors.Is(err, ErrIdempotencyKeyInUse):
+		return ErrorCodeIdempotencyKeyInUse
+	case errors.Is(err, ErrForbidden):
+		return ErrorCodeForbidden
+	case errors.Is(err, ErrInvalidCursor), errors.Is(err, ErrInvalidListOptions):
+		return ErrorCodeInvalidParameter
+	case errors.Is(err, errors.ErrUnsupported):
+		return ErrorCodeUnsupported
+	default:
+		return ErrorCodeInternal
+	}
+}
@@ -0,0 +1,35 @@
+package usrsvc
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// etag returns the strong entity tag of the user's version.
+func (u *User) etag() string {
+	return strconv.Quote(strconv.FormatInt(u.Version, 10))
+}
+
+func writeETag(w http.ResponseWriter, u *User) {
+	w.Header().Set("ETag", u.etag())
+}
+
+// matchIfMatch reports whether the If-Match header of r allows changing u.
+// A request without If-Match always matches.
+func matchIfMatch(r *http.Request, u *User) bool {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		return true
+	}
+
+	etag := u.etag()
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		// If-Match uses the strong comparison, so weak tags never match.
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,266 @@
+package usrsvc
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultIdempotencyWindow = 24 * time.Hour
+	maxIdempotencyKeyLength  = 255
+	idempotencyKeyPrefix     = "usrsvc:idempotency:"
+)
+
+// idempotentHeaders are the response headers replayed with a stored response.
+var idempotentHeaders = []string{"Content-Type", "ETag"}
+
+// IdempotencyRecord is what an IdempotencyStore keeps for an Idempotency-Key:
+// the hash of the request which first used it and, once that request
+// completed, its response. Status is 0 while the request is in flight.
+type IdempotencyRecord struct {
+	RequestHash string      `json:"requestHash"`
+	Status      int         `json:"status,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        []byte      `json:"body,omitempty"`
+}
+
+// IdempotencyStore keeps the records of Idempotency-Keys for a window.
+type IdempotencyStore interface {
+	// Begin stores record under key unless key is already used, in which
+	// case the stored record is returned instead.
+	Begin(ctx context.Context, key string, record *IdempotencyRecord, ttl time.Duration) (*IdempotencyRecord, error)
+
+	// Finish replaces the record of key with the completed one.
+	Finish(ctx context.Context, key string, record *IdempotencyRecord, ttl time.Duration) error
+
+	// Forget removes key, so that the request can be made again.
+	Forget(ctx context.Context, key string) error
+}
+
+// WithIdempotencyStore sets where the responses of requests made with an
+// Idempotency-Key are kept. By default they are kept in memory, which only
+// deduplicates retries served by the same instance.
+func WithIdempotencyStore(store IdempotencyStore) ServiceOption {
+	return func(s *Service) {
+		s.idempotencyStore = store
+	}
+}
+
+// WithIdempotencyWindow sets how long a response is replayed for retries
+// with the same Idempotency-Key.
+func WithIdempotencyWindow(window time.Duration) ServiceOption {
+	return func(s *Service) {
+		s.idempotencyWindow = window
+	}
+}
+
+// idempotent wraps h so that requests with an Idempotency-Key run once per
+// key: retries get the stored response, and reusing the key for another
+// request fails. Keys are scoped to the actor of the request.
+func (s *Service) idempotent(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			h(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeInvalidParameterResponse(w, r, fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLength))
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeBadRequestResponse(w, r, "Invalid request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		ctx := s.newContext(r)
+		storeKey := idempotencyStoreKey(ActorFromContext(ctx), key)
+		hash := requestHash(r, body)
+
+		stored, err := s.idempotencyStore.Begin(ctx, storeKey, &IdempotencyRecord{RequestHash: hash}, s.idempotencyWindow)
+		if err != nil {
+			log.Printf("IdempotencyBegin	key:%s	err:%v", key, err)
+			writeErrorResponse(w, r, err, "Can not check Idempotency-Key")
+			return
+		}
+		if stored != nil {
+			switch {
+			case stored.RequestHash != hash:
+				writeErrorResponse(w, r, ErrIdempotencyKeyReused, "Idempotency-Key was used for a different request")
+			case stored.Status == 0:
+				writeErrorResponse(w, r, ErrIdempotencyKeyInUse, "The request with this Idempotency-Key is still in progress")
+			default:
+				replayResponse(w, stored)
+			}
+			return
+		}
+
+		// A panicking handler would otherwise leave the key in flight until
+		// the window ends.
+		defer func() {
+			if p := recover(); p != nil {
+				if err := s.idempotencyStore.Forget(ctx, storeKey); err != nil {
+					log.Printf("IdempotencyForget	key:%s	err:%v", key, err)
+				}
+				panic(p)
+			}
+		}()
+
+		rec := &recordingResponseWriter{ResponseWriter: w}
+		h(rec, r)
+
+		// Server errors may succeed on a retry, so they are not replayed.
+		if rec.status() >= http.StatusInternalServerError {
+			if err := s.idempotencyStore.Forget(ctx, storeKey); err != nil {
+				log.Printf("IdempotencyForget	key:%s	err:%v", key, err)
+			}
+			return
+		}
+		record := &IdempotencyRecord{
+			RequestHash: hash,
+			Status:      rec.status(),
+			Header:      http.Header{},
+			Body:        rec.body.Bytes(),
+		}
+		for _, name := range idempotentHeaders {
+			if v := w.Header().Get(name); v != "" {
+				record.Header.Set(name, v)
+			}
+		}
+		if err := s.idempotencyStore.Finish(ctx, storeKey, record, s.idempotencyWindow); err != nil {
+			log.Printf("IdempotencyFinish	key:%s	err:%v", key, err)
+		}
+	}
+}
+
+// idempotencyStoreKey returns the store key of an Idempotency-Key of actor.
+// Both are hashed, so the key stays within the 250 bytes of memcache.
+func idempotencyStoreKey(actor string, key string) string {
+	sum := sha256.Sum256([]byte(actor + ":" + key))
+	return idempotencyKeyPrefix + hex.EncodeToString(sum[:])
+}
+
+// requestHash identifies a request by its method, path and body.
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.Path)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// replayResponse writes the stored response of record.
+func replayResponse(w http.ResponseWriter, record *IdempotencyRecord) {
+	for name, values := range record.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(record.Status)
+	w.Write(record.Body)
+}
+
+// recordingResponseWriter keeps a copy of the response it writes.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (w *recordingResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingResponseWriter) status() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
+
+type memoryIdempotencyStore struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	records   map[string]memoryIdempotencyEntry
+	nextSweep time.Time
+}
+
+type memoryIdempotencyEntry struct {
+	record    IdempotencyRecord
+	expiresAt time.Time
+}
+
+// NewMemoryIdempotencyStore returns an IdempotencyStore which keeps the
+// records in memory.
+func NewMemoryIdempotencyStore() IdempotencyStore {
+	return newMemoryIdempotencyStore()
+}
+
+func newMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{
+		now:     time.Now,
+		records: map[string]memoryIdempotencyEntry{},
+	}
+}
+
+func (store *memoryIdempotencyStore) Begin(ctx context.Context, key string, record *IdempotencyRecord, ttl time.Duration) (*IdempotencyRecord, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := store.now()
+	store.sweep(now)
+	if entry, ok := store.records[key]; ok && now.Before(entry.expiresAt) {
+		stored := entry.record
+		return &stored, nil
+	}
+	store.records[key] = memoryIdempotencyEntry{record: *record, expiresAt: now.Add(ttl)}
+	return nil, nil
+}
+
+func (store *memoryIdempotencyStore) Finish(ctx context.Context, key string, record *IdempotencyRecord, ttl time.Duration) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.records[key] = memoryIdempotencyEntry{record: *record, expiresAt: store.now().Add(ttl)}
+	return nil
+}
+
+func (store *memoryIdempotencyStore) Forget(ctx context.Context, key string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.records, key)
+	return nil
+}
+
+// sweep drops the expired records, at most once a minute.
+func (store *memoryIdempotencyStore) sweep(now time.Time) {
+	if now.Before(store.nextSweep) {
+		return
+	}
+	for key, entry := range store.records {
+		if !now.Before(entry.expiresAt) {
+			delete(store.records, key)
+		}
+	}
+	store.nextSweep = now.Add(time.Minute)
+}
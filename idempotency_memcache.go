@@ -0,0 +1,65 @@
+package usrsvc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"google.golang.org/appengine/memcache"
+)
+
+type appEngineMemcacheIdempotencyStore struct{}
+
+// NewAppEngineMemcacheIdempotencyStore returns an IdempotencyStore backed by
+// App Engine memcache. Memcache may evict records before their window ends.
+func NewAppEngineMemcacheIdempotencyStore() IdempotencyStore {
+	return appEngineMemcacheIdempotencyStore{}
+}
+
+func (appEngineMemcacheIdempotencyStore) Begin(ctx context.Context, key string, record *IdempotencyRecord, ttl time.Duration) (*IdempotencyRecord, error) {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	// Add fails when the key exists, so only one request begins. Retry once
+	// when the stored record expires in between.
+	for i := 0; i < 2; i++ {
+		err := memcache.Add(ctx, &memcache.Item{Key: key, Value: value, Expiration: ttl})
+		if err == nil {
+			return nil, nil
+		}
+		if !errors.Is(err, memcache.ErrNotStored) {
+			return nil, err
+		}
+		item, err := memcache.Get(ctx, key)
+		if errors.Is(err, memcache.ErrCacheMiss) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		stored := &IdempotencyRecord{}
+		if err := json.Unmarshal(item.Value, stored); err != nil {
+			return nil, err
+		}
+		return stored, nil
+	}
+	return nil, memcache.ErrNotStored
+}
+
+func (appEngineMemcacheIdempotencyStore) Finish(ctx context.Context, key string, record *IdempotencyRecord, ttl time.Duration) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return memcache.Set(ctx, &memcache.Item{Key: key, Value: value, Expiration: ttl})
+}
+
+func (appEngineMemcacheIdempotencyStore) Forget(ctx context.Context, key string) error {
+	err := memcache.Delete(ctx, key)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,245 @@
+package usrsvc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// failingCreateRepository fails the first Create with an internal error.
+type failingCreateRepository struct {
+	IUserRepository
+	failed bool
+}
+
+func (repository *failingCreateRepository) Create(ctx context.Context, user *User) error {
+	if !repository.failed {
+		repository.failed = true
+		return errors.New("connection reset")
+	}
+	return repository.IUserRepository.Create(ctx, user)
+}
+
+type idempotentRequest struct {
+	key                string
+	actor              string
+	body               string
+	expectedStatusCode int
+	expectedCode       string
+	expectedReplayed   bool
+}
+
+func TestIdempotentCreateUser(t *testing.T) {
+	newContext := WithContextFunc(func(r *http.Request) context.Context {
+		return r.Context()
+	})
+	alice := `{"user":{"name":"Alice"}}`
+	bob := `{"user":{"name":"Bob"}}`
+
+	tests := []struct {
+		name          string
+		repository    IUserRepository
+		requests      []idempotentRequest
+		expectedUsers int
+	}{
+		{
+			name:       "Create_WhenRetryingWithTheSameKey_ReplayTheResponse",
+			repository: NewMemoryRepository(),
+			requests: []idempotentRequest{
+				{key: "k1", body: alice, expectedStatusCode: http.StatusOK},
+				{key: "k1", body: alice, expectedStatusCode: http.StatusOK, expectedReplayed: true},
+				{key: "k1", body: alice, expectedStatusCode: http.StatusOK, expectedReplayed: true},
+			},
+			expectedUsers: 1,
+		},
+		{
+			name:       "Create_WhenReusingTheKeyWithAnotherBody_ReturnError",
+			repository: NewMemoryRepository(),
+			requests: []idempotentRequest{
+				{key: "k1", body: alice, expectedStatusCode: http.StatusOK},
+				{key: "k1", body: bob, expectedStatusCode: http.StatusUnprocessableEntity, expectedCode: ErrorCodeIdempotencyKeyReused},
+			},
+			expectedUsers: 1,
+		},
+		{
+			name:       "Create_WhenPassingNoKey_CreateEveryTime",
+			repository: NewMemoryRepository(),
+			requests: []idempotentRequest{
+				{body: alice, expectedStatusCode: http.StatusOK},
+				{body: alice, expectedStatusCode: http.StatusOK},
+			},
+			expectedUsers: 2,
+		},
+		{
+			name:       "Create_WhenActorsDiffer_KeepTheirKeysApart",
+			repository: NewMemoryRepository(),
+			requests: []idempotentRequest{
+				{key: "k1", actor: "a@example.com", body: alice, expectedStatusCode: http.StatusOK},
+				{key: "k1", actor: "b@example.com", body: alice, expectedStatusCode: http.StatusOK},
+			},
+			expectedUsers: 2,
+		},
+		{
+			name:       "Create_WhenUserIsInvalid_ReplayTheError",
+			repository: NewMemoryRepository(),
+			requests: []idempotentRequest{
+				{key: "k1", body: `{"user":{"name":""}}`, expectedStatusCode: http.StatusUnprocessableEntity, expectedCode: ErrorCodeInvalidUser},
+				{key: "k1", body: `{"user":{"name":""}}`, expectedStatusCode: http.StatusUnprocessableEntity, expectedCode: ErrorCodeInvalidUser, expectedReplayed: true},
+			},
+			expectedUsers: 0,
+		},
+		{
+			name:       "Create_WhenTheFirstRequestFailed_RunTheRetry",
+			repository: &failingCreateRepository{IUserRepository: NewMemoryRepository()},
+			requests: []idempotentRequest{
+				{key: "k1", body: alice, expectedStatusCode: http.StatusInternalServerError, expectedCode: ErrorCodeInternal},
+				{key: "k1", body: alice, expectedStatusCode: http.StatusOK},
+			},
+			expectedUsers: 1,
+		},
+		{
+			name:       "Create_WhenKeyIsTooLong_ReturnError",
+			repository: NewMemoryRepository(),
+			requests: []idempotentRequest{
+				{key: strings.Repeat("k", maxIdempotencyKeyLength+1), body: alice, expectedStatusCode: http.StatusBadRequest, expectedCode: ErrorCodeInvalidParameter},
+			},
+			expectedUsers: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := mux.NewRouter()
+			RegisterService(r, NewService(tt.repository, newContext, WithActorFunc(IAPActor)))
+
+			var firstBody string
+			for i, req := range tt.requests {
+				rr := serveIdempotent(r, req)
+				if rr.Code != req.expectedStatusCode || !strings.Contains(rr.Body.String(), req.expectedCode) {
+					t.Fatalf("Unexpected response	request:%d	code:%v	body:%v", i, rr.Code, rr.Body.String())
+				}
+				replayed := rr.Header().Get("Idempotent-Replayed") == "true"
+				if replayed != req.expectedReplayed {
+					t.Errorf("Unexpected replay	request:%d	replayed:%v", i, replayed)
+				}
+				if replayed && rr.Body.String() != firstBody {
+					t.Errorf("Replayed response must match	request:%d	body:%v	firstBody:%v", i, rr.Body.String(), firstBody)
+				}
+				if i == 0 {
+					firstBody = rr.Body.String()
+				}
+			}
+
+			users, err := tt.repository.List(context.Background())
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if len(users) != tt.expectedUsers {
+				t.Errorf("Unexpected users	users:%d	expected:%d", len(users), tt.expectedUsers)
+			}
+		})
+	}
+}
+
+func TestIdempotentCreateUser_Window(t *testing.T) {
+	newContext := WithContextFunc(func(r *http.Request) context.Context {
+		return r.Context()
+	})
+	request := idempotentRequest{key: "k1", body: `{"user":{"name":"Alice"}}`}
+
+	t.Run("Create_WhenTheRequestIsInProgress_ReturnError", func(t *testing.T) {
+		store := newMemoryIdempotencyStore()
+		r := mux.NewRouter()
+		RegisterService(r, NewService(NewMemoryRepository(), newContext, WithIdempotencyStore(store)))
+
+		req := httptest.NewRequest("POST", "/v1/users", strings.NewReader(request.body))
+		record := &IdempotencyRecord{RequestHash: requestHash(req, []byte(request.body))}
+		if _, err := store.Begin(context.Background(), idempotencyStoreKey("", request.key), record, time.Hour); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+
+		rr := serveIdempotent(r, request)
+		if rr.Code != http.StatusConflict || !strings.Contains(rr.Body.String(), ErrorCodeIdempotencyKeyInUse) {
+			t.Errorf("Unexpected response	code:%v	body:%v", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("Create_WhenTheWindowHasPassed_CreateAgain", func(t *testing.T) {
+		now := time.Now()
+		store := newMemoryIdempotencyStore()
+		store.now = func() time.Time { return now }
+		repository := NewMemoryRepository()
+		r := mux.NewRouter()
+		RegisterService(r, NewService(repository, newContext, WithIdempotencyStore(store), WithIdempotencyWindow(time.Hour)))
+
+		serveIdempotent(r, request)
+		now = now.Add(59 * time.Minute)
+		if rr := serveIdempotent(r, request); rr.Header().Get("Idempotent-Replayed") != "true" {
+			t.Errorf("Response should be replayed within the window	code:%v", rr.Code)
+		}
+		now = now.Add(2 * time.Minute)
+		if rr := serveIdempotent(r, request); rr.Header().Get("Idempotent-Replayed") != "" {
+			t.Errorf("Response should not be replayed after the window	code:%v", rr.Code)
+		}
+
+		if users, _ := repository.List(context.Background()); len(users) != 2 {
+			t.Errorf("Unexpected users	users:%d", len(users))
+		}
+	})
+}
+
+func TestIdempotent_WhenHandlerPanics_ForgetTheKey(t *testing.T) {
+	store := newMemoryIdempotencyStore()
+	s := NewService(NewMemoryRepository(), WithContextFunc(func(r *http.Request) context.Context {
+		return r.Context()
+	}), WithIdempotencyStore(store))
+	h := s.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+
+	func() {
+		defer func() {
+			if p := recover(); p != "boom" {
+				t.Errorf("Panic should be propagated	p:%v", p)
+			}
+		}()
+		req := httptest.NewRequest("POST", "/v1/users", strings.NewReader(`{}`))
+		req.Header.Set("Idempotency-Key", "k1")
+		h(httptest.NewRecorder(), req)
+	}()
+
+	stored, err := store.Begin(context.Background(), idempotencyStoreKey("", "k1"), &IdempotencyRecord{}, time.Hour)
+	if err != nil || stored != nil {
+		t.Errorf("Key should be forgotten	stored:%v	err:%v", stored, err)
+	}
+}
+
+func TestIdempotencyStoreKey_FitMemcache(t *testing.T) {
+	key := idempotencyStoreKey(strings.Repeat("a", 320)+"@example.com", strings.Repeat("k", maxIdempotencyKeyLength))
+	if len(key) > 250 {
+		t.Errorf("Key must fit memcache	length:%d", len(key))
+	}
+	if idempotencyStoreKey("a@example.com", "k") == idempotencyStoreKey("b@example.com", "k") {
+		t.Errorf("Keys of different actors must differ")
+	}
+}
+
+func serveIdempotent(r *mux.Router, request idempotentRequest) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/v1/users", strings.NewReader(request.body))
+	req.Header.Set("Content-Type", "application/json")
+	if request.key != "" {
+		req.Header.Set("Idempotency-Key", request.key)
+	}
+	if request.actor != "" {
+		req.Header.Set("X-Goog-Authenticated-User-Email", "accounts.google.com:"+request.actor)
+	}
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	return rr
+}
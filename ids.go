@@ -0,0 +1,192 @@
+package usrsvc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// IDGenerator mints the ids of the users created with POST /v1/users and
+// POST /v1/users:batchCreate.
+type IDGenerator interface {
+	NewID() (string, error)
+}
+
+// WithIDGenerator sets how the service mints user ids. By default they are
+// random UUIDv4s; time-ordered ids spread writes less evenly but sort by
+// creation with sort=id.
+func WithIDGenerator(generator IDGenerator) ServiceOption {
+	return func(s *Service) {
+		s.idGenerator = generator
+	}
+}
+
+type uuidV4Generator struct{}
+
+// NewUUIDv4Generator returns an IDGenerator of random UUIDs.
+func NewUUIDv4Generator() IDGenerator {
+	return uuidV4Generator{}
+}
+
+func (uuidV4Generator) NewID() (string, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+type uuidV7Generator struct{}
+
+// NewUUIDv7Generator returns an IDGenerator of UUIDs starting with the
+// time in milliseconds, which increase within the process.
+func NewUUIDv7Generator() IDGenerator {
+	return uuidV7Generator{}
+}
+
+func (uuidV7Generator) NewID() (string, error) {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+const crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+type ulidGenerator struct {
+	now func() time.Time
+}
+
+// NewULIDGenerator returns an IDGenerator of ULIDs: 26 characters holding
+// the time in milliseconds and 80 random bits. ULIDs of the same
+// millisecond are not ordered.
+func NewULIDGenerator() IDGenerator {
+	return ulidGenerator{now: time.Now}
+}
+
+func (g ulidGenerator) NewID() (string, error) {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(g.now().UnixMilli())<<16)
+	if _, err := rand.Read(b[6:]); err != nil {
+		return "", err
+	}
+
+	// Encode the 128 bits as 26 groups of 5 bits, from the right.
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	var id [26]byte
+	for i := len(id) - 1; i >= 0; i-- {
+		id[i] = crockfordBase32[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(id[:]), nil
+}
+
+// ksuidEpoch is the start of KSUID timestamps, 2014-05-13.
+const ksuidEpoch = 1400000000
+
+type ksuidGenerator struct {
+	now func() time.Time
+}
+
+// NewKSUIDGenerator returns an IDGenerator of KSUIDs: 27 base62 characters
+// holding the time in seconds and 128 random bits. KSUIDs of the same
+// second are not ordered.
+func NewKSUIDGenerator() IDGenerator {
+	return ksuidGenerator{now: time.Now}
+}
+
+func (g ksuidGenerator) NewID() (string, error) {
+	var b [20]byte
+	binary.BigEndian.PutUint32(b[:4], uint32(g.now().Unix()-ksuidEpoch))
+	if _, err := rand.Read(b[4:]); err != nil {
+		return "", err
+	}
+
+	// big.Int uses 0-9a-zA-Z, while KSUIDs use 0-9A-Za-z to sort like
+	// their value.
+	id := strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z':
+			return r - 'a' + 'A'
+		case 'A' <= r && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return r
+		}
+	}, new(big.Int).SetBytes(b[:]).Text(62))
+	return strings.Repeat("0", 27-len(id)) + id, nil
+}
+
+// defaultUserIdPattern accepts the ids minted by the service as well as
+// most external ids, without characters which are special in the routes.
+var defaultUserIdPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._~-]{0,127}$`)
+
+// WithUserIdPattern sets the format of the ids clients may choose when
+// creating users with PUT /v1/users/{id}.
+func WithUserIdPattern(pattern *regexp.Regexp) ServiceOption {
+	return func(s *Service) {
+		s.userIdPattern = pattern
+	}
+}
+
+// validateUserId checks a client chosen id against the pattern of s.
+func (s *Service) validateUserId(id string) error {
+	if !s.userIdPattern.MatchString(id) {
+		return &ValidationError{Fields: []FieldError{{Field: "id", Code: "INVALID_FORMAT", Detail: fmt.Sprintf("user id must match %s", s.userIdPattern)}}}
+	}
+	return nil
+}
+
+// ifNoneMatchAny reports whether r only applies when the target does not
+// exist.
+func ifNoneMatchAny(r *http.Request) bool {
+	return strings.TrimSpace(r.Header.Get("If-None-Match")) == "*"
+}
+
+// createUserWithId creates the user of a PUT with If-None-Match: *. Create
+// checks in a transaction that the id is free, so a taken id, even by a
+// soft deleted user, is a conflict.
+func (s *Service) createUserWithId(ctx context.Context, w http.ResponseWriter, r *http.Request, id string, u *User) {
+	if err := s.validateUserId(id); err != nil {
+		writeErrorResponse(w, r, err, "Invalid user id")
+		return
+	}
+
+	user := &User{
+		Id:        id,
+		Name:      u.Name,
+		CreatedAt: time.Now(),
+	}
+
+	err := user.isValid()
+	if err != nil {
+		writeErrorResponse(w, r, err, "Invalid user")
+		return
+	}
+
+	err = s.repository.Create(ctx, user)
+	if err != nil {
+		log.Printf("UserCreateError	err:%v", err)
+		writeErrorResponse(w, r, err, "Can not create user")
+		return
+	}
+
+	writeETag(w, user)
+	w.Header().Set("Location", r.URL.Path)
+	w.WriteHeader(http.StatusCreated)
+	res := &userCreateResponse{User: user}
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,144 @@
+package usrsvc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestPutCreateUser_UserIdPattern(t *testing.T) {
+	newContext := WithContextFunc(func(r *http.Request) context.Context {
+		return r.Context()
+	})
+	legacyIds := WithUserIdPattern(regexp.MustCompile(`^legacy-[0-9]+$`))
+
+	tests := []struct {
+		name               string
+		opts               []ServiceOption
+		id                 string
+		expectedStatusCode int
+	}{
+		{name: "Put_WhenIdMatchesTheDefaultPattern_CreateTheUser", id: "Legacy.User_42", expectedStatusCode: http.StatusCreated},
+		{name: "Put_WhenIdIsTooLong_ReturnError", id: strings.Repeat("a", 129), expectedStatusCode: http.StatusUnprocessableEntity},
+		{name: "Put_WhenIdMatchesTheConfiguredPattern_CreateTheUser", opts: []ServiceOption{legacyIds}, id: "legacy-42", expectedStatusCode: http.StatusCreated},
+		{name: "Put_WhenIdDoesNotMatchTheConfiguredPattern_ReturnError", opts: []ServiceOption{legacyIds}, id: "Legacy.User_42", expectedStatusCode: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repository := NewMemoryRepository()
+			r := mux.NewRouter()
+			RegisterService(r, NewService(repository, append([]ServiceOption{newContext}, tt.opts...)...))
+
+			req := httptest.NewRequest("PUT", "/v1/users/"+tt.id, strings.NewReader(`{"user":{"name":"Alice"}}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("If-None-Match", "*")
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+			if rr.Code != tt.expectedStatusCode {
+				t.Fatalf("Unexpected response	code:%v	body:%v", rr.Code, rr.Body.String())
+			}
+
+			_, err := repository.Find(context.Background(), tt.id)
+			if created := err == nil; created != (tt.expectedStatusCode == http.StatusCreated) {
+				t.Errorf("Unexpected user	created:%v	err:%v", created, err)
+			}
+		})
+	}
+}
+
+func TestIDGenerators(t *testing.T) {
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	steppingClock := func(step time.Duration) func() time.Time {
+		now := start
+		return func() time.Time {
+			now = now.Add(step)
+			return now
+		}
+	}
+
+	tests := []struct {
+		name           string
+		generator      IDGenerator
+		expectedLength int
+		expectedSorted bool
+	}{
+		{name: "UUIDv4_WhenMintingIds_ReturnUniqueIds", generator: NewUUIDv4Generator(), expectedLength: 36},
+		{name: "UUIDv7_WhenMintingIds_ReturnIdsInCreationOrder", generator: NewUUIDv7Generator(), expectedLength: 36, expectedSorted: true},
+		{name: "ULID_WhenMintingIds_ReturnIdsInCreationOrder", generator: ulidGenerator{now: steppingClock(time.Millisecond)}, expectedLength: 26, expectedSorted: true},
+		{name: "KSUID_WhenMintingIds_ReturnIdsInCreationOrder", generator: ksuidGenerator{now: steppingClock(time.Second)}, expectedLength: 27, expectedSorted: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := map[string]bool{}
+			var ids []string
+			for i := 0; i < 1000; i++ {
+				id, err := tt.generator.NewID()
+				if err != nil {
+					t.Fatalf("err:%v", err)
+				}
+				if len(id) != tt.expectedLength || !defaultUserIdPattern.MatchString(id) {
+					t.Fatalf("Id should be valid	id:%v", id)
+				}
+				if seen[id] {
+					t.Fatalf("Id should be unique	id:%v", id)
+				}
+				seen[id] = true
+				ids = append(ids, id)
+			}
+			if tt.expectedSorted && !sort.StringsAreSorted(ids) {
+				t.Errorf("Ids should sort in creation order	ids:%v", ids[:10])
+			}
+		})
+	}
+}
+
+func TestIDGenerators_KnownEncodings(t *testing.T) {
+	// The timestamp of the example in the ULID spec.
+	ulid, err := ulidGenerator{now: func() time.Time { return time.UnixMilli(1469918176385) }}.NewID()
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	if ulid[:10] != "01ARYZ6S41" {
+		t.Errorf("ULID should start with the timestamp	ulid:%v", ulid)
+	}
+
+	ksuid, err := ksuidGenerator{now: func() time.Time { return time.Unix(ksuidEpoch, 0) }}.NewID()
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	// Without timestamp the 128 random bits fit in 26 characters.
+	if ksuid[0] != '0' {
+		t.Errorf("KSUID of the epoch should start with 0	ksuid:%v", ksuid)
+	}
+}
+
+func TestCreateUser_IDGenerator(t *testing.T) {
+	newContext := WithContextFunc(func(r *http.Request) context.Context {
+		return r.Context()
+	})
+	r := mux.NewRouter()
+	RegisterService(r, NewService(NewMemoryRepository(), newContext, WithIDGenerator(ulidGenerator{now: time.Now})))
+
+	for _, url := range []string{"/v1/users", "/v1/users:batchCreate"} {
+		body := `{"user":{"name":"Alice"}}`
+		if url == "/v1/users:batchCreate" {
+			body = `{"users":[{"name":"Alice"}]}`
+		}
+		req := httptest.NewRequest("POST", url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK || !regexp.MustCompile(`"id":"[0-9A-HJKMNP-TV-Z]{26}"`).MatchString(rr.Body.String()) {
+			t.Errorf("User should get a ULID	url:%v	code:%v	body:%v", url, rr.Code, rr.Body.String())
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package usrsvc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	contentTypeJsonPatchJson = "application/json-patch+json"
+)
+
+// patchableUserPaths are the JSON pointers which a JSON Patch may change.
+// The test operation may read any path.
+var patchableUserPaths = []string{"/name"}
+
+var errInvalidPatch = errors.New("usrsvc: patch can not be applied")
+
+// patchError reports the JSON Patch operation which could not be applied.
+type patchError struct {
+	Index  int
+	Op     string
+	Detail string
+}
+
+func (e *patchError) Error() string {
+	return fmt.Sprintf("%v: operation %d (%s): %s", errInvalidPatch, e.Index, e.Op, e.Detail)
+}
+
+func (e *patchError) Unwrap() error {
+	return errInvalidPatch
+}
+
+// patchOperation is an RFC 6902 operation. Value is nil when it is missing.
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// applyJSONPatch applies an RFC 6902 JSON Patch to u.
+func applyJSONPatch(u *User, operations []patchOperation) (*User, error) {
+	var doc interface{}
+	doc, err := userDocument(u)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, operation := range operations {
+		doc, err = applyPatchOperation(doc, operation)
+		if err != nil {
+			return nil, &patchError{Index: i, Op: operation.Op, Detail: err.Error()}
+		}
+	}
+
+	patchedDoc, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, &ValidationError{Fields: []FieldError{{Field: "", Code: "INVALID_TYPE", Detail: "user must be a JSON object"}}}
+	}
+	return userFromDocument(u, patchedDoc)
+}
+
+func applyPatchOperation(doc interface{}, operation patchOperation) (interface{}, error) {
+	path, err := parseJSONPointer(operation.Path)
+	if err != nil {
+		return nil, err
+	}
+	if operation.Op != "test" && !isPatchablePath(operation.Path) {
+		return nil, fmt.Errorf("path %q can not be changed", operation.Path)
+	}
+
+	switch operation.Op {
+	case "add", "replace", "test":
+		if operation.Value == nil {
+			return nil, fmt.Errorf("value is missing")
+		}
+		var value interface{}
+		if err := json.Unmarshal(operation.Value, &value); err != nil {
+			return nil, fmt.Errorf("value is invalid: %v", err)
+		}
+		switch operation.Op {
+		case "add":
+			return addValue(doc, path, value)
+		case "replace":
+			doc, _, err = removeValue(doc, path)
+			if err != nil {
+				return nil, err
+			}
+			return addValue(doc, path, value)
+		default:
+			actual, err := getValue(doc, path)
+			if err != nil {
+				return nil, err
+			}
+			if !reflect.DeepEqual(actual, value) {
+				return nil, fmt.Errorf("value at %q does not match", operation.Path)
+			}
+			return doc, nil
+		}
+
+	case "remove":
+		doc, _, err = removeValue(doc, path)
+		return doc, err
+
+	case "move", "copy":
+		from, err := parseJSONPointer(operation.From)
+		if err != nil {
+			return nil, err
+		}
+		var value interface{}
+		if operation.Op == "move" {
+			if !isPatchablePath(operation.From) {
+				return nil, fmt.Errorf("path %q can not be changed", operation.From)
+			}
+			if strings.HasPrefix(operation.Path, operation.From+"/") {
+				return nil, fmt.Errorf("path %q can not be moved into itself", operation.From)
+			}
+			doc, value, err = removeValue(doc, from)
+		} else {
+			value, err = getValue(doc, from)
+			value = copyValue(value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+
+	default:
+		return nil, fmt.Errorf("unknown op %q", operation.Op)
+	}
+}
+
+func isPatchablePath(path string) bool {
+	for _, p := range patchableUserPaths {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseJSONPointer splits an RFC 6901 JSON pointer into reference tokens.
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("path %q is not a JSON pointer", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func getValue(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		child, err := childValue(doc, token)
+		if err != nil {
+			return nil, err
+		}
+		doc = child
+	}
+	return doc, nil
+}
+
+func addValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return updateParent(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			container[token] = value
+			return container, nil
+		case []interface{}:
+			if token == "-" {
+				return append(container, value), nil
+			}
+			i, err := arrayIndex(token, len(container)+1)
+			if err != nil {
+				return nil, err
+			}
+			container = append(container, nil)
+			copy(container[i+1:], container[i:])
+			container[i] = value
+			return container, nil
+		default:
+			return nil, fmt.Errorf("can not add %q to a scalar", token)
+		}
+	})
+}
+
+func removeValue(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("the whole user can not be removed")
+	}
+	var removed interface{}
+	doc, err := updateParent(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			value, ok := container[token]
+			if !ok {
+				return nil, fmt.Errorf("member %q does not exist", token)
+			}
+			removed = value
+			delete(container, token)
+			return container, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(container))
+			if err != nil {
+				return nil, err
+			}
+			removed = container[i]
+			return append(container[:i], container[i+1:]...), nil
+		default:
+			return nil, fmt.Errorf("can not remove %q from a scalar", token)
+		}
+	})
+	return doc, removed, err
+}
+
+// updateParent calls f with the container of the last token of path and
+// stores the container it returns back into doc.
+func updateParent(doc interface{}, path []string, f func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return f(doc, path[0])
+	}
+	child, err := childValue(doc, path[0])
+	if err != nil {
+		return nil, err
+	}
+	child, err = updateParent(child, path[1:], f)
+	if err != nil {
+		return nil, err
+	}
+	switch container := doc.(type) {
+	case map[string]interface{}:
+		container[path[0]] = child
+	case []interface{}:
+		i, _ := arrayIndex(path[0], len(container))
+		container[i] = child
+	}
+	return doc, nil
+}
+
+func childValue(doc interface{}, token string) (interface{}, error) {
+	switch container := doc.(type) {
+	case map[string]interface{}:
+		value, ok := container[token]
+		if !ok {
+			return nil, fmt.Errorf("member %q does not exist", token)
+		}
+		return value, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(container))
+		if err != nil {
+			return nil, err
+		}
+		return container[i], nil
+	default:
+		return nil, fmt.Errorf("can not read %q from a scalar", token)
+	}
+}
+
+// arrayIndex parses token as an array index lower than size.
+func arrayIndex(token string, size int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i >= size || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("index %q is out of range", token)
+	}
+	return i, nil
+}
+
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			m[k] = copyValue(child)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, child := range v {
+			s[i] = copyValue(child)
+		}
+		return s
+	default:
+		return v
+	}
+}
@@ -0,0 +1,124 @@
+package usrsvc
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// Test cases from RFC 6902 Appendix A, applied without the path whitelist.
+var jsonPatchOperationTests = []struct {
+	name     string
+	doc      string
+	patch    string
+	expected string
+}{
+	{"AddObjectMember", `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+	{"AddArrayElement", `{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+	{"RemoveObjectMember", `{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+	{"RemoveArrayElement", `{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+	{"ReplaceValue", `{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+	{"MoveValue", `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+	{"MoveArrayElement", `{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+	{"TestValue", `{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`, `{"baz":"qux","foo":["a",2,"c"]}`},
+	{"AddNestedMember", `{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"foo":"bar","child":{"grandchild":{}}}`},
+	{"EscapedPath", `{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10}]`, `{"/":9,"~1":10}`},
+	{"AddArrayValue", `{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`},
+	{"CopyValue", `{"foo":{"bar":1}}`, `[{"op":"copy","from":"/foo","path":"/baz"}]`, `{"foo":{"bar":1},"baz":{"bar":1}}`},
+}
+
+var jsonPatchOperationErrorTests = []struct {
+	name  string
+	doc   string
+	patch string
+}{
+	{"RemoveNonExistingMember", `{"foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`},
+	{"TestNotMatchingValue", `{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`},
+	{"AddToNonExistingTarget", `{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`},
+	{"AddOutOfRangeIndex", `{"foo":["bar"]}`, `[{"op":"add","path":"/foo/2","value":"qux"}]`},
+	{"AddWithoutValue", `{"foo":"bar"}`, `[{"op":"add","path":"/baz"}]`},
+	{"UnknownOp", `{"foo":"bar"}`, `[{"op":"merge","path":"/foo","value":"qux"}]`},
+}
+
+func TestApplyPatchOperation(t *testing.T) {
+	defer func(paths []string) { patchableUserPaths = paths }(patchableUserPaths)
+	patchableUserPaths = []string{""}
+
+	for _, tt := range jsonPatchOperationTests {
+		t.Run(tt.name, func(t *testing.T) {
+			var doc, expected interface{}
+			var operations []patchOperation
+			mustUnmarshal(t, tt.doc, &doc)
+			mustUnmarshal(t, tt.patch, &operations)
+			mustUnmarshal(t, tt.expected, &expected)
+
+			var err error
+			for _, operation := range operations {
+				doc, err = applyPatchOperation(doc, operation)
+				if err != nil {
+					t.Fatalf("err:%v", err)
+				}
+			}
+			if !reflect.DeepEqual(doc, expected) {
+				t.Errorf("got:%v	want:%s", doc, tt.expected)
+			}
+		})
+	}
+
+	for _, tt := range jsonPatchOperationErrorTests {
+		t.Run(tt.name, func(t *testing.T) {
+			var doc interface{}
+			var operations []patchOperation
+			mustUnmarshal(t, tt.doc, &doc)
+			mustUnmarshal(t, tt.patch, &operations)
+
+			if _, err := applyPatchOperation(doc, operations[0]); err == nil {
+				t.Errorf("Error must be thrown")
+			}
+		})
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	user := newDummyUser()
+	user.Version = 1
+
+	tests := []struct {
+		name          string
+		patch         string
+		expectedName  string
+		expectedIndex int
+		expectedErr   error
+	}{
+		{"ReplaceName", `[{"op":"test","path":"/version","value":1},{"op":"replace","path":"/name","value":"ChangedName"}]`, "ChangedName", 0, nil},
+		{"CopyIdToName", `[{"op":"copy","from":"/id","path":"/name"}]`, user.Id, 0, nil},
+		{"ReplaceId", `[{"op":"replace","path":"/name","value":"ChangedName"},{"op":"replace","path":"/id","value":"OtherId"}]`, "", 1, errInvalidPatch},
+		{"TestStaleVersion", `[{"op":"test","path":"/version","value":2},{"op":"replace","path":"/name","value":"ChangedName"}]`, "", 0, errInvalidPatch},
+		{"RemoveName", `[{"op":"remove","path":"/name"}]`, "", 0, ErrInvalidUser},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var operations []patchOperation
+			mustUnmarshal(t, tt.patch, &operations)
+
+			patchedUser, err := applyJSONPatch(user, operations)
+			if tt.expectedErr != nil {
+				if !errors.Is(err, tt.expectedErr) {
+					t.Fatalf("%v must be thrown	err:%v", tt.expectedErr, err)
+				}
+				var perr *patchError
+				if errors.As(err, &perr) && perr.Index != tt.expectedIndex {
+					t.Errorf("Failing operation index must be reported	index:%d	want:%d", perr.Index, tt.expectedIndex)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if patchedUser.Name != tt.expectedName || patchedUser.Id != user.Id {
+				t.Errorf("User should be patched	patchedUser:%v", patchedUser)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package usrsvc
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type migration struct {
+	version int
+	name    string
+}
+
+// migrate applies the *.sql files of migrations which are not recorded in
+// the schema_migrations table yet, in the order of their numeric prefix,
+// e.g. 0001_create_users.sql. Each file runs in its own transaction, which
+// starts with lockStmt when it is not empty.
+func migrate(ctx context.Context, db *sql.DB, migrations fs.FS, lockStmt string) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return fmt.Errorf("migrate: could not create schema_migrations	err:%w", err)
+	}
+
+	migrationList, err := listMigrations(migrations)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrationList {
+		if err := applyMigration(ctx, db, migrations, m, lockStmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func listMigrations(migrations fs.FS) ([]migration, error) {
+	names, err := fs.Glob(migrations, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrationList []migration
+	for _, name := range names {
+		prefix, _, _ := strings.Cut(path.Base(name), "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migrate: invalid migration name	name:%s	err:%w", name, err)
+		}
+		migrationList = append(migrationList, migration{version: version, name: name})
+	}
+	sort.Slice(migrationList, func(i, j int) bool {
+		return migrationList[i].version < migrationList[j].version
+	})
+	for i := 1; i < len(migrationList); i++ {
+		if migrationList[i].version == migrationList[i-1].version {
+			return nil, fmt.Errorf("migrate: duplicated migration version	version:%d", migrationList[i].version)
+		}
+	}
+	return migrationList, nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, migrations fs.FS, m migration, lockStmt string) error {
+	script, err := fs.ReadFile(migrations, m.name)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if lockStmt != "" {
+		if _, err := tx.ExecContext(ctx, lockStmt); err != nil {
+			return fmt.Errorf("migrate: could not lock	err:%w", err)
+		}
+	}
+
+	var applied int
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM schema_migrations WHERE version = $1`, m.version).Scan(&applied)
+	if err != nil {
+		return fmt.Errorf("migrate: could not read schema_migrations	err:%w", err)
+	}
+	if applied > 0 {
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, string(script)); err != nil {
+		return fmt.Errorf("migrate: could not apply migration	name:%s	err:%w", m.name, err)
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, m.version); err != nil {
+		return fmt.Errorf("migrate: could not record migration	name:%s	err:%w", m.name, err)
+	}
+	return tx.Commit()
+}
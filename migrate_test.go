@@ -0,0 +1,35 @@
+package usrsvc
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestListMigrations(t *testing.T) {
+	migrations := fstest.MapFS{
+		"0010_add_index.sql":    {Data: []byte("")},
+		"0002_add_column.sql":   {Data: []byte("")},
+		"0001_create_users.sql": {Data: []byte("")},
+		"README.md":             {Data: []byte("")},
+	}
+	migrationList, err := listMigrations(migrations)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	var versions []int
+	for _, m := range migrationList {
+		versions = append(versions, m.version)
+	}
+	if len(versions) != 3 || versions[0] != 1 || versions[1] != 2 || versions[2] != 10 {
+		t.Errorf("Migrations must be ordered by version	versions:%v", versions)
+	}
+
+	migrations["0002_duplicated.sql"] = &fstest.MapFile{}
+	if _, err := listMigrations(migrations); err == nil {
+		t.Errorf("Error must be thrown for a duplicated version")
+	}
+
+	if _, err := listMigrations(fstest.MapFS{"init.sql": {}}); err == nil {
+		t.Errorf("Error must be thrown for a name without version")
+	}
+}
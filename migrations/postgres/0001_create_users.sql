@@ -0,0 +1,13 @@
+-- name uses the "C" collation so that it sorts like Go strings and
+-- prefix filters can use the index.
+CREATE TABLE users (
+    id         TEXT PRIMARY KEY,
+    name       TEXT COLLATE "C" NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL,
+    version    BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX users_created_at_idx ON users (created_at DESC, id);
+CREATE INDEX users_updated_at_idx ON users (updated_at, created_at DESC, id);
+CREATE INDEX users_name_idx ON users (name, created_at DESC, id);
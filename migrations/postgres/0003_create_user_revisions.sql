@@ -0,0 +1,11 @@
+-- user_revisions keeps a snapshot of every version of a user. Revisions are
+-- deleted along with their user.
+CREATE TABLE user_revisions (
+    user_id    TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    version    BIGINT NOT NULL,
+    action     TEXT NOT NULL,
+    actor      TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    snapshot   JSONB NOT NULL,
+    PRIMARY KEY (user_id, version)
+);
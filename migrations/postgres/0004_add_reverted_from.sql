@@ -0,0 +1,2 @@
+-- reverted_from is the version a revert revision restored.
+ALTER TABLE user_revisions ADD COLUMN reverted_from BIGINT;
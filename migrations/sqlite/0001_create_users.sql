@@ -0,0 +1,14 @@
+-- Timestamps are fixed-width UTC text (see sqliteTime), so that they sort
+-- chronologically. name uses the default BINARY collation, which sorts like
+-- Go strings.
+CREATE TABLE users (
+    id         TEXT PRIMARY KEY,
+    name       TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    updated_at TEXT NOT NULL,
+    version    INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX users_created_at_idx ON users (created_at DESC, id);
+CREATE INDEX users_updated_at_idx ON users (updated_at, created_at DESC, id);
+CREATE INDEX users_name_idx ON users (name, created_at DESC, id);
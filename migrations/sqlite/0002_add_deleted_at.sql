@@ -0,0 +1,4 @@
+-- deleted_at is set when a user is soft deleted.
+ALTER TABLE users ADD COLUMN deleted_at TEXT;
+
+CREATE INDEX users_deleted_at_idx ON users (deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,11 @@
+-- user_revisions keeps a snapshot of every version of a user. Revisions are
+-- deleted along with their user, as OpenSQLite enables foreign keys.
+CREATE TABLE user_revisions (
+    user_id    TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    version    INTEGER NOT NULL,
+    action     TEXT NOT NULL,
+    actor      TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    snapshot   TEXT NOT NULL,
+    PRIMARY KEY (user_id, version)
+);
@@ -0,0 +1,224 @@
+package usrsvc
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultListLimit = 20
+	maxListLimit     = 100
+)
+
+// ListSort is the order of IUserRepository.ListWithOptions.
+// A leading "-" means descending.
+type ListSort string
+
+const (
+	SortByCreatedAtDesc ListSort = "-createdAt"
+	SortByCreatedAtAsc  ListSort = "createdAt"
+	SortByUpdatedAtDesc ListSort = "-updatedAt"
+	SortByUpdatedAtAsc  ListSort = "updatedAt"
+	SortByNameDesc      ListSort = "-name"
+	SortByNameAsc       ListSort = "name"
+	SortByIdDesc        ListSort = "-id"
+	SortByIdAsc         ListSort = "id"
+)
+
+var listSorts = []ListSort{
+	SortByCreatedAtDesc,
+	SortByCreatedAtAsc,
+	SortByUpdatedAtDesc,
+	SortByUpdatedAtAsc,
+	SortByNameDesc,
+	SortByNameAsc,
+	SortByIdDesc,
+	SortByIdAsc,
+}
+
+// ListOptions controls the page returned by IUserRepository.ListWithOptions.
+type ListOptions struct {
+	// Limit is the maximum number of users in the page. Zero means 20.
+	Limit int
+
+	// Cursor is the NextCursor of the previous page. Empty means the first page.
+	Cursor string
+
+	// NamePrefix keeps the users whose name starts with it. It requires
+	// sorting by name.
+	NamePrefix string
+
+	// CreatedSince and CreatedBefore keep the users with
+	// CreatedSince <= CreatedAt < CreatedBefore. They require sorting by
+	// createdAt.
+	CreatedSince  time.Time
+	CreatedBefore time.Time
+
+	// UpdatedSince and UpdatedBefore keep the users with
+	// UpdatedSince <= UpdatedAt < UpdatedBefore. They require sorting by
+	// updatedAt.
+	UpdatedSince  time.Time
+	UpdatedBefore time.Time
+
+	// Sort is the order of the users. Empty means SortByCreatedAtDesc.
+	// Users with the same sort value are ordered by -createdAt.
+	Sort ListSort
+
+	// IncludeDeleted keeps soft deleted users, which are skipped by default.
+	IncludeDeleted bool
+}
+
+// UserPage is a page of users and the cursor to fetch the following one.
+type UserPage struct {
+	Users []*User
+
+	// NextCursor is empty when there are no more users.
+	NextCursor string
+}
+
+func (opts ListOptions) limit() int {
+	if opts.Limit <= 0 {
+		return defaultListLimit
+	}
+	if opts.Limit > maxListLimit {
+		return maxListLimit
+	}
+	return opts.Limit
+}
+
+func (opts ListOptions) sort() ListSort {
+	if opts.Sort == "" {
+		return SortByCreatedAtDesc
+	}
+	return opts.Sort
+}
+
+// field returns the sorted User field: "createdAt", "updatedAt", "name" or
+// "id".
+func (s ListSort) field() string {
+	return strings.TrimPrefix(string(s), "-")
+}
+
+func (s ListSort) descending() bool {
+	return strings.HasPrefix(string(s), "-")
+}
+
+// validate rejects unknown sorts and the filters which datastore can not
+// serve, since every inequality filter must be on the first sorted field.
+func (opts ListOptions) validate() error {
+	listSort := opts.sort()
+	valid := false
+	for _, s := range listSorts {
+		if s == listSort {
+			valid = true
+		}
+	}
+	if !valid {
+		return fmt.Errorf("%w: unknown sort %q", ErrInvalidListOptions, opts.Sort)
+	}
+
+	if opts.NamePrefix != "" && listSort.field() != "name" {
+		return fmt.Errorf("%w: namePrefix requires sorting by name", ErrInvalidListOptions)
+	}
+	if (!opts.CreatedSince.IsZero() || !opts.CreatedBefore.IsZero()) && listSort.field() != "createdAt" {
+		return fmt.Errorf("%w: createdAt range requires sorting by createdAt", ErrInvalidListOptions)
+	}
+	if (!opts.UpdatedSince.IsZero() || !opts.UpdatedBefore.IsZero()) && listSort.field() != "updatedAt" {
+		return fmt.Errorf("%w: updatedAt range requires sorting by updatedAt", ErrInvalidListOptions)
+	}
+	return nil
+}
+
+// match reports whether u passes the filters of opts.
+func (opts ListOptions) match(u *User) bool {
+	if opts.excludes(u) {
+		return false
+	}
+	if !strings.HasPrefix(u.Name, opts.NamePrefix) {
+		return false
+	}
+	if !inTimeRange(u.CreatedAt, opts.CreatedSince, opts.CreatedBefore) {
+		return false
+	}
+	return inTimeRange(u.UpdatedAt, opts.UpdatedSince, opts.UpdatedBefore)
+}
+
+// excludes reports whether u is soft deleted and opts skips it.
+func (opts ListOptions) excludes(u *User) bool {
+	return !opts.IncludeDeleted && u.isDeleted()
+}
+
+func inTimeRange(t time.Time, since time.Time, before time.Time) bool {
+	if !since.IsZero() && t.Before(since) {
+		return false
+	}
+	if !before.IsZero() && !t.Before(before) {
+		return false
+	}
+	return true
+}
+
+// sortUsers orders users by s, then by -CreatedAt and id.
+func sortUsers(users []*User, s ListSort) {
+	compare := func(a *User, b *User) int {
+		switch s.field() {
+		case "name":
+			return strings.Compare(a.Name, b.Name)
+		case "id":
+			return strings.Compare(a.Id, b.Id)
+		case "updatedAt":
+			return compareTime(a.UpdatedAt, b.UpdatedAt)
+		default:
+			return compareTime(a.CreatedAt, b.CreatedAt)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		c := compare(users[i], users[j])
+		if s.descending() {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+		if c = compareTime(users[i].CreatedAt, users[j].CreatedAt); c != 0 {
+			return c > 0
+		}
+		return users[i].Id < users[j].Id
+	})
+}
+
+func compareTime(a time.Time, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// encodeOffsetCursor and decodeOffsetCursor implement opaque cursors for
+// repositories without native query cursors.
+func encodeOffsetCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset)))
+}
+
+func decodeOffsetCursor(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidCursor, cursor)
+	}
+	offset, err := strconv.Atoi(string(b))
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidCursor, cursor)
+	}
+	return offset, nil
+}
@@ -0,0 +1,118 @@
+package usrsvc
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+)
+
+const (
+	contentTypeMergePatchJson = "application/merge-patch+json"
+)
+
+// readOnlyUserFields can not be changed by a patch.
+var readOnlyUserFields = []string{"id", "createdAt", "updatedAt", "version"}
+
+// userDocument returns the JSON document of u as served by the API.
+func userDocument(u *User) (map[string]interface{}, error) {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// userFromDocument converts a patched document of original back to a User.
+// It returns a ValidationError for unknown fields, changed read-only fields
+// and users failing isValid.
+func userFromDocument(original *User, doc map[string]interface{}) (*User, error) {
+	originalDoc, err := userDocument(original)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []FieldError
+	for _, name := range sortedKeys(doc) {
+		if _, ok := originalDoc[name]; !ok {
+			fields = append(fields, FieldError{Field: name, Code: "UNKNOWN", Detail: "unknown user field"})
+		}
+	}
+	for _, name := range readOnlyUserFields {
+		if !reflect.DeepEqual(originalDoc[name], doc[name]) {
+			fields = append(fields, FieldError{Field: name, Code: "READ_ONLY", Detail: "user field can not be changed"})
+		}
+	}
+	if len(fields) > 0 {
+		return nil, &ValidationError{Fields: fields}
+	}
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	user := &User{}
+	if err := json.Unmarshal(b, user); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return nil, &ValidationError{Fields: []FieldError{{Field: typeErr.Field, Code: "INVALID_TYPE", Detail: "user field has a wrong type"}}}
+		}
+		return nil, err
+	}
+
+	// Timestamps are compared on their JSON form, so keep the originals.
+	user.CreatedAt = original.CreatedAt
+	user.UpdatedAt = original.UpdatedAt
+
+	if err := user.isValid(); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// applyMergePatch applies an RFC 7396 JSON Merge Patch to u.
+func applyMergePatch(u *User, patch interface{}) (*User, error) {
+	doc, err := userDocument(u)
+	if err != nil {
+		return nil, err
+	}
+	patchedDoc, ok := mergePatch(doc, patch).(map[string]interface{})
+	if !ok {
+		return nil, &ValidationError{Fields: []FieldError{{Field: "", Code: "INVALID_TYPE", Detail: "user must be a JSON object"}}}
+	}
+	return userFromDocument(u, patchedDoc)
+}
+
+// mergePatch implements the MergePatch function of RFC 7396 section 2.
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+			continue
+		}
+		targetObject[name] = mergePatch(targetObject[name], value)
+	}
+	return targetObject
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
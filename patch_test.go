@@ -0,0 +1,49 @@
+package usrsvc
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// Test cases from RFC 7396 Appendix A.
+var mergePatchTests = []struct {
+	target   string
+	patch    string
+	expected string
+}{
+	{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+	{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+	{`{"a":"b"}`, `{"a":null}`, `{}`},
+	{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+	{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+	{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+	{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+	{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+	{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+	{`{"a":"b"}`, `["c"]`, `["c"]`},
+	{`{"a":"foo"}`, `null`, `null`},
+	{`{"a":"foo"}`, `"bar"`, `"bar"`},
+	{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+	{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+	{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+}
+
+func TestMergePatch(t *testing.T) {
+	for _, tt := range mergePatchTests {
+		var target, patch, expected interface{}
+		mustUnmarshal(t, tt.target, &target)
+		mustUnmarshal(t, tt.patch, &patch)
+		mustUnmarshal(t, tt.expected, &expected)
+
+		if actual := mergePatch(target, patch); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("mergePatch	target:%s	patch:%s	got:%v	want:%s", tt.target, tt.patch, actual, tt.expected)
+		}
+	}
+}
+
+func mustUnmarshal(t *testing.T, s string, v interface{}) {
+	if err := json.Unmarshal([]byte(s), v); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+}
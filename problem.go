@@ -0,0 +1,90 @@
+package usrsvc
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+const (
+	contentTypeProblemJson = "application/problem+json"
+)
+
+// Stable error codes carried by the code member of problem responses.
+const (
+	ErrorCodeInvalidRequestBody   = "INVALID_REQUEST_BODY"
+	ErrorCodeInvalidParameter     = "INVALID_PARAMETER"
+	ErrorCodeUnsupportedMedia     = "UNSUPPORTED_MEDIA_TYPE"
+	ErrorCodeInvalidUser          = "INVALID_USER"
+	ErrorCodeUserNotFound         = "USER_NOT_FOUND"
+	ErrorCodeRevisionNotFound     = "REVISION_NOT_FOUND"
+	ErrorCodeUserConflict         = "USER_CONFLICT"
+	ErrorCodeVersionMismatch      = "VERSION_MISMATCH"
+	ErrorCodePatchFailed          = "PATCH_FAILED"
+	ErrorCodeIdempotencyKeyReused = "IDEMPOTENCY_KEY_REUSED"
+	ErrorCodeIdempotencyKeyInUse  = "IDEMPOTENCY_KEY_IN_USE"
+	ErrorCodeForbidden            = "FORBIDDEN"
+	ErrorCodeUnsupported          = "UNSUPPORTED"
+	ErrorCodeInternal             = "INTERNAL_ERROR"
+)
+
+// problemResponse is an RFC 7807 problem detail extended with a stable
+// error code and, for validation failures, the invalid fields.
+type problemResponse struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Code     string       `json:"code"`
+	Errors   []FieldError `json:"errors,omitempty"`
+	// Operation is the index of the JSON Patch operation which failed.
+	Operation *int `json:"operation,omitempty"`
+}
+
+func newProblemResponse(r *http.Request, statusCode int, code string, detail string) *problemResponse {
+	return &problemResponse{
+		Type:     "about:blank",
+		Title:    http.StatusText(statusCode),
+		Status:   statusCode,
+		Detail:   detail,
+		Instance: r.URL.RequestURI(),
+		Code:     code,
+	}
+}
+
+func writeProblemResponse(w http.ResponseWriter, problem *problemResponse) {
+	w.Header().Set("Content-Type", contentTypeProblemJson)
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// writeErrorResponse writes the problem matching a repository or validation error.
+func writeErrorResponse(w http.ResponseWriter, r *http.Request, err error, detail string) {
+	problem := newProblemResponse(r, statusCodeFromError(err), errorCodeFromError(err), detail)
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		problem.Errors = verr.Fields
+	}
+	var perr *patchError
+	if errors.As(err, &perr) {
+		problem.Operation = &perr.Index
+		problem.Detail = perr.Error()
+	}
+	writeProblemResponse(w, problem)
+}
+
+// writeBadRequestResponse writes the problem for a malformed request body.
+func writeBadRequestResponse(w http.ResponseWriter, r *http.Request, detail string) {
+	writeProblemResponse(w, newProblemResponse(r, http.StatusBadRequest, ErrorCodeInvalidRequestBody, detail))
+}
+
+// writeInvalidParameterResponse writes the problem for an invalid query parameter.
+func writeInvalidParameterResponse(w http.ResponseWriter, r *http.Request, detail string) {
+	writeProblemResponse(w, newProblemResponse(r, http.StatusBadRequest, ErrorCodeInvalidParameter, detail))
+}
+
+// writeUnsupportedMediaTypeResponse writes the problem for a request body of the wrong Content-Type.
+func writeUnsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request, detail string) {
+	writeProblemResponse(w, newProblemResponse(r, http.StatusUnsupportedMediaType, ErrorCodeUnsupportedMedia, detail))
+}
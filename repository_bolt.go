@@ -0,0 +1,665 @@
+package usrsvc
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltUsersBucket     = []byte("users")
+	boltCreatedAtBucket = []byte("users_by_created_at")
+	boltDeletedAtBucket = []byte("users_by_deleted_at")
+	boltRevisionsBucket = []byte("user_revisions")
+)
+
+// boltTimeKeyLength is the length of the CreatedAt part of an index key.
+const boltTimeKeyLength = 12
+
+// boltRepository stores users as JSON in the users bucket, keyed by id.
+// The users_by_created_at bucket indexes them by CreatedAt followed by id,
+// so that listing by CreatedAt walks the index instead of every user, and
+// the users_by_deleted_at bucket indexes the soft deleted users by DeletedAt
+// followed by id for purging.
+// The user_revisions bucket holds a bucket of revisions per user, keyed by
+// version.
+type boltRepository struct {
+	db *bolt.DB
+}
+
+var _ IUserRepository = &boltRepository{}
+var _ RevisionRepository = &boltRepository{}
+
+// OpenBolt opens the bbolt database file at path and creates the buckets of
+// the repository. It waits up to timeout for the file lock, which another
+// process may hold.
+func OpenBolt(path string, timeout time.Duration) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltUsersBucket, boltCreatedAtBucket, boltRevisionsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket(boltDeletedAtBucket) == nil {
+			return createBoltDeletedAtIndex(tx)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// NewBoltRepository returns an IUserRepository backed by db, opened by
+// OpenBolt.
+func NewBoltRepository(db *bolt.DB) IUserRepository {
+	return newBoltRepository(db)
+}
+
+func newBoltRepository(db *bolt.DB) *boltRepository {
+	return &boltRepository{db: db}
+}
+
+// boltTimeKey encodes t so that byte order is chronological order: the
+// seconds with the sign bit flipped, then the nanoseconds.
+func boltTimeKey(t time.Time) []byte {
+	key := make([]byte, boltTimeKeyLength)
+	binary.BigEndian.PutUint64(key, uint64(t.Unix())^(1<<63))
+	binary.BigEndian.PutUint32(key[8:], uint32(t.Nanosecond()))
+	return key
+}
+
+func boltCreatedAtKey(user *User) []byte {
+	return append(boltTimeKey(user.CreatedAt), user.Id...)
+}
+
+func boltDeletedAtKey(user *User) []byte {
+	return append(boltTimeKey(user.DeletedAt), user.Id...)
+}
+
+// createBoltDeletedAtIndex creates the users_by_deleted_at bucket, indexing
+// the users soft deleted before the bucket existed.
+func createBoltDeletedAtIndex(tx *bolt.Tx) error {
+	index, err := tx.CreateBucket(boltDeletedAtBucket)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltUsersBucket).ForEach(func(k []byte, v []byte) error {
+		user := &User{}
+		if err := json.Unmarshal(v, user); err != nil {
+			return err
+		}
+		if !user.isDeleted() {
+			return nil
+		}
+		return index.Put(boltDeletedAtKey(user), nil)
+	})
+}
+
+func getBoltUser(tx *bolt.Tx, id string) (*User, error) {
+	value := tx.Bucket(boltUsersBucket).Get([]byte(id))
+	if value == nil {
+		return nil, ErrNotFound
+	}
+	user := &User{}
+	if err := json.Unmarshal(value, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// putBoltUser stores user and moves its index entries from storedUser,
+// which is nil for a new user.
+func putBoltUser(tx *bolt.Tx, user *User, storedUser *User) error {
+	value, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltUsersBucket).Put([]byte(user.Id), value); err != nil {
+		return err
+	}
+	if storedUser != nil {
+		if err := deleteBoltIndexEntries(tx, storedUser); err != nil {
+			return err
+		}
+	}
+	if err := tx.Bucket(boltCreatedAtBucket).Put(boltCreatedAtKey(user), nil); err != nil {
+		return err
+	}
+	if user.isDeleted() {
+		return tx.Bucket(boltDeletedAtBucket).Put(boltDeletedAtKey(user), nil)
+	}
+	return nil
+}
+
+func deleteBoltIndexEntries(tx *bolt.Tx, user *User) error {
+	if err := tx.Bucket(boltCreatedAtBucket).Delete(boltCreatedAtKey(user)); err != nil {
+		return err
+	}
+	if user.isDeleted() {
+		return tx.Bucket(boltDeletedAtBucket).Delete(boltDeletedAtKey(user))
+	}
+	return nil
+}
+
+// deleteBoltUser deletes user with its index entries and revisions.
+func deleteBoltUser(tx *bolt.Tx, user *User) error {
+	if err := tx.Bucket(boltUsersBucket).Delete([]byte(user.Id)); err != nil {
+		return err
+	}
+	if err := deleteBoltIndexEntries(tx, user); err != nil {
+		return err
+	}
+	revisions := tx.Bucket(boltRevisionsBucket)
+	if revisions.Bucket([]byte(user.Id)) == nil {
+		return nil
+	}
+	return revisions.DeleteBucket([]byte(user.Id))
+}
+
+// boltVersionKey encodes version so that byte order is numeric order.
+func boltVersionKey(version int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(version))
+	return key
+}
+
+func putBoltRevision(tx *bolt.Tx, revision *Revision) error {
+	revisions, err := tx.Bucket(boltRevisionsBucket).CreateBucketIfNotExists([]byte(revision.User.Id))
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(revision)
+	if err != nil {
+		return err
+	}
+	return revisions.Put(boltVersionKey(revision.Version), value)
+}
+
+// findBoltUserVersion reads the user and checks its version. version 0
+// matches any stored version.
+func findBoltUserVersion(tx *bolt.Tx, id string, version int64) (*User, error) {
+	user, err := getBoltUser(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if version != 0 && version != user.Version {
+		return nil, fmt.Errorf("%w	version:%d	storedVersion:%d", ErrVersionMismatch, version, user.Version)
+	}
+	return user, nil
+}
+
+func (repository *boltRepository) Create(ctx context.Context, user *User) error {
+
+	err := user.isValid()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	user.Version = 1
+
+	err = repository.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltUsersBucket).Get([]byte(user.Id)) != nil {
+			return fmt.Errorf("%w	id:%s", ErrConflict, user.Id)
+		}
+		if err := putBoltUser(tx, user, nil); err != nil {
+			return err
+		}
+		return putBoltRevision(tx, newRevision(ctx, RevisionActionCreate, user))
+	})
+	if err != nil {
+		return fmt.Errorf("bolt: could not create User: %v	err:%w", user, err)
+	}
+
+	return nil
+}
+
+func (repository *boltRepository) CreateMulti(ctx context.Context, userList []*User) ([]*UserResult, error) {
+
+	if len(userList) == 0 {
+		return nil, fmt.Errorf("%w: bolt: userList can not be empty", ErrInvalidUser)
+	}
+
+	for _, u := range userList {
+		err := u.isValid()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var results = make([]*UserResult, len(userList))
+	err := repository.db.Update(func(tx *bolt.Tx) error {
+		for i, u := range userList {
+			results[i] = &UserResult{Id: u.Id}
+			if tx.Bucket(boltUsersBucket).Get([]byte(u.Id)) != nil {
+				results[i].Err = fmt.Errorf("bolt: could not create User	id:%s	err: %w", u.Id, ErrConflict)
+				continue
+			}
+			if err := putBoltUser(tx, u, nil); err != nil {
+				return fmt.Errorf("bolt: could not create User: %v	err:%w", u, err)
+			}
+			if err := putBoltRevision(tx, newRevision(ctx, RevisionActionCreate, u)); err != nil {
+				return fmt.Errorf("bolt: could not create User: %v	err:%w", u, err)
+			}
+			results[i].User = u
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (repository *boltRepository) Find(ctx context.Context, id string) (*User, error) {
+	var user *User
+	err := repository.db.View(func(tx *bolt.Tx) error {
+		var err error
+		user, err = getBoltUser(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bolt: could not find User	id:%s	err: %w", id, err)
+	}
+	return user, nil
+}
+
+func (repository *boltRepository) FindMulti(ctx context.Context, ids []string) ([]*UserResult, error) {
+
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("%w: bolt: ids can not be empty", ErrInvalidUser)
+	}
+
+	for _, id := range ids {
+		if id == "" {
+			return nil, fmt.Errorf("%w: bolt: id can not be empty", ErrInvalidUser)
+		}
+	}
+
+	var results = make([]*UserResult, len(ids))
+	err := repository.db.View(func(tx *bolt.Tx) error {
+		for i, id := range ids {
+			results[i] = &UserResult{Id: id}
+			user, err := getBoltUser(tx, id)
+			if errors.Is(err, ErrNotFound) {
+				results[i].Err = fmt.Errorf("bolt: could not find User	id:%s	err: %w", id, err)
+				continue
+			} else if err != nil {
+				return fmt.Errorf("bolt: could not find User	id:%s	err: %w", id, err)
+			}
+			results[i].User = user
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (repository *boltRepository) Delete(ctx context.Context, id string) error {
+	_, err := repository.FindAndDelete(ctx, id, 0)
+	return err
+}
+
+func (repository *boltRepository) FindAndDelete(ctx context.Context, id string, version int64) (*User, error) {
+	var user *User
+	err := repository.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		user, err = findBoltUserVersion(tx, id, version)
+		if err != nil {
+			return err
+		}
+		return deleteBoltUser(tx, user)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bolt: could not delete User	id:%s	err: %w", id, err)
+	}
+	return user, nil
+}
+
+func (repository *boltRepository) DeleteMulti(ctx context.Context, userList []*User) ([]*UserResult, error) {
+
+	if len(userList) == 0 {
+		return nil, fmt.Errorf("%w: bolt: userList can not be empty", ErrInvalidUser)
+	}
+
+	for _, u := range userList {
+		err := u.isValid()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := repository.db.Update(func(tx *bolt.Tx) error {
+		for _, u := range userList {
+			storedUser, err := getBoltUser(tx, u.Id)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if err := deleteBoltUser(tx, storedUser); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deletedUserResults(userList), nil
+}
+
+func (repository *boltRepository) Update(ctx context.Context, user *User) error {
+	if user.Id == "" {
+		return fmt.Errorf("%w: user id empty User: %v", ErrInvalidUser, user)
+	}
+	var updatedUser *User
+	err := repository.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		updatedUser, err = updateBoltUser(ctx, tx, user, time.Now())
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("bolt: could not update User: %v	err:%w", user, err)
+	}
+	*user = *updatedUser
+	return nil
+}
+
+func (repository *boltRepository) UpdateMulti(ctx context.Context, userList []*User) ([]*UserResult, error) {
+	if err := validateUpdateList(userList); err != nil {
+		return nil, fmt.Errorf("bolt: could not update Users	err: %w", err)
+	}
+
+	results := make([]*UserResult, len(userList))
+	err := repository.db.Update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		for i, u := range userList {
+			results[i] = &UserResult{Id: u.Id}
+			updatedUser, err := updateBoltUser(ctx, tx, u, now)
+			if isUserError(err) {
+				results[i].Err = fmt.Errorf("bolt: could not update User	id:%s	err: %w", u.Id, err)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			results[i].User = updatedUser
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bolt: could not update Users	err: %w", err)
+	}
+	return results, nil
+}
+
+// updateBoltUser stores user like Update and returns it as stored.
+func updateBoltUser(ctx context.Context, tx *bolt.Tx, user *User, now time.Time) (*User, error) {
+	storedUser, err := findBoltUserVersion(tx, user.Id, user.Version)
+	if err != nil {
+		return nil, err
+	}
+	updatedUser := *user
+	updatedUser.Version = storedUser.Version + 1
+	updatedUser.UpdatedAt = now
+	if err := putBoltUser(tx, &updatedUser, storedUser); err != nil {
+		return nil, err
+	}
+	if err := putBoltRevision(tx, newRevision(ctx, updateAction(storedUser, &updatedUser), &updatedUser)); err != nil {
+		return nil, err
+	}
+	return &updatedUser, nil
+}
+
+func (repository *boltRepository) ListRevisions(ctx context.Context, id string, after int64, limit int) ([]*Revision, error) {
+	var revisions []*Revision
+	err := repository.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltRevisionsBucket).Bucket([]byte(id))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.Seek(boltVersionKey(after + 1)); k != nil && len(revisions) < limit; k, v = c.Next() {
+			revision := &Revision{}
+			if err := json.Unmarshal(v, revision); err != nil {
+				return err
+			}
+			revisions = append(revisions, revision)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bolt: could not retrieve Revision list	id:%s	Err:%w", id, err)
+	}
+	return revisions, nil
+}
+
+func (repository *boltRepository) FindRevision(ctx context.Context, id string, version int64) (*Revision, error) {
+	var revision *Revision
+	err := repository.db.View(func(tx *bolt.Tx) error {
+		var value []byte
+		if bucket := tx.Bucket(boltRevisionsBucket).Bucket([]byte(id)); bucket != nil {
+			value = bucket.Get(boltVersionKey(version))
+		}
+		if value == nil {
+			return ErrRevisionNotFound
+		}
+		revision = &Revision{}
+		return json.Unmarshal(value, revision)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bolt: could not find Revision	id:%s	version:%d	err: %w", id, version, err)
+	}
+	return revision, nil
+}
+
+func (repository *boltRepository) List(ctx context.Context) ([]*User, error) {
+	page, err := repository.ListWithOptions(ctx, ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return page.Users, nil
+}
+
+// ListDeleted walks the DeletedAt index from the oldest deletion.
+func (repository *boltRepository) ListDeleted(ctx context.Context, deletedBefore time.Time, limit int) ([]*User, error) {
+	before := boltTimeKey(deletedBefore)
+	var users []*User
+	err := repository.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltDeletedAtBucket).Cursor()
+		for k, _ := c.First(); k != nil && len(users) < limit; k, _ = c.Next() {
+			if bytes.Compare(k, before) >= 0 {
+				break
+			}
+			user, err := getBoltUser(tx, string(k[boltTimeKeyLength:]))
+			if err != nil {
+				return err
+			}
+			users = append(users, user)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bolt: could not retrieve deleted User list	Err:%w", err)
+	}
+	return users, nil
+}
+
+// ListWithOptions walks the CreatedAt index when sorting by createdAt, with
+// cursors holding the index key of the next user. Other sorts load every
+// user and use offset cursors.
+func (repository *boltRepository) ListWithOptions(ctx context.Context, opts ListOptions) (*UserPage, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	var page *UserPage
+	err := repository.db.View(func(tx *bolt.Tx) error {
+		var err error
+		if opts.sort().field() == "createdAt" {
+			page, err = listBoltUsersByCreatedAt(tx, opts)
+		} else {
+			page, err = listBoltUsers(tx, opts)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bolt: could not retrieve User list	Err:%w", err)
+	}
+	return page, nil
+}
+
+func listBoltUsersByCreatedAt(tx *bolt.Tx, opts ListOptions) (*UserPage, error) {
+	var start []byte
+	if opts.Cursor != "" {
+		cursor, err := base64.RawURLEncoding.DecodeString(opts.Cursor)
+		if err != nil || len(cursor) <= boltTimeKeyLength {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidCursor, opts.Cursor)
+		}
+		start = cursor
+	}
+
+	var since, before []byte
+	if !opts.CreatedSince.IsZero() {
+		since = boltTimeKey(opts.CreatedSince)
+	}
+	if !opts.CreatedBefore.IsZero() {
+		before = boltTimeKey(opts.CreatedBefore)
+	}
+
+	c := tx.Bucket(boltCreatedAtBucket).Cursor()
+	descending := opts.sort().descending()
+	var k []byte
+	var next func() ([]byte, []byte)
+	if descending {
+		// Walk the CreatedAt groups newest first but each group in ascending
+		// id order, which is how the other repositories break ties.
+		var prefix []byte
+		// group returns k if it is in the current group, or else the first
+		// key of the group before it.
+		group := func(k []byte) []byte {
+			if k != nil && bytes.HasPrefix(k, prefix) {
+				return k
+			}
+			if k, _ = c.Seek(prefix); k == nil {
+				k, _ = c.Last()
+			} else {
+				k, _ = c.Prev()
+			}
+			if k == nil {
+				return nil
+			}
+			prefix = append([]byte(nil), k[:boltTimeKeyLength]...)
+			k, _ = c.Seek(prefix)
+			return k
+		}
+		next = func() ([]byte, []byte) {
+			k, _ := c.Next()
+			return group(k), nil
+		}
+		switch {
+		case start != nil:
+			prefix = start[:boltTimeKeyLength]
+			k, _ = c.Seek(start)
+		case before != nil:
+			// Start in the group of the last key < before.
+			prefix = before
+		default:
+			// Start in the group of the last key, since no key sorts after
+			// this prefix.
+			prefix = bytes.Repeat([]byte{0xff}, boltTimeKeyLength)
+		}
+		k = group(k)
+	} else {
+		next = c.Next
+		switch {
+		case start != nil:
+			k, _ = c.Seek(start)
+		case since != nil:
+			k, _ = c.Seek(since)
+		default:
+			k, _ = c.First()
+		}
+	}
+
+	limit := opts.limit()
+	page := &UserPage{}
+	for ; k != nil; k, _ = next() {
+		if descending && since != nil && bytes.Compare(k, since) < 0 {
+			break
+		}
+		if !descending && before != nil && bytes.Compare(k, before) >= 0 {
+			break
+		}
+
+		user, err := getBoltUser(tx, string(k[boltTimeKeyLength:]))
+		if err != nil {
+			return nil, err
+		}
+		if !opts.match(user) {
+			continue
+		}
+		if len(page.Users) == limit {
+			page.NextCursor = base64.RawURLEncoding.EncodeToString(k)
+			break
+		}
+		page.Users = append(page.Users, user)
+	}
+	return page, nil
+}
+
+func listBoltUsers(tx *bolt.Tx, opts ListOptions) (*UserPage, error) {
+	offset, err := decodeOffsetCursor(opts.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []*User
+	err = tx.Bucket(boltUsersBucket).ForEach(func(k []byte, v []byte) error {
+		user := &User{}
+		if err := json.Unmarshal(v, user); err != nil {
+			return err
+		}
+		if opts.match(user) {
+			users = append(users, user)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortUsers(users, opts.sort())
+
+	page := &UserPage{}
+	if offset >= len(users) {
+		return page, nil
+	}
+	end := offset + opts.limit()
+	if end < len(users) {
+		page.NextCursor = encodeOffsetCursor(end)
+	} else {
+		end = len(users)
+	}
+	page.Users = users[offset:end]
+	return page, nil
+}
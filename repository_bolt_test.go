@@ -0,0 +1,96 @@
+package usrsvc
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func openTestBolt(t *testing.T) *bolt.DB {
+	db, err := OpenBolt(filepath.Join(t.TempDir(), "users.db"), time.Second)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestUserBoltRepository_WhenUpdatingCreatedAt_MoveTheIndexEntry(t *testing.T) {
+	ctx := context.Background()
+	db := openTestBolt(t)
+	repository := NewBoltRepository(db)
+
+	user := createTestUser(ctx, t, repository)
+	user.CreatedAt = user.CreatedAt.Add(-time.Hour)
+	if err := repository.Update(ctx, user); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	var keys [][]byte
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltCreatedAtBucket).ForEach(func(k []byte, v []byte) error {
+			keys = append(keys, append([]byte{}, k...))
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	if len(keys) != 1 || string(keys[0]) != string(boltCreatedAtKey(user)) {
+		t.Errorf("Index must have a single entry for the new CreatedAt	keys:%q", keys)
+	}
+}
+
+func TestBoltTimeKey_KeepChronologicalOrder(t *testing.T) {
+	times := []time.Time{
+		{},
+		time.Unix(-1, 999999999),
+		time.Unix(0, 0),
+		time.Unix(0, 1),
+		time.Now(),
+	}
+	for i := 1; i < len(times); i++ {
+		if string(boltTimeKey(times[i-1])) >= string(boltTimeKey(times[i])) {
+			t.Errorf("Keys must be ordered	before:%v	after:%v", times[i-1], times[i])
+		}
+	}
+}
+
+func TestOpenBolt_WhenDeletedAtIndexIsMissing_IndexTheDeletedUsers(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "users.db")
+	db, err := OpenBolt(path, time.Second)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	repository := NewBoltRepository(db)
+	user := createTestUser(ctx, t, repository)
+	user.DeletedAt = time.Now()
+	if err := repository.Update(ctx, user); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	// Databases written before the index existed have no bucket for it.
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(boltDeletedAtBucket)
+	})
+	db.Close()
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	db, err = OpenBolt(path, time.Second)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer db.Close()
+	deletedUsers, err := NewBoltRepository(db).ListDeleted(ctx, time.Now(), 10)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	if len(deletedUsers) != 1 || deletedUsers[0].Id != user.Id {
+		t.Errorf("Deleted user should be indexed when opening	deletedUsers:%v", deletedUsers)
+	}
+}
@@ -0,0 +1,379 @@
+package usrsvc
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultCacheSize  = 1000
+	defaultCacheTTL   = time.Minute
+	sharedCachePrefix = "usrsvc:user:"
+	// sharedCacheTombstoneTTL is how long an invalidated user can't be
+	// added to the shared cache. It must be longer than a read of the
+	// wrapped repository takes.
+	sharedCacheTombstoneTTL = 10 * time.Second
+)
+
+// sharedCacheTombstone replaces an invalidated user in the shared cache, so
+// that a lookup which read the previous version can't add it back.
+var sharedCacheTombstone = []byte("invalidated")
+
+// SharedCache is a cache shared by every instance of the service, such as
+// memcache or Redis. Errors are logged and treated as misses.
+type SharedCache interface {
+	Get(ctx context.Context, key string) (value []byte, ok bool, err error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Add stores value only if key is absent, like memcache Add or Redis
+	// SET NX, and reports whether it did.
+	Add(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+}
+
+// CacheStats counts the lookups of a CachingRepository.
+type CacheStats struct {
+	Hits         uint64 `json:"hits"`
+	Misses       uint64 `json:"misses"`
+	SharedHits   uint64 `json:"sharedHits"`
+	SharedMisses uint64 `json:"sharedMisses"`
+}
+
+// CachingRepository is an IUserRepository which serves Find from an LRU
+// cache with a TTL, in front of another IUserRepository. Update and Delete
+// invalidate the cached user, and concurrent misses for the same id share
+// a single lookup.
+type CachingRepository struct {
+	IUserRepository
+
+	size   int
+	ttl    time.Duration
+	shared SharedCache
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	// epoch is incremented by every invalidation, so that lookups which
+	// started before it don't cache what they read.
+	epoch uint64
+
+	group singleflight.Group
+
+	hits         atomic.Uint64
+	misses       atomic.Uint64
+	sharedHits   atomic.Uint64
+	sharedMisses atomic.Uint64
+}
+
+var _ IUserRepository = &CachingRepository{}
+var _ RevisionRepository = &CachingRepository{}
+
+type cacheEntry struct {
+	id        string
+	user      User
+	expiresAt time.Time
+}
+
+// CachingOption configures a CachingRepository created by
+// NewCachingRepository.
+type CachingOption func(repository *CachingRepository)
+
+// WithCacheSize sets how many users the local cache keeps.
+func WithCacheSize(size int) CachingOption {
+	return func(repository *CachingRepository) {
+		repository.size = size
+	}
+}
+
+// WithCacheTTL sets how long a cached user is served.
+func WithCacheTTL(ttl time.Duration) CachingOption {
+	return func(repository *CachingRepository) {
+		repository.ttl = ttl
+	}
+}
+
+// WithSharedCache adds a second tier which is looked up on local misses.
+func WithSharedCache(shared SharedCache) CachingOption {
+	return func(repository *CachingRepository) {
+		repository.shared = shared
+	}
+}
+
+// NewCachingRepository returns a CachingRepository in front of repository.
+// It caches 1000 users for a minute unless configured otherwise.
+func NewCachingRepository(repository IUserRepository, opts ...CachingOption) *CachingRepository {
+	c := &CachingRepository{
+		IUserRepository: repository,
+		size:            defaultCacheSize,
+		ttl:             defaultCacheTTL,
+		now:             time.Now,
+		entries:         map[string]*list.Element{},
+		lru:             list.New(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Stats returns the hit and miss counters.
+func (repository *CachingRepository) Stats() CacheStats {
+	return CacheStats{
+		Hits:         repository.hits.Load(),
+		Misses:       repository.misses.Load(),
+		SharedHits:   repository.sharedHits.Load(),
+		SharedMisses: repository.sharedMisses.Load(),
+	}
+}
+
+type freshReadKey struct{}
+
+// withFreshRead returns a copy of ctx whose Find skips the local cache.
+// Reads which precede a write use it, since other instances can't
+// invalidate the local cache and a stale user fails the If-Match check.
+func withFreshRead(ctx context.Context) context.Context {
+	return context.WithValue(ctx, freshReadKey{}, true)
+}
+
+func isFreshRead(ctx context.Context) bool {
+	fresh, _ := ctx.Value(freshReadKey{}).(bool)
+	return fresh
+}
+
+// Find returns the user from the local cache, the shared cache or the
+// wrapped repository, in that order. Writes on other instances invalidate
+// the shared cache only, so a local hit may be stale for up to the TTL.
+func (repository *CachingRepository) Find(ctx context.Context, id string) (*User, error) {
+	if !isFreshRead(ctx) {
+		if user, ok := repository.get(id); ok {
+			repository.hits.Add(1)
+			return user, nil
+		}
+	}
+	repository.misses.Add(1)
+
+	// The lookup is shared with other callers, so it must not be canceled
+	// with the context of the first one.
+	sharedCtx := context.WithoutCancel(ctx)
+	v, err, _ := repository.group.Do(id, func() (interface{}, error) {
+		epoch := repository.currentEpoch()
+		if user, ok := repository.getShared(sharedCtx, id); ok {
+			repository.add(user, epoch)
+			return user, nil
+		}
+		user, err := repository.IUserRepository.Find(sharedCtx, id)
+		if err != nil {
+			return nil, err
+		}
+		if repository.add(user, epoch) {
+			repository.addShared(sharedCtx, user)
+		}
+		return user, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	user := *v.(*User)
+	return &user, nil
+}
+
+func (repository *CachingRepository) Update(ctx context.Context, user *User) error {
+	defer repository.invalidate(ctx, user.Id)
+	return repository.IUserRepository.Update(ctx, user)
+}
+
+func (repository *CachingRepository) Delete(ctx context.Context, id string) error {
+	defer repository.invalidate(ctx, id)
+	return repository.IUserRepository.Delete(ctx, id)
+}
+
+func (repository *CachingRepository) FindAndDelete(ctx context.Context, id string, version int64) (*User, error) {
+	defer repository.invalidate(ctx, id)
+	return repository.IUserRepository.FindAndDelete(ctx, id, version)
+}
+
+// CreateMulti, FindMulti, DeleteMulti and UpdateMulti call the wrapped
+// repository, which must implement them. Writes invalidate the cached users.
+func (repository *CachingRepository) CreateMulti(ctx context.Context, userList []*User) ([]*UserResult, error) {
+	multi, err := repository.multi()
+	if err != nil {
+		return nil, err
+	}
+	defer repository.invalidateUsers(ctx, userList)
+	return multi.CreateMulti(ctx, userList)
+}
+
+func (repository *CachingRepository) FindMulti(ctx context.Context, ids []string) ([]*UserResult, error) {
+	multi, err := repository.multi()
+	if err != nil {
+		return nil, err
+	}
+	return multi.FindMulti(ctx, ids)
+}
+
+func (repository *CachingRepository) DeleteMulti(ctx context.Context, userList []*User) ([]*UserResult, error) {
+	multi, err := repository.multi()
+	if err != nil {
+		return nil, err
+	}
+	defer repository.invalidateUsers(ctx, userList)
+	return multi.DeleteMulti(ctx, userList)
+}
+
+func (repository *CachingRepository) UpdateMulti(ctx context.Context, userList []*User) ([]*UserResult, error) {
+	multi, err := repository.multi()
+	if err != nil {
+		return nil, err
+	}
+	defer repository.invalidateUsers(ctx, userList)
+	return multi.UpdateMulti(ctx, userList)
+}
+
+func (repository *CachingRepository) multi() (BatchUserRepository, error) {
+	multi, ok := repository.IUserRepository.(BatchUserRepository)
+	if !ok {
+		return nil, fmt.Errorf("%w: the cached repository does not support batches", errors.ErrUnsupported)
+	}
+	return multi, nil
+}
+
+func (repository *CachingRepository) invalidateUsers(ctx context.Context, userList []*User) {
+	for _, u := range userList {
+		repository.invalidate(ctx, u.Id)
+	}
+}
+
+// ListRevisions reads the revisions from the wrapped repository, which
+// must implement RevisionRepository.
+func (repository *CachingRepository) ListRevisions(ctx context.Context, id string, after int64, limit int) ([]*Revision, error) {
+	revisions, ok := repository.IUserRepository.(RevisionRepository)
+	if !ok {
+		return nil, fmt.Errorf("%w: the cached repository does not keep revisions", errors.ErrUnsupported)
+	}
+	return revisions.ListRevisions(ctx, id, after, limit)
+}
+
+// FindRevision reads the revision from the wrapped repository, which must
+// implement RevisionRepository.
+func (repository *CachingRepository) FindRevision(ctx context.Context, id string, version int64) (*Revision, error) {
+	revisions, ok := repository.IUserRepository.(RevisionRepository)
+	if !ok {
+		return nil, fmt.Errorf("%w: the cached repository does not keep revisions", errors.ErrUnsupported)
+	}
+	return revisions.FindRevision(ctx, id, version)
+}
+
+func (repository *CachingRepository) get(id string) (*User, bool) {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	element, ok := repository.entries[id]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if !repository.now().Before(entry.expiresAt) {
+		repository.lru.Remove(element)
+		delete(repository.entries, id)
+		return nil, false
+	}
+	repository.lru.MoveToFront(element)
+	user := entry.user
+	return &user, true
+}
+
+// add caches user unless an invalidation happened since epoch, in which
+// case it returns false.
+func (repository *CachingRepository) add(user *User, epoch uint64) bool {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	if epoch != repository.epoch {
+		return false
+	}
+	if repository.size <= 0 {
+		return true
+	}
+	entry := &cacheEntry{id: user.Id, user: *user, expiresAt: repository.now().Add(repository.ttl)}
+	if element, ok := repository.entries[user.Id]; ok {
+		element.Value = entry
+		repository.lru.MoveToFront(element)
+		return true
+	}
+	repository.entries[user.Id] = repository.lru.PushFront(entry)
+	for repository.lru.Len() > repository.size {
+		oldest := repository.lru.Back()
+		repository.lru.Remove(oldest)
+		delete(repository.entries, oldest.Value.(*cacheEntry).id)
+	}
+	return true
+}
+
+func (repository *CachingRepository) currentEpoch() uint64 {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+	return repository.epoch
+}
+
+func (repository *CachingRepository) invalidate(ctx context.Context, id string) {
+	repository.mu.Lock()
+	repository.epoch++
+	if element, ok := repository.entries[id]; ok {
+		repository.lru.Remove(element)
+		delete(repository.entries, id)
+	}
+	repository.mu.Unlock()
+
+	if repository.shared != nil {
+		if err := repository.shared.Set(ctx, sharedCachePrefix+id, sharedCacheTombstone, sharedCacheTombstoneTTL); err != nil {
+			log.Printf("CachingRepository.invalidate	id:%s	err:%v", id, err)
+		}
+	}
+}
+
+func (repository *CachingRepository) getShared(ctx context.Context, id string) (*User, bool) {
+	if repository.shared == nil {
+		return nil, false
+	}
+	value, ok, err := repository.shared.Get(ctx, sharedCachePrefix+id)
+	if err != nil {
+		log.Printf("CachingRepository.getShared	id:%s	err:%v", id, err)
+	}
+	if !ok || err != nil || bytes.Equal(value, sharedCacheTombstone) {
+		repository.sharedMisses.Add(1)
+		return nil, false
+	}
+	user := &User{}
+	if err := json.Unmarshal(value, user); err != nil {
+		log.Printf("CachingRepository.getShared	id:%s	err:%v", id, err)
+		repository.sharedMisses.Add(1)
+		return nil, false
+	}
+	repository.sharedHits.Add(1)
+	return user, true
+}
+
+// addShared adds user to the shared cache unless it already holds the user
+// or a tombstone, so that a user read before a write on another instance
+// doesn't replace the invalidation.
+func (repository *CachingRepository) addShared(ctx context.Context, user *User) {
+	if repository.shared == nil {
+		return
+	}
+	value, err := json.Marshal(user)
+	if err == nil {
+		_, err = repository.shared.Add(ctx, sharedCachePrefix+user.Id, value, repository.ttl)
+	}
+	if err != nil {
+		log.Printf("CachingRepository.addShared	id:%s	err:%v", user.Id, err)
+	}
+}
@@ -0,0 +1,354 @@
+package usrsvc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// countingRepository counts the calls of Find and can block them.
+type countingRepository struct {
+	IUserRepository
+	finds   atomic.Int64
+	release chan struct{}
+}
+
+func (repository *countingRepository) Find(ctx context.Context, id string) (*User, error) {
+	repository.finds.Add(1)
+	if repository.release != nil {
+		<-repository.release
+	}
+	return repository.IUserRepository.Find(ctx, id)
+}
+
+type mapSharedCache struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func (c *mapSharedCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok := c.values[key]
+	return value, ok, nil
+}
+
+func (c *mapSharedCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] = value
+	return nil
+}
+
+func (c *mapSharedCache) Add(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.values[key]; ok {
+		return false, nil
+	}
+	c.values[key] = value
+	return true, nil
+}
+
+func TestCachingRepository_Find(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		f    func(t *testing.T, origin *countingRepository, repository *CachingRepository, user *User)
+	}{
+		{
+			name: "Find_WhenCalledTwice_ReturnTheCachedUser",
+			f: func(t *testing.T, origin *countingRepository, repository *CachingRepository, user *User) {
+				for i := 0; i < 2; i++ {
+					if _, err := repository.Find(ctx, user.Id); err != nil {
+						t.Fatalf("err:%v", err)
+					}
+				}
+				if origin.finds.Load() != 1 {
+					t.Errorf("Second Find should hit the cache	finds:%d", origin.finds.Load())
+				}
+				if stats := repository.Stats(); stats.Hits != 1 || stats.Misses != 1 {
+					t.Errorf("Unexpected stats	stats:%+v", stats)
+				}
+			},
+		},
+
+		{
+			name: "Find_WhenModifyingTheReturnedUser_KeepTheCachedUser",
+			f: func(t *testing.T, origin *countingRepository, repository *CachingRepository, user *User) {
+				foundUser, _ := repository.Find(ctx, user.Id)
+				foundUser.Name = "Modified"
+				cachedUser, _ := repository.Find(ctx, user.Id)
+				if cachedUser.Name != user.Name {
+					t.Errorf("Cached user must not be shared	cachedUser:%v", cachedUser)
+				}
+			},
+		},
+
+		{
+			name: "Find_WhenUpdated_ReturnTheUpdatedUser",
+			f: func(t *testing.T, origin *countingRepository, repository *CachingRepository, user *User) {
+				repository.Find(ctx, user.Id)
+				user.Name = "Updated"
+				if err := repository.Update(ctx, user); err != nil {
+					t.Fatalf("err:%v", err)
+				}
+				foundUser, err := repository.Find(ctx, user.Id)
+				if err != nil {
+					t.Fatalf("err:%v", err)
+				}
+				if foundUser.Name != "Updated" || foundUser.Version != user.Version {
+					t.Errorf("Update must invalidate the cache	foundUser:%v", foundUser)
+				}
+			},
+		},
+
+		{
+			name: "Find_WhenDeleted_ReturnError",
+			f: func(t *testing.T, origin *countingRepository, repository *CachingRepository, user *User) {
+				repository.Find(ctx, user.Id)
+				if err := repository.Delete(ctx, user.Id); err != nil {
+					t.Fatalf("err:%v", err)
+				}
+				if foundUser, err := repository.Find(ctx, user.Id); err == nil {
+					t.Errorf("Delete must invalidate the cache	foundUser:%v", foundUser)
+				}
+			},
+		},
+
+		{
+			name: "Find_WhenTTLExpired_ReadTheRepository",
+			f: func(t *testing.T, origin *countingRepository, repository *CachingRepository, user *User) {
+				now := time.Now()
+				repository.now = func() time.Time { return now }
+				repository.Find(ctx, user.Id)
+				now = now.Add(defaultCacheTTL)
+				repository.Find(ctx, user.Id)
+				if origin.finds.Load() != 2 {
+					t.Errorf("Expired user should be read again	finds:%d", origin.finds.Load())
+				}
+			},
+		},
+
+		{
+			name: "Find_WhenCacheIsFull_EvictTheLeastRecentlyUsedUser",
+			f: func(t *testing.T, origin *countingRepository, repository *CachingRepository, user *User) {
+				repository.size = 1
+				otherUser := createTestUser(ctx, t, repository)
+				repository.Find(ctx, user.Id)
+				repository.Find(ctx, otherUser.Id)
+				repository.Find(ctx, user.Id)
+				if origin.finds.Load() != 3 {
+					t.Errorf("Evicted user should be read again	finds:%d", origin.finds.Load())
+				}
+			},
+		},
+
+		{
+			name: "Find_WhenMissingConcurrently_ReadTheRepositoryOnce",
+			f: func(t *testing.T, origin *countingRepository, repository *CachingRepository, user *User) {
+				origin.release = make(chan struct{})
+				var wg sync.WaitGroup
+				for i := 0; i < 10; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						if _, err := repository.Find(ctx, user.Id); err != nil {
+							t.Errorf("err:%v", err)
+						}
+					}()
+				}
+				for repository.Stats().Misses < 10 {
+					time.Sleep(time.Millisecond)
+				}
+				// Let the last callers join the lookup in flight.
+				time.Sleep(10 * time.Millisecond)
+				close(origin.release)
+				wg.Wait()
+				if origin.finds.Load() != 1 {
+					t.Errorf("Concurrent misses must be coalesced	finds:%d", origin.finds.Load())
+				}
+			},
+		},
+
+		{
+			name: "Find_WhenSharedCacheHasTheUser_SkipTheRepository",
+			f: func(t *testing.T, origin *countingRepository, repository *CachingRepository, user *User) {
+				shared := &mapSharedCache{values: map[string][]byte{}}
+				repository.shared = shared
+				repository.Find(ctx, user.Id)
+
+				otherInstance := NewCachingRepository(origin, WithSharedCache(shared))
+				foundUser, err := otherInstance.Find(ctx, user.Id)
+				if err != nil {
+					t.Fatalf("err:%v", err)
+				}
+				if foundUser.Name != user.Name || origin.finds.Load() != 1 {
+					t.Errorf("User should come from the shared cache	foundUser:%v	finds:%d", foundUser, origin.finds.Load())
+				}
+				if stats := otherInstance.Stats(); stats.SharedHits != 1 {
+					t.Errorf("Unexpected stats	stats:%+v", stats)
+				}
+
+				otherInstance.Delete(ctx, user.Id)
+				if _, ok := otherInstance.getShared(ctx, user.Id); ok {
+					t.Errorf("Delete must invalidate the shared cache	values:%v", shared.values)
+				}
+			},
+		},
+
+		{
+			name: "Find_WhenAnotherInstanceUpdated_ReturnTheUpdatedUserAfterTheTTL",
+			f: func(t *testing.T, origin *countingRepository, repository *CachingRepository, user *User) {
+				now := time.Now()
+				repository.now = func() time.Time { return now }
+				shared := &mapSharedCache{values: map[string][]byte{}}
+				repository.shared = shared
+				otherInstance := NewCachingRepository(origin, WithSharedCache(shared))
+				repository.Find(ctx, user.Id)
+
+				updatedUser, _ := otherInstance.Find(ctx, user.Id)
+				updatedUser.Name = "Updated"
+				if err := otherInstance.Update(ctx, updatedUser); err != nil {
+					t.Fatalf("err:%v", err)
+				}
+
+				if foundUser, _ := repository.Find(ctx, user.Id); foundUser.Name != user.Name {
+					t.Errorf("Local hit should be served until the TTL	foundUser:%v", foundUser)
+				}
+				now = now.Add(defaultCacheTTL)
+				foundUser, err := repository.Find(ctx, user.Id)
+				if err != nil {
+					t.Fatalf("err:%v", err)
+				}
+				if foundUser.Name != "Updated" || foundUser.Version != updatedUser.Version {
+					t.Errorf("Stale local user must not be served after the TTL	foundUser:%v", foundUser)
+				}
+			},
+		},
+
+		{
+			name: "Find_WhenLocalHit_SkipTheSharedCache",
+			f: func(t *testing.T, origin *countingRepository, repository *CachingRepository, user *User) {
+				repository.shared = &mapSharedCache{values: map[string][]byte{}}
+				for i := 0; i < 2; i++ {
+					if _, err := repository.Find(ctx, user.Id); err != nil {
+						t.Fatalf("err:%v", err)
+					}
+				}
+				stats := repository.Stats()
+				if stats.Hits != 1 || stats.SharedHits != 0 || stats.SharedMisses != 1 {
+					t.Errorf("Local hit must not look up the shared cache	stats:%+v", stats)
+				}
+			},
+		},
+
+		{
+			name: "Find_WhenFreshRead_SkipTheLocalCache",
+			f: func(t *testing.T, origin *countingRepository, repository *CachingRepository, user *User) {
+				repository.Find(ctx, user.Id)
+
+				// Written by another instance, which can't invalidate this one.
+				updatedUser, _ := origin.Find(ctx, user.Id)
+				updatedUser.Name = "Updated"
+				if err := origin.Update(ctx, updatedUser); err != nil {
+					t.Fatalf("err:%v", err)
+				}
+
+				foundUser, err := repository.Find(withFreshRead(ctx), user.Id)
+				if err != nil {
+					t.Fatalf("err:%v", err)
+				}
+				if foundUser.Name != "Updated" {
+					t.Errorf("Fresh read must skip the local cache	foundUser:%v", foundUser)
+				}
+				if foundUser, _ := repository.Find(ctx, user.Id); foundUser.Name != "Updated" {
+					t.Errorf("Fresh read should refresh the local cache	foundUser:%v", foundUser)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			origin := &countingRepository{IUserRepository: NewMemoryRepository()}
+			user := createTestUser(ctx, t, origin)
+			tt.f(t, origin, NewCachingRepository(origin), user)
+		})
+	}
+}
+
+func TestCachingRepository_WhenAnotherInstanceUpdated_AcceptTheCurrentETag(t *testing.T) {
+	ctx := context.Background()
+	origin := NewMemoryRepository()
+	user := createTestUser(ctx, t, origin)
+
+	instances := []*mux.Router{mux.NewRouter(), mux.NewRouter()}
+	for _, r := range instances {
+		RegisterService(r, NewService(NewCachingRepository(origin)))
+	}
+
+	url := "/v1/users/" + user.Id
+	rr := httptest.NewRecorder()
+	instances[1].ServeHTTP(rr, httptest.NewRequest("GET", url, nil))
+
+	for i, r := range instances {
+		req := httptest.NewRequest("PUT", url, strings.NewReader(fmt.Sprintf(`{"user":{"name":"Name%d"}}`, i)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("If-Match", (&User{Version: int64(i + 1)}).etag())
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Update with the current ETag should succeed	instance:%d	code:%d	body:%s", i, rr.Code, rr.Body)
+		}
+	}
+}
+
+// staleRepository returns the user it holds from Find, like a read which
+// happened just before another instance wrote the user.
+type staleRepository struct {
+	IUserRepository
+	user *User
+}
+
+func (repository *staleRepository) Find(ctx context.Context, id string) (*User, error) {
+	user := *repository.user
+	return &user, nil
+}
+
+func TestCachingRepository_WhenAnotherInstanceUpdatedDuringARead_KeepTheStaleUserOutOfTheSharedCache(t *testing.T) {
+	ctx := context.Background()
+	origin := NewMemoryRepository()
+	user := createTestUser(ctx, t, origin)
+	staleUser, _ := origin.Find(ctx, user.Id)
+
+	shared := &mapSharedCache{values: map[string][]byte{}}
+	reader := NewCachingRepository(&staleRepository{IUserRepository: origin, user: staleUser}, WithSharedCache(shared))
+	writer := NewCachingRepository(origin, WithSharedCache(shared))
+
+	updatedUser, _ := writer.Find(ctx, user.Id)
+	updatedUser.Name = "Updated"
+	if err := writer.Update(ctx, updatedUser); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	if _, err := reader.Find(ctx, user.Id); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	foundUser, err := NewCachingRepository(origin, WithSharedCache(shared)).Find(ctx, user.Id)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	if foundUser.Name != "Updated" || foundUser.Version != updatedUser.Version {
+		t.Errorf("Stale user must not be written back to the shared cache	foundUser:%v", foundUser)
+	}
+}
@@ -0,0 +1,569 @@
+package usrsvc
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	clouddatastore "cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// cloudDatastoreRepository stores users with the Cloud Datastore client,
+// which works outside the App Engine go1 runtime. Entities are the same as
+// the ones of datastoreRepository: kind "User" keyed by the user id.
+type cloudDatastoreRepository struct {
+	client *clouddatastore.Client
+}
+
+var _ IUserRepository = &cloudDatastoreRepository{}
+var _ RevisionRepository = &cloudDatastoreRepository{}
+
+// NewCloudDatastoreRepository returns an IUserRepository backed by client.
+// The client targets the local emulator when DATASTORE_EMULATOR_HOST is set.
+func NewCloudDatastoreRepository(client *clouddatastore.Client) IUserRepository {
+	return newCloudDatastoreRepository(client)
+}
+
+func newCloudDatastoreRepository(client *clouddatastore.Client) *cloudDatastoreRepository {
+	return &cloudDatastoreRepository{client: client}
+}
+
+func newCloudKey(id string) *clouddatastore.Key {
+	return clouddatastore.NameKey(kind, id, nil)
+}
+
+func newCloudRevisionKey(userKey *clouddatastore.Key, version int64) *clouddatastore.Key {
+	return clouddatastore.IDKey(revisionKind, version, userKey)
+}
+
+func newCloudKeys(userList []*User) ([]*clouddatastore.Key, error) {
+	var keys []*clouddatastore.Key
+	for _, u := range userList {
+		err := u.isValid()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, newCloudKey(u.Id))
+	}
+	return keys, nil
+}
+
+func (repository *cloudDatastoreRepository) Create(ctx context.Context, user *User) error {
+
+	err := user.isValid()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	user.Version = 1
+
+	key := newCloudKey(user.Id)
+	_, err = repository.client.RunInTransaction(ctx, func(tx *clouddatastore.Transaction) error {
+		err := tx.Get(key, &User{})
+		if err == nil {
+			return fmt.Errorf("%w	id:%s", ErrConflict, user.Id)
+		}
+		if err != clouddatastore.ErrNoSuchEntity {
+			return err
+		}
+		if _, err := tx.Put(key, user); err != nil {
+			return err
+		}
+		_, err = tx.Put(newCloudRevisionKey(key, user.Version), newRevision(ctx, RevisionActionCreate, user))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("clouddatastore: could not create User: %v	err:%w", user, err)
+	}
+
+	return nil
+}
+
+func (repository *cloudDatastoreRepository) CreateMulti(ctx context.Context, userList []*User) ([]*UserResult, error) {
+
+	if len(userList) == 0 {
+		return nil, fmt.Errorf("%w: clouddatastore: userList can not be empty", ErrInvalidUser)
+	}
+
+	keys, err := newCloudKeys(userList)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like Create, every group checks in a transaction that the ids are
+	// free. A failed transaction only fails the users of its group.
+	var results = make([]*UserResult, len(userList))
+	for start := 0; start < len(keys); start += datastoreTransactionGroups {
+		end := min(start+datastoreTransactionGroups, len(keys))
+		_, err := repository.client.RunInTransaction(ctx, func(tx *clouddatastore.Transaction) error {
+			return createCloudUsers(ctx, tx, keys[start:end], userList[start:end], results[start:end])
+		})
+		if err != nil {
+			for i := start; i < end; i++ {
+				results[i] = &UserResult{Id: userList[i].Id, Err: fmt.Errorf("clouddatastore: could not create User	id:%s	err: %w", userList[i].Id, err)}
+			}
+		}
+	}
+	return results, nil
+}
+
+// createCloudUsers stores the users of userList whose keys are free, with
+// their create revisions, and sets their results.
+func createCloudUsers(ctx context.Context, tx *clouddatastore.Transaction, keys []*clouddatastore.Key, userList []*User, results []*UserResult) error {
+	errs, err := cloudMultiErrors(tx.GetMulti(keys, make([]User, len(keys))), len(keys))
+	if err != nil {
+		return err
+	}
+
+	var putKeys, revisionKeys []*clouddatastore.Key
+	var putUsers []*User
+	var revisions []*Revision
+	for i, u := range userList {
+		results[i] = &UserResult{Id: u.Id}
+		switch {
+		case errs[i] == nil:
+			results[i].Err = fmt.Errorf("clouddatastore: could not create User	id:%s	err: %w", u.Id, ErrConflict)
+		case errs[i] == clouddatastore.ErrNoSuchEntity:
+			results[i].User = u
+			putKeys = append(putKeys, keys[i])
+			putUsers = append(putUsers, u)
+			revisionKeys = append(revisionKeys, newCloudRevisionKey(keys[i], u.Version))
+			revisions = append(revisions, newRevision(ctx, RevisionActionCreate, u))
+		default:
+			return errs[i]
+		}
+	}
+	if len(putKeys) == 0 {
+		return nil
+	}
+	if _, err := tx.PutMulti(putKeys, putUsers); err != nil {
+		return err
+	}
+	_, err = tx.PutMulti(revisionKeys, revisions)
+	return err
+}
+
+func (repository *cloudDatastoreRepository) Find(ctx context.Context, id string) (*User, error) {
+	if id == "" {
+		return nil, fmt.Errorf("clouddatastore: could not find User	id:%s	err: %w", id, ErrNotFound)
+	}
+	key := newCloudKey(id)
+	user := &User{}
+	if err := repository.client.Get(ctx, key, user); err != nil {
+		return nil, fmt.Errorf("clouddatastore: could not find User	id:%s	err: %w", id, cloudNotFoundError(err))
+	}
+	user.Id = key.Name
+	return user, nil
+}
+
+func (repository *cloudDatastoreRepository) FindMulti(ctx context.Context, ids []string) ([]*UserResult, error) {
+
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("%w: clouddatastore: ids can not be empty", ErrInvalidUser)
+	}
+
+	var keys []*clouddatastore.Key
+	for _, id := range ids {
+		if id == "" {
+			return nil, fmt.Errorf("%w: clouddatastore: id can not be empty", ErrInvalidUser)
+		}
+		keys = append(keys, newCloudKey(id))
+	}
+
+	var userList = make([]User, len(keys))
+
+	errs, err := cloudMultiErrors(repository.client.GetMulti(ctx, keys, userList), len(keys))
+	if err != nil {
+		return nil, fmt.Errorf("clouddatastore: could not find Users	ids:%v	err: %w", ids, err)
+	}
+
+	var results = make([]*UserResult, len(ids))
+	for i, key := range keys {
+		results[i] = &UserResult{Id: key.Name}
+		if errs[i] != nil {
+			results[i].Err = fmt.Errorf("clouddatastore: could not find User	id:%s	err: %w", key.Name, cloudNotFoundError(errs[i]))
+			continue
+		}
+		user := userList[i]
+		user.Id = key.Name
+		results[i].User = &user
+	}
+	return results, nil
+}
+
+func (repository *cloudDatastoreRepository) Delete(ctx context.Context, id string) error {
+	_, err := repository.FindAndDelete(ctx, id, 0)
+	return err
+}
+
+func (repository *cloudDatastoreRepository) FindAndDelete(ctx context.Context, id string, version int64) (*User, error) {
+	if id == "" {
+		return nil, fmt.Errorf("clouddatastore: user doesn't exist id%s	err: %w", id, ErrNotFound)
+	}
+
+	key := newCloudKey(id)
+	var user *User
+	var revisionKeys []*clouddatastore.Key
+	_, err := repository.client.RunInTransaction(ctx, func(tx *clouddatastore.Transaction) error {
+		user = &User{}
+		if err := tx.Get(key, user); err != nil {
+			return cloudNotFoundError(err)
+		}
+		if version != 0 && version != user.Version {
+			return fmt.Errorf("%w	version:%d	storedVersion:%d", ErrVersionMismatch, version, user.Version)
+		}
+		var err error
+		revisionKeys, err = repository.deleteUserWithRevisions(ctx, tx, key)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("clouddatastore: could not delete User	id:%s	err: %w", id, err)
+	}
+	if err := repository.deleteRevisionKeys(ctx, revisionKeys); err != nil {
+		return nil, fmt.Errorf("clouddatastore: could not delete Revisions	id:%s	err: %w", id, err)
+	}
+	user.Id = id
+	return user, nil
+}
+
+// deleteUserWithRevisions deletes the user with key and its revisions in
+// tx, like deleteUserWithRevisions of datastoreRepository.
+func (repository *cloudDatastoreRepository) deleteUserWithRevisions(ctx context.Context, tx *clouddatastore.Transaction, key *clouddatastore.Key) ([]*clouddatastore.Key, error) {
+	q := clouddatastore.NewQuery(revisionKind).Ancestor(key).KeysOnly().Transaction(tx)
+	revisionKeys, err := repository.client.GetAll(ctx, q, nil)
+	if err != nil {
+		return nil, err
+	}
+	split := max(0, len(revisionKeys)-(datastoreBatchSize-1))
+	if err := tx.DeleteMulti(append([]*clouddatastore.Key{key}, revisionKeys[split:]...)); err != nil {
+		return nil, err
+	}
+	return revisionKeys[:split], nil
+}
+
+func (repository *cloudDatastoreRepository) DeleteMulti(ctx context.Context, userList []*User) ([]*UserResult, error) {
+
+	if len(userList) == 0 {
+		return nil, fmt.Errorf("%w: clouddatastore: userList can not be empty", ErrInvalidUser)
+	}
+
+	keys, err := newCloudKeys(userList)
+	if err != nil {
+		return nil, err
+	}
+
+	errs, err := cloudMultiErrors(repository.client.DeleteMulti(ctx, keys), len(keys))
+	if err != nil {
+		return nil, err
+	}
+
+	var results = make([]*UserResult, len(userList))
+	for i, u := range userList {
+		results[i] = &UserResult{Id: u.Id}
+		if errs[i] != nil {
+			results[i].Err = fmt.Errorf("clouddatastore: could not delete User	id:%s	err: %w", u.Id, errs[i])
+			continue
+		}
+		if err := repository.deleteRevisions(ctx, keys[i]); err != nil {
+			results[i].Err = fmt.Errorf("clouddatastore: could not delete Revisions	id:%s	err: %w", u.Id, err)
+			continue
+		}
+		results[i].User = u
+	}
+	return results, nil
+}
+
+// deleteRevisions deletes the revisions of the user with key, like
+// deleteRevisions of datastoreRepository.
+func (repository *cloudDatastoreRepository) deleteRevisions(ctx context.Context, key *clouddatastore.Key) error {
+	q := clouddatastore.NewQuery(revisionKind).Ancestor(key).KeysOnly()
+	keys, err := repository.client.GetAll(ctx, q, nil)
+	if err != nil {
+		return err
+	}
+	return repository.deleteRevisionKeys(ctx, keys)
+}
+
+// deleteRevisionKeys deletes the revisions with keys in batches.
+func (repository *cloudDatastoreRepository) deleteRevisionKeys(ctx context.Context, keys []*clouddatastore.Key) error {
+	for start := 0; start < len(keys); start += datastoreBatchSize {
+		end := min(start+datastoreBatchSize, len(keys))
+		if err := repository.client.DeleteMulti(ctx, keys[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (repository *cloudDatastoreRepository) Update(ctx context.Context, user *User) error {
+	if user.Id == "" {
+		return fmt.Errorf("%w: user id empty User: %v", ErrInvalidUser, user)
+	}
+	key := newCloudKey(user.Id)
+	version := user.Version
+	updatedUser := *user
+	_, err := repository.client.RunInTransaction(ctx, func(tx *clouddatastore.Transaction) error {
+		storedUser := &User{}
+		if err := tx.Get(key, storedUser); err != nil {
+			return cloudNotFoundError(err)
+		}
+		if version != 0 && version != storedUser.Version {
+			return fmt.Errorf("%w	version:%d	storedVersion:%d", ErrVersionMismatch, version, storedUser.Version)
+		}
+		updatedUser.Version = storedUser.Version + 1
+		updatedUser.UpdatedAt = time.Now()
+		if _, err := tx.Put(key, &updatedUser); err != nil {
+			return err
+		}
+		revision := newRevision(ctx, updateAction(storedUser, &updatedUser), &updatedUser)
+		_, err := tx.Put(newCloudRevisionKey(key, updatedUser.Version), revision)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("clouddatastore: could not update User: %v	err:%w", user, err)
+	}
+	*user = updatedUser
+	return nil
+}
+
+func (repository *cloudDatastoreRepository) UpdateMulti(ctx context.Context, userList []*User) ([]*UserResult, error) {
+	if err := validateUpdateList(userList); err != nil {
+		return nil, fmt.Errorf("clouddatastore: could not update Users	err: %w", err)
+	}
+
+	keys := make([]*clouddatastore.Key, len(userList))
+	for i, u := range userList {
+		keys[i] = newCloudKey(u.Id)
+	}
+
+	// Like Update, every group reads and writes the users in a transaction.
+	// A failed transaction only fails the users of its group.
+	var results = make([]*UserResult, len(userList))
+	for start := 0; start < len(keys); start += datastoreTransactionGroups {
+		end := min(start+datastoreTransactionGroups, len(keys))
+		_, err := repository.client.RunInTransaction(ctx, func(tx *clouddatastore.Transaction) error {
+			return updateCloudUsers(ctx, tx, keys[start:end], userList[start:end], results[start:end])
+		})
+		if err != nil {
+			for i := start; i < end; i++ {
+				results[i] = &UserResult{Id: userList[i].Id, Err: fmt.Errorf("clouddatastore: could not update User	id:%s	err: %w", userList[i].Id, err)}
+			}
+		}
+	}
+	return results, nil
+}
+
+// updateCloudUsers stores the users of userList whose versions match, with
+// their revisions, and sets their results.
+func updateCloudUsers(ctx context.Context, tx *clouddatastore.Transaction, keys []*clouddatastore.Key, userList []*User, results []*UserResult) error {
+	storedUsers := make([]User, len(keys))
+	errs, err := cloudMultiErrors(tx.GetMulti(keys, storedUsers), len(keys))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var putKeys, revisionKeys []*clouddatastore.Key
+	var putUsers []*User
+	var revisions []*Revision
+	for i, u := range userList {
+		results[i] = &UserResult{Id: u.Id}
+		switch {
+		case errs[i] == clouddatastore.ErrNoSuchEntity:
+			results[i].Err = fmt.Errorf("clouddatastore: could not update User	id:%s	err: %w", u.Id, ErrNotFound)
+			continue
+		case errs[i] != nil:
+			return errs[i]
+		case u.Version != 0 && u.Version != storedUsers[i].Version:
+			results[i].Err = fmt.Errorf("clouddatastore: could not update User	id:%s	err: %w", u.Id, ErrVersionMismatch)
+			continue
+		}
+		updatedUser := *u
+		updatedUser.Version = storedUsers[i].Version + 1
+		updatedUser.UpdatedAt = now
+		results[i].User = &updatedUser
+		putKeys = append(putKeys, keys[i])
+		putUsers = append(putUsers, &updatedUser)
+		revisionKeys = append(revisionKeys, newCloudRevisionKey(keys[i], updatedUser.Version))
+		revisions = append(revisions, newRevision(ctx, updateAction(&storedUsers[i], &updatedUser), &updatedUser))
+	}
+	if len(putKeys) == 0 {
+		return nil
+	}
+	if _, err := tx.PutMulti(putKeys, putUsers); err != nil {
+		return err
+	}
+	_, err = tx.PutMulti(revisionKeys, revisions)
+	return err
+}
+
+func (repository *cloudDatastoreRepository) ListRevisions(ctx context.Context, id string, after int64, limit int) ([]*Revision, error) {
+	if id == "" {
+		return nil, nil
+	}
+	key := newCloudKey(id)
+	q := clouddatastore.NewQuery(revisionKind).Ancestor(key).Order("__key__").Limit(limit)
+	if after > 0 {
+		q = q.FilterField("__key__", ">", newCloudRevisionKey(key, after))
+	}
+	var revisions []*Revision
+	if _, err := repository.client.GetAll(ctx, q, &revisions); err != nil {
+		return nil, fmt.Errorf("clouddatastore: could not retrieve Revision list	id:%s	Err:%w", id, err)
+	}
+	for _, revision := range revisions {
+		revision.User.Id = id
+	}
+	return revisions, nil
+}
+
+func (repository *cloudDatastoreRepository) FindRevision(ctx context.Context, id string, version int64) (*Revision, error) {
+	if id == "" || version < 1 {
+		return nil, fmt.Errorf("clouddatastore: could not find Revision	id:%s	version:%d	err: %w", id, version, ErrRevisionNotFound)
+	}
+	revision := &Revision{}
+	if err := repository.client.Get(ctx, newCloudRevisionKey(newCloudKey(id), version), revision); err != nil {
+		if err == clouddatastore.ErrNoSuchEntity {
+			err = ErrRevisionNotFound
+		}
+		return nil, fmt.Errorf("clouddatastore: could not find Revision	id:%s	version:%d	err: %w", id, version, err)
+	}
+	revision.User.Id = id
+	return revision, nil
+}
+
+func (repository *cloudDatastoreRepository) List(ctx context.Context) ([]*User, error) {
+	page, err := repository.ListWithOptions(ctx, ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return page.Users, nil
+}
+
+func (repository *cloudDatastoreRepository) ListWithOptions(ctx context.Context, opts ListOptions) (*UserPage, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	limit := opts.limit()
+	// Soft deleted users are skipped while iterating, so the query has no
+	// limit and stops once the entity after the page is found.
+	q := newCloudListQuery(opts)
+	if opts.Cursor != "" {
+		cursor, err := clouddatastore.DecodeCursor(opts.Cursor)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidCursor, opts.Cursor)
+		}
+		q = q.Start(cursor)
+	}
+
+	page := &UserPage{}
+	var cursor clouddatastore.Cursor
+	it := repository.client.Run(ctx, q)
+	for {
+		user := &User{}
+		key, err := it.Next(user)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("clouddatastore: could not retrieve User list	Err:%w", err)
+		}
+		if opts.excludes(user) {
+			continue
+		}
+		if len(page.Users) == limit {
+			page.NextCursor = cursor.String()
+			break
+		}
+		user.Id = key.Name
+		page.Users = append(page.Users, user)
+		if len(page.Users) == limit {
+			if cursor, err = it.Cursor(); err != nil {
+				return nil, fmt.Errorf("clouddatastore: could not retrieve User list cursor	Err:%w", err)
+			}
+		}
+	}
+
+	return page, nil
+}
+
+// ListDeleted is the Cloud Datastore counterpart of
+// datastoreRepository.ListDeleted.
+func (repository *cloudDatastoreRepository) ListDeleted(ctx context.Context, deletedBefore time.Time, limit int) ([]*User, error) {
+	q := clouddatastore.NewQuery(kind).
+		FilterField("DeletedAt", ">", time.Time{}).
+		FilterField("DeletedAt", "<", deletedBefore).
+		Order("DeletedAt").
+		Limit(limit)
+
+	var users []*User
+	keys, err := repository.client.GetAll(ctx, q, &users)
+	if err != nil {
+		return nil, fmt.Errorf("clouddatastore: could not retrieve deleted User list	Err:%w", err)
+	}
+	for i, key := range keys {
+		users[i].Id = key.Name
+	}
+	return users, nil
+}
+
+// newCloudListQuery is the Cloud Datastore counterpart of newListQuery and
+// needs the same index.yaml.
+func newCloudListQuery(opts ListOptions) *clouddatastore.Query {
+	q := clouddatastore.NewQuery(kind)
+
+	if opts.NamePrefix != "" {
+		q = q.FilterField("Name", ">=", opts.NamePrefix).FilterField("Name", "<", opts.NamePrefix+"\ufffd")
+	}
+	if !opts.CreatedSince.IsZero() {
+		q = q.FilterField("CreatedAt", ">=", opts.CreatedSince)
+	}
+	if !opts.CreatedBefore.IsZero() {
+		q = q.FilterField("CreatedAt", "<", opts.CreatedBefore)
+	}
+	if !opts.UpdatedSince.IsZero() {
+		q = q.FilterField("UpdatedAt", ">=", opts.UpdatedSince)
+	}
+	if !opts.UpdatedBefore.IsZero() {
+		q = q.FilterField("UpdatedAt", "<", opts.UpdatedBefore)
+	}
+
+	listSort := opts.sort()
+	property := listSortProperties[listSort.field()]
+	if listSort.descending() {
+		q = q.Order("-" + property)
+	} else {
+		q = q.Order(property)
+	}
+	// Keys are unique, so they need no tiebreak.
+	if property != "CreatedAt" && property != "__key__" {
+		q = q.Order("-CreatedAt")
+	}
+	return q
+}
+
+// cloudNotFoundError translates clouddatastore.ErrNoSuchEntity into
+// ErrNotFound.
+func cloudNotFoundError(err error) error {
+	if err == clouddatastore.ErrNoSuchEntity {
+		return ErrNotFound
+	}
+	return err
+}
+
+// cloudMultiErrors returns the error of each of the n keys of a GetMulti or
+// DeleteMulti, unpacking a clouddatastore.MultiError. Any other error fails
+// the call as a whole and is returned.
+func cloudMultiErrors(err error, n int) ([]error, error) {
+	if err == nil {
+		return make([]error, n), nil
+	}
+	if merr, ok := err.(clouddatastore.MultiError); ok && len(merr) == n {
+		return merr, nil
+	}
+	return nil, err
+}
@@ -0,0 +1,41 @@
+package usrsvc_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	clouddatastore "cloud.google.com/go/datastore"
+	usrsvc "github.com/yusuke0913/app-engine-golang-user-crud-api"
+	"github.com/yusuke0913/app-engine-golang-user-crud-api/usrsvctest"
+)
+
+func TestUserCloudDatastoreRepository(t *testing.T) {
+	if os.Getenv("DATASTORE_EMULATOR_HOST") == "" {
+		t.Skip("DATASTORE_EMULATOR_HOST is not set")
+	}
+	projectID := os.Getenv("DATASTORE_PROJECT_ID")
+	if projectID == "" {
+		projectID = "usrsvc-test"
+	}
+
+	ctx := context.Background()
+	client, err := clouddatastore.NewClient(ctx, projectID)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer client.Close()
+
+	usrsvctest.RunRepositoryConformance(t, ctx, func() usrsvc.IUserRepository {
+		for _, k := range []string{"User", "UserRevision"} {
+			keys, err := client.GetAll(ctx, clouddatastore.NewQuery(k).KeysOnly(), nil)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if err := client.DeleteMulti(ctx, keys); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+		}
+		return usrsvc.NewCloudDatastoreRepository(client)
+	})
+}
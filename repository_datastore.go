@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"time"
 
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 )
 
@@ -12,15 +13,40 @@ type datastoreRepository struct {
 }
 
 var _ IUserRepository = &datastoreRepository{}
+var _ RevisionRepository = &datastoreRepository{}
+
+// NewDatastoreRepository returns an IUserRepository backed by the App Engine datastore.
+func NewDatastoreRepository() IUserRepository {
+	return newRepository()
+}
+
+func newRepository() *datastoreRepository {
+	return &datastoreRepository{}
+}
 
 const (
-	kind = "User"
+	kind         = "User"
+	revisionKind = "UserRevision"
+
+	// datastoreBatchSize is the most entities a single datastore call may
+	// write or delete.
+	datastoreBatchSize = 500
+
+	// datastoreTransactionGroups is the most entity groups, so users, a
+	// cross-group transaction may write.
+	datastoreTransactionGroups = 25
 )
 
 func newKey(ctx context.Context, id string) *datastore.Key {
 	return datastore.NewKey(ctx, kind, id, 0, nil)
 }
 
+// newRevisionKey returns the key of a revision, a child of the user key
+// numbered by version.
+func newRevisionKey(ctx context.Context, userKey *datastore.Key, version int64) *datastore.Key {
+	return datastore.NewKey(ctx, revisionKind, "", version, userKey)
+}
+
 func newKeys(ctx context.Context, userList []*User) ([]*datastore.Key, error) {
 	var keys []*datastore.Key
 	for _, u := range userList {
@@ -37,7 +63,7 @@ func newKeysByIds(ctx context.Context, ids []string) ([]*datastore.Key, error) {
 	var keys []*datastore.Key
 	for _, id := range ids {
 		if id == "" {
-			return nil, fmt.Errorf("datastore: id can not be empty")
+			return nil, fmt.Errorf("%w: datastore: id can not be empty", ErrInvalidUser)
 		}
 		keys = append(keys, newKey(ctx, id))
 	}
@@ -54,56 +80,111 @@ func (repository *datastoreRepository) Create(ctx context.Context, user *User) e
 	now := time.Now()
 	user.CreatedAt = now
 	user.UpdatedAt = now
+	user.Version = 1
 
-	key := datastore.NewKey(ctx, kind, user.Id, 0, nil)
-	key, err = datastore.Put(ctx, key, user)
+	key := newKey(ctx, user.Id)
+	err = datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		err := datastore.Get(tc, key, &User{})
+		if err == nil {
+			return fmt.Errorf("%w	id:%s", ErrConflict, user.Id)
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if _, err := datastore.Put(tc, key, user); err != nil {
+			return err
+		}
+		_, err = datastore.Put(tc, newRevisionKey(tc, key, user.Version), newRevision(ctx, RevisionActionCreate, user))
+		return err
+	}, nil)
 	if err != nil {
-		return fmt.Errorf("datastore: could not create User: %v	err:%v", user, err)
+		return fmt.Errorf("datastore: could not create User: %v	err:%w", user, err)
 	}
 
 	return nil
 }
 
-func (repository *datastoreRepository) CreateMulti(ctx context.Context, userList []*User) error {
+func (repository *datastoreRepository) CreateMulti(ctx context.Context, userList []*User) ([]*UserResult, error) {
 
 	if len(userList) == 0 {
-		return fmt.Errorf("datastore: userList can not be empty")
+		return nil, fmt.Errorf("%w: datastore: userList can not be empty", ErrInvalidUser)
 	}
 
-	var keys []*datastore.Key
-	for _, u := range userList {
-		err := u.isValid()
+	keys, err := newKeys(ctx, userList)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like Create, every group checks in a transaction that the ids are
+	// free. A failed transaction only fails the users of its group.
+	var results = make([]*UserResult, len(userList))
+	for start := 0; start < len(keys); start += datastoreTransactionGroups {
+		end := min(start+datastoreTransactionGroups, len(keys))
+		err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+			return createUsers(tc, keys[start:end], userList[start:end], results[start:end])
+		}, &datastore.TransactionOptions{XG: true})
 		if err != nil {
-			return err
+			for i := start; i < end; i++ {
+				results[i] = &UserResult{Id: userList[i].Id, Err: fmt.Errorf("datastore: could not create User	id:%s	err: %w", userList[i].Id, err)}
+			}
 		}
-		keys = append(keys, newKey(ctx, u.Id))
 	}
-	// log.Printf("CreateMulti	keys:%v", keys)
-
-	keys, err := datastore.PutMulti(ctx, keys, userList)
+	return results, nil
+}
 
+// createUsers stores the users of userList whose keys are free, with their
+// create revisions, and sets their results.
+func createUsers(tc context.Context, keys []*datastore.Key, userList []*User, results []*UserResult) error {
+	errs, err := multiErrors(datastore.GetMulti(tc, keys, make([]User, len(keys))), len(keys))
 	if err != nil {
 		return err
 	}
-	// log.Printf("CreateMulti	userList:%v", userList)
 
-	return nil
+	var putKeys, revisionKeys []*datastore.Key
+	var putUsers []*User
+	var revisions []*Revision
+	for i, u := range userList {
+		results[i] = &UserResult{Id: u.Id}
+		switch {
+		case errs[i] == nil:
+			results[i].Err = fmt.Errorf("datastore: could not create User	id:%s	err: %w", u.Id, ErrConflict)
+		case errs[i] == datastore.ErrNoSuchEntity:
+			results[i].User = u
+			putKeys = append(putKeys, keys[i])
+			putUsers = append(putUsers, u)
+			revisionKeys = append(revisionKeys, newRevisionKey(tc, keys[i], u.Version))
+			revisions = append(revisions, newRevision(tc, RevisionActionCreate, u))
+		default:
+			return errs[i]
+		}
+	}
+	if len(putKeys) == 0 {
+		return nil
+	}
+	if _, err := datastore.PutMulti(tc, putKeys, putUsers); err != nil {
+		return err
+	}
+	_, err = datastore.PutMulti(tc, revisionKeys, revisions)
+	return err
 }
 
 func (repository *datastoreRepository) Find(ctx context.Context, id string) (*User, error) {
+	if id == "" {
+		return nil, fmt.Errorf("datastore: could not find User	id:%s	err: %w", id, ErrNotFound)
+	}
 	key := datastore.NewKey(ctx, kind, id, 0, nil)
 	user := &User{}
 	if err := datastore.Get(ctx, key, user); err != nil {
-		return nil, fmt.Errorf("datastore: could not find User	id:%s	err: %v", id, err)
+		return nil, fmt.Errorf("datastore: could not find User	id:%s	err: %w", id, notFoundError(err))
 	}
 	user.Id = key.StringID()
 	return user, nil
 }
 
-func (repository *datastoreRepository) FindMulti(ctx context.Context, ids []string) ([]*User, error) {
+func (repository *datastoreRepository) FindMulti(ctx context.Context, ids []string) ([]*UserResult, error) {
 
 	if len(ids) == 0 {
-		return nil, fmt.Errorf("datastore: ids can not be empty")
+		return nil, fmt.Errorf("%w: datastore: ids can not be empty", ErrInvalidUser)
 	}
 
 	keys, err := newKeysByIds(ctx, ids)
@@ -111,83 +192,403 @@ func (repository *datastoreRepository) FindMulti(ctx context.Context, ids []stri
 		return nil, err
 	}
 
-	// log.Printf("DeleteMulti	keys:%v", keys)
+	var userList = make([]User, len(keys))
 
-	var userList = make([]*User, len(keys))
-
-	err = datastore.GetMulti(ctx, keys, userList)
+	errs, err := multiErrors(datastore.GetMulti(ctx, keys, userList), len(keys))
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("datastore: could not find Users	ids:%v	err: %w", ids, err)
 	}
 
-	return userList, nil
+	var results = make([]*UserResult, len(ids))
+	for i, id := range ids {
+		results[i] = &UserResult{Id: id}
+		if errs[i] != nil {
+			results[i].Err = fmt.Errorf("datastore: could not find User	id:%s	err: %w", id, notFoundError(errs[i]))
+			continue
+		}
+		user := userList[i]
+		user.Id = id
+		results[i].User = &user
+	}
+	return results, nil
 }
 
 func (repository *datastoreRepository) Delete(ctx context.Context, id string) error {
-	user, err := repository.Find(ctx, id)
-	if err != nil {
+	_, err := repository.FindAndDelete(ctx, id, 0)
+	return err
+}
+
+func (repository *datastoreRepository) FindAndDelete(ctx context.Context, id string, version int64) (*User, error) {
+	if id == "" {
+		return nil, fmt.Errorf("datastore: user doesn't exist id%s	err: %w", id, ErrNotFound)
+	}
+
+	key := newKey(ctx, id)
+	var user *User
+	var revisionKeys []*datastore.Key
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		user = &User{}
+		if err := datastore.Get(tc, key, user); err != nil {
+			return notFoundError(err)
+		}
+		if version != 0 && version != user.Version {
+			return fmt.Errorf("%w	version:%d	storedVersion:%d", ErrVersionMismatch, version, user.Version)
+		}
+		var err error
+		revisionKeys, err = deleteUserWithRevisions(tc, key)
 		return err
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("datastore: could not delete User	id:%s	err: %w", id, err)
 	}
-	if user == nil {
-		return fmt.Errorf("datastore: user doesn't exist id%s", id)
+	if err := deleteRevisionKeys(ctx, revisionKeys); err != nil {
+		return nil, fmt.Errorf("datastore: could not delete Revisions	id:%s	err: %w", id, err)
 	}
+	user.Id = id
+	return user, nil
+}
 
-	key := datastore.NewKey(ctx, kind, id, 0, nil)
-	err = datastore.Delete(ctx, key)
+// deleteUserWithRevisions deletes the user with key and its revisions in
+// the transaction tc. A commit takes up to datastoreBatchSize entities, so
+// the oldest revisions of a longer history are left to the caller, whose
+// keys it returns.
+func deleteUserWithRevisions(tc context.Context, key *datastore.Key) ([]*datastore.Key, error) {
+	revisionKeys, err := datastore.NewQuery(revisionKind).Ancestor(key).KeysOnly().GetAll(tc, nil)
 	if err != nil {
-		return fmt.Errorf("datastore: could not delete User	id:%s	err: %v", id, err)
+		return nil, err
 	}
-	return nil
+	split := max(0, len(revisionKeys)-(datastoreBatchSize-1))
+	if err := datastore.DeleteMulti(tc, append([]*datastore.Key{key}, revisionKeys[split:]...)); err != nil {
+		return nil, err
+	}
+	return revisionKeys[:split], nil
 }
 
-func (repository *datastoreRepository) DeleteMulti(ctx context.Context, userList []*User) error {
+func (repository *datastoreRepository) DeleteMulti(ctx context.Context, userList []*User) ([]*UserResult, error) {
 
 	if len(userList) == 0 {
-		return fmt.Errorf("datastore: userList can not be empty")
+		return nil, fmt.Errorf("%w: datastore: userList can not be empty", ErrInvalidUser)
 	}
 
 	keys, err := newKeys(ctx, userList)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// log.Printf("DeleteMulti	keys:%v", keys)
+	errs, err := multiErrors(datastore.DeleteMulti(ctx, keys), len(keys))
+	if err != nil {
+		return nil, err
+	}
 
-	err = datastore.DeleteMulti(ctx, keys)
+	var results = make([]*UserResult, len(userList))
+	for i, u := range userList {
+		results[i] = &UserResult{Id: u.Id}
+		if errs[i] != nil {
+			results[i].Err = fmt.Errorf("datastore: could not delete User	id:%s	err: %w", u.Id, errs[i])
+			continue
+		}
+		if err := deleteRevisions(ctx, keys[i]); err != nil {
+			results[i].Err = fmt.Errorf("datastore: could not delete Revisions	id:%s	err: %w", u.Id, err)
+			continue
+		}
+		results[i].User = u
+	}
+	return results, nil
+}
 
+// deleteRevisions deletes the revisions of the user with key, for deletes
+// which don't run in a transaction.
+func deleteRevisions(ctx context.Context, key *datastore.Key) error {
+	keys, err := datastore.NewQuery(revisionKind).Ancestor(key).KeysOnly().GetAll(ctx, nil)
 	if err != nil {
 		return err
 	}
+	return deleteRevisionKeys(ctx, keys)
+}
 
+// deleteRevisionKeys deletes the revisions with keys in batches.
+func deleteRevisionKeys(ctx context.Context, keys []*datastore.Key) error {
+	for start := 0; start < len(keys); start += datastoreBatchSize {
+		end := min(start+datastoreBatchSize, len(keys))
+		if err := datastore.DeleteMulti(ctx, keys[start:end]); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (repository *datastoreRepository) Update(ctx context.Context, user *User) error {
 	if user.Id == "" {
-		return fmt.Errorf("user id empty User: %v", user)
+		return fmt.Errorf("%w: user id empty User: %v", ErrInvalidUser, user)
 	}
-	key := datastore.NewKey(ctx, kind, user.Id, 0, nil)
-	user.UpdatedAt = time.Now()
-	key, err := datastore.Put(ctx, key, user)
+	key := newKey(ctx, user.Id)
+	version := user.Version
+	updatedUser := *user
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		storedUser := &User{}
+		if err := datastore.Get(tc, key, storedUser); err != nil {
+			return notFoundError(err)
+		}
+		if version != 0 && version != storedUser.Version {
+			return fmt.Errorf("%w	version:%d	storedVersion:%d", ErrVersionMismatch, version, storedUser.Version)
+		}
+		updatedUser.Version = storedUser.Version + 1
+		updatedUser.UpdatedAt = time.Now()
+		if _, err := datastore.Put(tc, key, &updatedUser); err != nil {
+			return err
+		}
+		revision := newRevision(ctx, updateAction(storedUser, &updatedUser), &updatedUser)
+		_, err := datastore.Put(tc, newRevisionKey(tc, key, updatedUser.Version), revision)
+		return err
+	}, nil)
 	if err != nil {
-		return fmt.Errorf("datastore: could not update User: %v	err:%v", user, err)
+		return fmt.Errorf("datastore: could not update User: %v	err:%w", user, err)
 	}
+	*user = updatedUser
 	return nil
 }
 
+func (repository *datastoreRepository) UpdateMulti(ctx context.Context, userList []*User) ([]*UserResult, error) {
+	if err := validateUpdateList(userList); err != nil {
+		return nil, fmt.Errorf("datastore: could not update Users	err: %w", err)
+	}
+
+	keys := make([]*datastore.Key, len(userList))
+	for i, u := range userList {
+		keys[i] = newKey(ctx, u.Id)
+	}
+
+	// Like Update, every group reads and writes the users in a transaction.
+	// A failed transaction only fails the users of its group.
+	var results = make([]*UserResult, len(userList))
+	for start := 0; start < len(keys); start += datastoreTransactionGroups {
+		end := min(start+datastoreTransactionGroups, len(keys))
+		err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+			return updateUsers(tc, keys[start:end], userList[start:end], results[start:end])
+		}, &datastore.TransactionOptions{XG: true})
+		if err != nil {
+			for i := start; i < end; i++ {
+				results[i] = &UserResult{Id: userList[i].Id, Err: fmt.Errorf("datastore: could not update User	id:%s	err: %w", userList[i].Id, err)}
+			}
+		}
+	}
+	return results, nil
+}
+
+// updateUsers stores the users of userList whose versions match, with
+// their revisions, and sets their results.
+func updateUsers(tc context.Context, keys []*datastore.Key, userList []*User, results []*UserResult) error {
+	storedUsers := make([]User, len(keys))
+	errs, err := multiErrors(datastore.GetMulti(tc, keys, storedUsers), len(keys))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var putKeys, revisionKeys []*datastore.Key
+	var putUsers []*User
+	var revisions []*Revision
+	for i, u := range userList {
+		results[i] = &UserResult{Id: u.Id}
+		switch {
+		case errs[i] == datastore.ErrNoSuchEntity:
+			results[i].Err = fmt.Errorf("datastore: could not update User	id:%s	err: %w", u.Id, ErrNotFound)
+			continue
+		case errs[i] != nil:
+			return errs[i]
+		case u.Version != 0 && u.Version != storedUsers[i].Version:
+			results[i].Err = fmt.Errorf("datastore: could not update User	id:%s	err: %w", u.Id, ErrVersionMismatch)
+			continue
+		}
+		updatedUser := *u
+		updatedUser.Version = storedUsers[i].Version + 1
+		updatedUser.UpdatedAt = now
+		results[i].User = &updatedUser
+		putKeys = append(putKeys, keys[i])
+		putUsers = append(putUsers, &updatedUser)
+		revisionKeys = append(revisionKeys, newRevisionKey(tc, keys[i], updatedUser.Version))
+		revisions = append(revisions, newRevision(tc, updateAction(&storedUsers[i], &updatedUser), &updatedUser))
+	}
+	if len(putKeys) == 0 {
+		return nil
+	}
+	if _, err := datastore.PutMulti(tc, putKeys, putUsers); err != nil {
+		return err
+	}
+	_, err = datastore.PutMulti(tc, revisionKeys, revisions)
+	return err
+}
+
+func (repository *datastoreRepository) ListRevisions(ctx context.Context, id string, after int64, limit int) ([]*Revision, error) {
+	if id == "" {
+		return nil, nil
+	}
+	key := newKey(ctx, id)
+	// Ancestor queries ordered by key need no composite index.
+	q := datastore.NewQuery(revisionKind).Ancestor(key).Order("__key__").Limit(limit)
+	if after > 0 {
+		q = q.Filter("__key__ >", newRevisionKey(ctx, key, after))
+	}
+	var revisions []*Revision
+	if _, err := q.GetAll(ctx, &revisions); err != nil {
+		return nil, fmt.Errorf("datastore: could not retrieve Revision list	id:%s	Err:%w", id, err)
+	}
+	for _, revision := range revisions {
+		revision.User.Id = id
+	}
+	return revisions, nil
+}
+
+func (repository *datastoreRepository) FindRevision(ctx context.Context, id string, version int64) (*Revision, error) {
+	if id == "" || version < 1 {
+		return nil, fmt.Errorf("datastore: could not find Revision	id:%s	version:%d	err: %w", id, version, ErrRevisionNotFound)
+	}
+	revision := &Revision{}
+	if err := datastore.Get(ctx, newRevisionKey(ctx, newKey(ctx, id), version), revision); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			err = ErrRevisionNotFound
+		}
+		return nil, fmt.Errorf("datastore: could not find Revision	id:%s	version:%d	err: %w", id, version, err)
+	}
+	revision.User.Id = id
+	return revision, nil
+}
+
 func (repository *datastoreRepository) List(ctx context.Context) ([]*User, error) {
-	q := datastore.NewQuery(kind).Order("-CreatedAt").Limit(20)
+	page, err := repository.ListWithOptions(ctx, ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return page.Users, nil
+}
+
+func (repository *datastoreRepository) ListWithOptions(ctx context.Context, opts ListOptions) (*UserPage, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	limit := opts.limit()
+	// Soft deleted users are skipped while iterating, so the query has no
+	// limit and stops once the entity after the page is found.
+	q := newListQuery(opts)
+	if opts.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(opts.Cursor)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidCursor, opts.Cursor)
+		}
+		q = q.Start(cursor)
+	}
+
+	page := &UserPage{}
+	var cursor datastore.Cursor
+	it := q.Run(ctx)
+	for {
+		user := &User{}
+		key, err := it.Next(user)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("datastore: could not retrieve User list	Err:%w", err)
+		}
+		if opts.excludes(user) {
+			continue
+		}
+		if len(page.Users) == limit {
+			page.NextCursor = cursor.String()
+			break
+		}
+		user.Id = key.StringID()
+		page.Users = append(page.Users, user)
+		if len(page.Users) == limit {
+			if cursor, err = it.Cursor(); err != nil {
+				return nil, fmt.Errorf("datastore: could not retrieve User list cursor	Err:%w", err)
+			}
+		}
+	}
+
+	return page, nil
+}
+
+// ListDeleted queries the DeletedAt index. Active users store the zero
+// time, which sorts before every deletion.
+func (repository *datastoreRepository) ListDeleted(ctx context.Context, deletedBefore time.Time, limit int) ([]*User, error) {
+	q := datastore.NewQuery(kind).
+		Filter("DeletedAt >", time.Time{}).
+		Filter("DeletedAt <", deletedBefore).
+		Order("DeletedAt").
+		Limit(limit)
+
 	var users []*User
 	keys, err := q.GetAll(ctx, &users)
 	if err != nil {
-		return nil, fmt.Errorf("datastore: could not retrieve User list	Err:%v", err)
+		return nil, fmt.Errorf("datastore: could not retrieve deleted User list	Err:%w", err)
+	}
+	for i, key := range keys {
+		users[i].Id = key.StringID()
+	}
+	return users, nil
+}
+
+var listSortProperties = map[string]string{
+	"createdAt": "CreatedAt",
+	"updatedAt": "UpdatedAt",
+	"name":      "Name",
+	"id":        "__key__",
+}
+
+// newListQuery builds the query for opts. Sorting by another property than
+// CreatedAt needs the composite indexes in index.yaml.
+func newListQuery(opts ListOptions) *datastore.Query {
+	q := datastore.NewQuery(kind)
+
+	if opts.NamePrefix != "" {
+		q = q.Filter("Name >=", opts.NamePrefix).Filter("Name <", opts.NamePrefix+"\ufffd")
+	}
+	if !opts.CreatedSince.IsZero() {
+		q = q.Filter("CreatedAt >=", opts.CreatedSince)
+	}
+	if !opts.CreatedBefore.IsZero() {
+		q = q.Filter("CreatedAt <", opts.CreatedBefore)
+	}
+	if !opts.UpdatedSince.IsZero() {
+		q = q.Filter("UpdatedAt >=", opts.UpdatedSince)
+	}
+	if !opts.UpdatedBefore.IsZero() {
+		q = q.Filter("UpdatedAt <", opts.UpdatedBefore)
 	}
 
-	for i := 0; i < len(keys); i++ {
-		// log.Printf("%#v", keys[i])
-		users[i].Id = keys[i].StringID()
+	listSort := opts.sort()
+	property := listSortProperties[listSort.field()]
+	if listSort.descending() {
+		q = q.Order("-" + property)
+	} else {
+		q = q.Order(property)
+	}
+	// Keys are unique, so they need no tiebreak.
+	if property != "CreatedAt" && property != "__key__" {
+		q = q.Order("-CreatedAt")
 	}
+	return q
+}
 
-	// log.Printf("%#v", users)
-	return users, nil
+// notFoundError translates datastore.ErrNoSuchEntity into ErrNotFound.
+func notFoundError(err error) error {
+	if err == datastore.ErrNoSuchEntity {
+		return ErrNotFound
+	}
+	return err
+}
+
+// multiErrors returns the error of each of the n keys of a GetMulti or
+// DeleteMulti, unpacking an appengine.MultiError. Any other error fails the
+// call as a whole and is returned.
+func multiErrors(err error, n int) ([]error, error) {
+	if err == nil {
+		return make([]error, n), nil
+	}
+	if merr, ok := err.(appengine.MultiError); ok && len(merr) == n {
+		return merr, nil
+	}
+	return nil, err
 }
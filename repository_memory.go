@@ -0,0 +1,315 @@
+package usrsvc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type memoryRepository struct {
+	mu        sync.RWMutex
+	users     map[string]User
+	revisions map[string][]Revision
+}
+
+var _ IUserRepository = &memoryRepository{}
+var _ RevisionRepository = &memoryRepository{}
+
+// NewMemoryRepository returns an IUserRepository which keeps users in memory.
+// It is safe for concurrent use and is meant for tests and local development.
+func NewMemoryRepository() IUserRepository {
+	return newMemoryRepository()
+}
+
+func newMemoryRepository() *memoryRepository {
+	return &memoryRepository{
+		users:     map[string]User{},
+		revisions: map[string][]Revision{},
+	}
+}
+
+func (repository *memoryRepository) Create(ctx context.Context, user *User) error {
+
+	err := user.isValid()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	user.Version = 1
+
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+	if _, ok := repository.users[user.Id]; ok {
+		return fmt.Errorf("memory: could not create User: %v	err:%w", user, ErrConflict)
+	}
+	repository.users[user.Id] = *user
+	repository.revisions[user.Id] = []Revision{*newRevision(ctx, RevisionActionCreate, user)}
+
+	return nil
+}
+
+func (repository *memoryRepository) CreateMulti(ctx context.Context, userList []*User) ([]*UserResult, error) {
+
+	if len(userList) == 0 {
+		return nil, fmt.Errorf("%w: memory: userList can not be empty", ErrInvalidUser)
+	}
+
+	for _, u := range userList {
+		err := u.isValid()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	var results = make([]*UserResult, len(userList))
+	for i, u := range userList {
+		results[i] = &UserResult{Id: u.Id}
+		if _, ok := repository.users[u.Id]; ok {
+			results[i].Err = fmt.Errorf("memory: could not create User	id:%s	err: %w", u.Id, ErrConflict)
+			continue
+		}
+		repository.users[u.Id] = *u
+		repository.revisions[u.Id] = []Revision{*newRevision(ctx, RevisionActionCreate, u)}
+		results[i].User = u
+	}
+
+	return results, nil
+}
+
+func (repository *memoryRepository) Find(ctx context.Context, id string) (*User, error) {
+	repository.mu.RLock()
+	defer repository.mu.RUnlock()
+
+	user, ok := repository.users[id]
+	if !ok {
+		return nil, fmt.Errorf("memory: could not find User	id:%s	err: %w", id, ErrNotFound)
+	}
+	return &user, nil
+}
+
+func (repository *memoryRepository) FindMulti(ctx context.Context, ids []string) ([]*UserResult, error) {
+
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("%w: memory: ids can not be empty", ErrInvalidUser)
+	}
+
+	for _, id := range ids {
+		if id == "" {
+			return nil, fmt.Errorf("%w: memory: id can not be empty", ErrInvalidUser)
+		}
+	}
+
+	repository.mu.RLock()
+	defer repository.mu.RUnlock()
+
+	var results = make([]*UserResult, len(ids))
+	for i, id := range ids {
+		results[i] = &UserResult{Id: id}
+		user, ok := repository.users[id]
+		if !ok {
+			results[i].Err = fmt.Errorf("memory: could not find User	id:%s	err: %w", id, ErrNotFound)
+			continue
+		}
+		results[i].User = &user
+	}
+
+	return results, nil
+}
+
+func (repository *memoryRepository) Delete(ctx context.Context, id string) error {
+	_, err := repository.FindAndDelete(ctx, id, 0)
+	return err
+}
+
+func (repository *memoryRepository) FindAndDelete(ctx context.Context, id string, version int64) (*User, error) {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	user, ok := repository.users[id]
+	if !ok {
+		return nil, fmt.Errorf("memory: user doesn't exist id%s	err: %w", id, ErrNotFound)
+	}
+	if version != 0 && version != user.Version {
+		return nil, fmt.Errorf("memory: could not delete User	id:%s	err: %w", id, ErrVersionMismatch)
+	}
+	delete(repository.users, id)
+	delete(repository.revisions, id)
+	return &user, nil
+}
+
+func (repository *memoryRepository) DeleteMulti(ctx context.Context, userList []*User) ([]*UserResult, error) {
+
+	if len(userList) == 0 {
+		return nil, fmt.Errorf("%w: memory: userList can not be empty", ErrInvalidUser)
+	}
+
+	for _, u := range userList {
+		err := u.isValid()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+	for _, u := range userList {
+		delete(repository.users, u.Id)
+		delete(repository.revisions, u.Id)
+	}
+
+	return deletedUserResults(userList), nil
+}
+
+func (repository *memoryRepository) Update(ctx context.Context, user *User) error {
+	if user.Id == "" {
+		return fmt.Errorf("%w: user id empty User: %v", ErrInvalidUser, user)
+	}
+
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	storedUser, ok := repository.users[user.Id]
+	if !ok {
+		return fmt.Errorf("memory: could not update User: %v	err:%w", user, ErrNotFound)
+	}
+	if user.Version != 0 && user.Version != storedUser.Version {
+		return fmt.Errorf("memory: could not update User: %v	err:%w", user, ErrVersionMismatch)
+	}
+	user.Version = storedUser.Version + 1
+	user.UpdatedAt = time.Now()
+	repository.users[user.Id] = *user
+	revision := newRevision(ctx, updateAction(&storedUser, user), user)
+	repository.revisions[user.Id] = append(repository.revisions[user.Id], *revision)
+	return nil
+}
+
+func (repository *memoryRepository) UpdateMulti(ctx context.Context, userList []*User) ([]*UserResult, error) {
+	if err := validateUpdateList(userList); err != nil {
+		return nil, fmt.Errorf("memory: could not update Users	err: %w", err)
+	}
+
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	now := time.Now()
+	results := make([]*UserResult, len(userList))
+	for i, u := range userList {
+		results[i] = &UserResult{Id: u.Id}
+		storedUser, ok := repository.users[u.Id]
+		if !ok {
+			results[i].Err = fmt.Errorf("memory: could not update User	id:%s	err: %w", u.Id, ErrNotFound)
+			continue
+		}
+		if u.Version != 0 && u.Version != storedUser.Version {
+			results[i].Err = fmt.Errorf("memory: could not update User	id:%s	err: %w", u.Id, ErrVersionMismatch)
+			continue
+		}
+		updatedUser := *u
+		updatedUser.Version = storedUser.Version + 1
+		updatedUser.UpdatedAt = now
+		repository.users[u.Id] = updatedUser
+		revision := newRevision(ctx, updateAction(&storedUser, &updatedUser), &updatedUser)
+		repository.revisions[u.Id] = append(repository.revisions[u.Id], *revision)
+		results[i].User = &updatedUser
+	}
+	return results, nil
+}
+
+func (repository *memoryRepository) ListRevisions(ctx context.Context, id string, after int64, limit int) ([]*Revision, error) {
+	repository.mu.RLock()
+	defer repository.mu.RUnlock()
+
+	var revisions []*Revision
+	for _, revision := range repository.revisions[id] {
+		if len(revisions) == limit {
+			break
+		}
+		if revision.Version > after {
+			revision := revision
+			revisions = append(revisions, &revision)
+		}
+	}
+	return revisions, nil
+}
+
+func (repository *memoryRepository) FindRevision(ctx context.Context, id string, version int64) (*Revision, error) {
+	repository.mu.RLock()
+	defer repository.mu.RUnlock()
+
+	for _, revision := range repository.revisions[id] {
+		if revision.Version == version {
+			return &revision, nil
+		}
+	}
+	return nil, fmt.Errorf("memory: could not find Revision	id:%s	version:%d	err: %w", id, version, ErrRevisionNotFound)
+}
+
+func (repository *memoryRepository) List(ctx context.Context) ([]*User, error) {
+	page, err := repository.ListWithOptions(ctx, ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return page.Users, nil
+}
+
+func (repository *memoryRepository) ListDeleted(ctx context.Context, deletedBefore time.Time, limit int) ([]*User, error) {
+	repository.mu.RLock()
+	defer repository.mu.RUnlock()
+
+	var users []*User
+	for id := range repository.users {
+		user := repository.users[id]
+		if user.isDeleted() && user.DeletedAt.Before(deletedBefore) {
+			users = append(users, &user)
+		}
+	}
+
+	sortDeletedUsers(users)
+	if len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+func (repository *memoryRepository) ListWithOptions(ctx context.Context, opts ListOptions) (*UserPage, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	offset, err := decodeOffsetCursor(opts.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	repository.mu.RLock()
+	defer repository.mu.RUnlock()
+
+	users := make([]*User, 0, len(repository.users))
+	for id := range repository.users {
+		user := repository.users[id]
+		if opts.match(&user) {
+			users = append(users, &user)
+		}
+	}
+
+	sortUsers(users, opts.sort())
+
+	page := &UserPage{}
+	if offset >= len(users) {
+		return page, nil
+	}
+	end := offset + opts.limit()
+	if end < len(users) {
+		page.NextCursor = encodeOffsetCursor(end)
+	} else {
+		end = len(users)
+	}
+	page.Users = users[offset:end]
+	return page, nil
+}
@@ -0,0 +1,445 @@
+package usrsvc
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"time"
+)
+
+//go:embed migrations/postgres/*.sql
+var postgresMigrations embed.FS
+
+// postgresMigrationLock serializes migrations of concurrently starting
+// instances.
+const postgresMigrationLock = "SELECT pg_advisory_xact_lock(7205617391)"
+
+type postgresRepository struct {
+	db *sql.DB
+}
+
+var _ IUserRepository = &postgresRepository{}
+var _ RevisionRepository = &postgresRepository{}
+
+// NewPostgresRepository returns an IUserRepository which stores users in the
+// users table of db. The schema is created by MigratePostgres.
+func NewPostgresRepository(db *sql.DB) IUserRepository {
+	return newPostgresRepository(db)
+}
+
+func newPostgresRepository(db *sql.DB) *postgresRepository {
+	return &postgresRepository{db: db}
+}
+
+// MigratePostgres brings the schema of db up to date with the embedded
+// migrations/postgres files.
+func MigratePostgres(ctx context.Context, db *sql.DB) error {
+	migrations, err := fs.Sub(postgresMigrations, "migrations/postgres")
+	if err != nil {
+		return err
+	}
+	return migrate(ctx, db, migrations, postgresMigrationLock)
+}
+
+func scanPostgresUser(row rowScanner) (*User, error) {
+	user := &User{}
+	var deletedAt sql.NullTime
+	err := row.Scan(&user.Id, &user.Name, &user.CreatedAt, &user.UpdatedAt, &user.Version, &deletedAt)
+	if err != nil {
+		return nil, err
+	}
+	user.DeletedAt = deletedAt.Time
+	return user, nil
+}
+
+// postgresNow returns the current time with the microsecond precision of
+// TIMESTAMPTZ, so that returned users equal stored ones.
+func postgresNow() time.Time {
+	return time.Now().Truncate(time.Microsecond)
+}
+
+func (repository *postgresRepository) Create(ctx context.Context, user *User) error {
+
+	err := user.isValid()
+	if err != nil {
+		return err
+	}
+
+	now := postgresNow()
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	user.Version = 1
+
+	err = repository.inTransaction(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx,
+			`INSERT INTO users (`+sqlUserColumns+`) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (id) DO NOTHING`,
+			user.Id, user.Name, user.CreatedAt, user.UpdatedAt, user.Version, nullTime(user.DeletedAt))
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrConflict
+		}
+		return insertPostgresRevision(ctx, tx, newRevision(ctx, RevisionActionCreate, user))
+	})
+	if err != nil {
+		return fmt.Errorf("postgres: could not create User: %v	err:%w", user, err)
+	}
+
+	return nil
+}
+
+func (repository *postgresRepository) CreateMulti(ctx context.Context, userList []*User) ([]*UserResult, error) {
+
+	if len(userList) == 0 {
+		return nil, fmt.Errorf("%w: postgres: userList can not be empty", ErrInvalidUser)
+	}
+
+	for _, u := range userList {
+		err := u.isValid()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var results = make([]*UserResult, len(userList))
+	err := repository.inTransaction(ctx, func(tx *sql.Tx) error {
+		// Taken ids are skipped rather than overwritten, as in Create.
+		stmt, err := tx.PrepareContext(ctx, `INSERT INTO users (`+sqlUserColumns+`) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (id) DO NOTHING`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for i, u := range userList {
+			results[i] = &UserResult{Id: u.Id}
+			result, err := stmt.ExecContext(ctx, u.Id, u.Name, u.CreatedAt, u.UpdatedAt, u.Version, nullTime(u.DeletedAt))
+			if err != nil {
+				return fmt.Errorf("postgres: could not create User: %v	err:%w", u, err)
+			}
+			if n, err := result.RowsAffected(); err != nil {
+				return err
+			} else if n == 0 {
+				results[i].Err = fmt.Errorf("postgres: could not create User	id:%s	err: %w", u.Id, ErrConflict)
+				continue
+			}
+			if err := insertPostgresRevision(ctx, tx, newRevision(ctx, RevisionActionCreate, u)); err != nil {
+				return fmt.Errorf("postgres: could not create User: %v	err:%w", u, err)
+			}
+			results[i].User = u
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (repository *postgresRepository) Find(ctx context.Context, id string) (*User, error) {
+	if id == "" {
+		return nil, fmt.Errorf("postgres: could not find User	id:%s	err: %w", id, ErrNotFound)
+	}
+	row := repository.db.QueryRowContext(ctx, `SELECT `+sqlUserColumns+` FROM users WHERE id = $1`, id)
+	user, err := scanPostgresUser(row)
+	if err != nil {
+		return nil, fmt.Errorf("postgres: could not find User	id:%s	err: %w", id, sqlNotFoundError(err))
+	}
+	return user, nil
+}
+
+func (repository *postgresRepository) FindMulti(ctx context.Context, ids []string) ([]*UserResult, error) {
+
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("%w: postgres: ids can not be empty", ErrInvalidUser)
+	}
+
+	for _, id := range ids {
+		if id == "" {
+			return nil, fmt.Errorf("%w: postgres: id can not be empty", ErrInvalidUser)
+		}
+	}
+
+	rows, err := repository.db.QueryContext(ctx, `SELECT `+sqlUserColumns+` FROM users WHERE id = ANY($1)`, ids)
+	if err != nil {
+		return nil, fmt.Errorf("postgres: could not find Users	ids:%v	err: %w", ids, err)
+	}
+	defer rows.Close()
+
+	users := map[string]*User{}
+	for rows.Next() {
+		user, err := scanPostgresUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("postgres: could not find Users	ids:%v	err: %w", ids, err)
+		}
+		users[user.Id] = user
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("postgres: could not find Users	ids:%v	err: %w", ids, err)
+	}
+
+	var results = make([]*UserResult, len(ids))
+	for i, id := range ids {
+		results[i] = &UserResult{Id: id}
+		user, ok := users[id]
+		if !ok {
+			results[i].Err = fmt.Errorf("postgres: could not find User	id:%s	err: %w", id, ErrNotFound)
+			continue
+		}
+		results[i].User = user
+	}
+	return results, nil
+}
+
+func (repository *postgresRepository) Delete(ctx context.Context, id string) error {
+	_, err := repository.FindAndDelete(ctx, id, 0)
+	return err
+}
+
+func (repository *postgresRepository) FindAndDelete(ctx context.Context, id string, version int64) (*User, error) {
+	if id == "" {
+		return nil, fmt.Errorf("postgres: user doesn't exist id%s	err: %w", id, ErrNotFound)
+	}
+
+	var user *User
+	err := repository.inTransaction(ctx, func(tx *sql.Tx) error {
+		var err error
+		user, err = lockPostgresUser(ctx, tx, id, version)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, id)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("postgres: could not delete User	id:%s	err: %w", id, err)
+	}
+	return user, nil
+}
+
+func (repository *postgresRepository) DeleteMulti(ctx context.Context, userList []*User) ([]*UserResult, error) {
+
+	if len(userList) == 0 {
+		return nil, fmt.Errorf("%w: postgres: userList can not be empty", ErrInvalidUser)
+	}
+
+	var ids []string
+	for _, u := range userList {
+		err := u.isValid()
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, u.Id)
+	}
+
+	if _, err := repository.db.ExecContext(ctx, `DELETE FROM users WHERE id = ANY($1)`, ids); err != nil {
+		return nil, err
+	}
+	return deletedUserResults(userList), nil
+}
+
+func (repository *postgresRepository) Update(ctx context.Context, user *User) error {
+	if user.Id == "" {
+		return fmt.Errorf("%w: user id empty User: %v", ErrInvalidUser, user)
+	}
+	var updatedUser *User
+	err := repository.inTransaction(ctx, func(tx *sql.Tx) error {
+		var err error
+		updatedUser, err = updatePostgresUser(ctx, tx, user, postgresNow())
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("postgres: could not update User: %v	err:%w", user, err)
+	}
+	*user = *updatedUser
+	return nil
+}
+
+func (repository *postgresRepository) UpdateMulti(ctx context.Context, userList []*User) ([]*UserResult, error) {
+	if err := validateUpdateList(userList); err != nil {
+		return nil, fmt.Errorf("postgres: could not update Users	err: %w", err)
+	}
+
+	results := make([]*UserResult, len(userList))
+	err := repository.inTransaction(ctx, func(tx *sql.Tx) error {
+		now := postgresNow()
+		for i, u := range userList {
+			results[i] = &UserResult{Id: u.Id}
+			updatedUser, err := updatePostgresUser(ctx, tx, u, now)
+			if isUserError(err) {
+				results[i].Err = fmt.Errorf("postgres: could not update User	id:%s	err: %w", u.Id, err)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			results[i].User = updatedUser
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("postgres: could not update Users	err: %w", err)
+	}
+	return results, nil
+}
+
+// updatePostgresUser stores user like Update and returns it as stored.
+func updatePostgresUser(ctx context.Context, tx *sql.Tx, user *User, now time.Time) (*User, error) {
+	storedUser, err := lockPostgresUser(ctx, tx, user.Id, user.Version)
+	if err != nil {
+		return nil, err
+	}
+	updatedUser := *user
+	updatedUser.Version = storedUser.Version + 1
+	updatedUser.UpdatedAt = now
+	_, err = tx.ExecContext(ctx,
+		`UPDATE users SET name = $2, created_at = $3, updated_at = $4, version = $5, deleted_at = $6 WHERE id = $1`,
+		updatedUser.Id, updatedUser.Name, updatedUser.CreatedAt, updatedUser.UpdatedAt, updatedUser.Version, nullTime(updatedUser.DeletedAt))
+	if err != nil {
+		return nil, err
+	}
+	if err := insertPostgresRevision(ctx, tx, newRevision(ctx, updateAction(storedUser, &updatedUser), &updatedUser)); err != nil {
+		return nil, err
+	}
+	return &updatedUser, nil
+}
+
+// lockPostgresUser reads the user with a row lock and checks its version.
+// version 0 matches any stored version.
+func lockPostgresUser(ctx context.Context, tx *sql.Tx, id string, version int64) (*User, error) {
+	row := tx.QueryRowContext(ctx, `SELECT `+sqlUserColumns+` FROM users WHERE id = $1 FOR UPDATE`, id)
+	user, err := scanPostgresUser(row)
+	if err != nil {
+		return nil, sqlNotFoundError(err)
+	}
+	if version != 0 && version != user.Version {
+		return nil, fmt.Errorf("%w	version:%d	storedVersion:%d", ErrVersionMismatch, version, user.Version)
+	}
+	return user, nil
+}
+
+func insertPostgresRevision(ctx context.Context, tx *sql.Tx, revision *Revision) error {
+	args, err := newSQLRevisionArgs(revision, func(t time.Time) interface{} { return t })
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, sqlInsertRevision, args...)
+	return err
+}
+
+func (repository *postgresRepository) inTransaction(ctx context.Context, f func(tx *sql.Tx) error) error {
+	tx, err := repository.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := f(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (repository *postgresRepository) ListRevisions(ctx context.Context, id string, after int64, limit int) ([]*Revision, error) {
+	rows, err := repository.db.QueryContext(ctx, sqlListRevisions, id, after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("postgres: could not retrieve Revision list	id:%s	Err:%w", id, err)
+	}
+	defer rows.Close()
+
+	var revisions []*Revision
+	for rows.Next() {
+		revision, err := scanSQLRevision(rows, id, postgresTimeDest)
+		if err != nil {
+			return nil, fmt.Errorf("postgres: could not retrieve Revision list	id:%s	Err:%w", id, err)
+		}
+		revisions = append(revisions, revision)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("postgres: could not retrieve Revision list	id:%s	Err:%w", id, err)
+	}
+	return revisions, nil
+}
+
+func (repository *postgresRepository) FindRevision(ctx context.Context, id string, version int64) (*Revision, error) {
+	row := repository.db.QueryRowContext(ctx, sqlFindRevision, id, version)
+	revision, err := scanSQLRevision(row, id, postgresTimeDest)
+	if err != nil {
+		return nil, fmt.Errorf("postgres: could not find Revision	id:%s	version:%d	err: %w", id, version, sqlRevisionNotFoundError(err))
+	}
+	return revision, nil
+}
+
+func postgresTimeDest(t *time.Time) interface{} {
+	return t
+}
+
+func (repository *postgresRepository) List(ctx context.Context) ([]*User, error) {
+	page, err := repository.ListWithOptions(ctx, ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return page.Users, nil
+}
+
+func (repository *postgresRepository) ListDeleted(ctx context.Context, deletedBefore time.Time, limit int) ([]*User, error) {
+	rows, err := repository.db.QueryContext(ctx, sqlListDeleted, deletedBefore, limit)
+	if err != nil {
+		return nil, fmt.Errorf("postgres: could not retrieve deleted User list	Err:%w", err)
+	}
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		user, err := scanPostgresUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("postgres: could not retrieve deleted User list	Err:%w", err)
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("postgres: could not retrieve deleted User list	Err:%w", err)
+	}
+	return users, nil
+}
+
+func (repository *postgresRepository) ListWithOptions(ctx context.Context, opts ListOptions) (*UserPage, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	after, err := decodeSQLCursor(opts.Cursor, opts.sort())
+	if err != nil {
+		return nil, err
+	}
+
+	limit := opts.limit()
+	// Fetch one more row to know whether there is a next page.
+	query, args := newSQLListQuery(sqlUserColumns, opts, limit+1, after)
+	rows, err := repository.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("postgres: could not retrieve User list	Err:%w", err)
+	}
+	defer rows.Close()
+
+	page := &UserPage{}
+	for rows.Next() {
+		if len(page.Users) == limit {
+			page.NextCursor = encodeSQLCursor(opts.sort(), page.Users[limit-1])
+			break
+		}
+		user, err := scanPostgresUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("postgres: could not retrieve User list	Err:%w", err)
+		}
+		page.Users = append(page.Users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("postgres: could not retrieve User list	Err:%w", err)
+	}
+
+	return page, nil
+}
@@ -0,0 +1,243 @@
+package usrsvc
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Helpers shared by the SQL repositories.
+
+const sqlUserColumns = "id, name, created_at, updated_at, version, deleted_at"
+
+// sqlListDeleted reads the partial index users_deleted_at_idx.
+const sqlListDeleted = `SELECT ` + sqlUserColumns + ` FROM users WHERE deleted_at IS NOT NULL AND deleted_at < $1 ORDER BY deleted_at, id LIMIT $2`
+
+// Revisions store the user as a JSON snapshot.
+const (
+	sqlRevisionColumns = "version, action, actor, created_at, snapshot, reverted_from"
+
+	sqlInsertRevision = `INSERT INTO user_revisions (user_id, ` + sqlRevisionColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	sqlListRevisions  = `SELECT ` + sqlRevisionColumns + ` FROM user_revisions WHERE user_id = $1 AND version > $2 ORDER BY version LIMIT $3`
+	sqlFindRevision   = `SELECT ` + sqlRevisionColumns + ` FROM user_revisions WHERE user_id = $1 AND version = $2`
+)
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+var listSortColumns = map[string]string{
+	"createdAt": "created_at",
+	"updatedAt": "updated_at",
+	"name":      "name",
+	"id":        "id",
+}
+
+// sqlCursor is the position after the last user of a page: its values of
+// the ORDER BY columns of the sort.
+type sqlCursor struct {
+	Sort      ListSort  `json:"sort"`
+	Name      string    `json:"name,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	Id        string    `json:"id"`
+}
+
+func encodeSQLCursor(listSort ListSort, u *User) string {
+	cursor := sqlCursor{Sort: listSort, CreatedAt: u.CreatedAt, Id: u.Id}
+	switch listSort.field() {
+	case "name":
+		cursor.Name = u.Name
+	case "updatedAt":
+		cursor.UpdatedAt = u.UpdatedAt
+	}
+	b, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeSQLCursor returns nil for the first page, and rejects the cursors of
+// another sort.
+func decodeSQLCursor(cursor string, listSort ListSort) (*sqlCursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidCursor, cursor)
+	}
+	after := &sqlCursor{}
+	if err := json.Unmarshal(b, after); err != nil || after.Sort != listSort || after.Id == "" {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidCursor, cursor)
+	}
+	return after, nil
+}
+
+// sqlSortKey is an ORDER BY column with the value of the cursor.
+type sqlSortKey struct {
+	column     string
+	descending bool
+	value      interface{}
+}
+
+// sqlSortKeys returns the ORDER BY columns of listSort, which end with the
+// same tiebreaks as sortUsers.
+func sqlSortKeys(listSort ListSort, after *sqlCursor) []sqlSortKey {
+	if after == nil {
+		after = &sqlCursor{}
+	}
+	keys := []sqlSortKey{{column: listSortColumns[listSort.field()], descending: listSort.descending()}}
+	switch listSort.field() {
+	case "name":
+		keys[0].value = after.Name
+	case "updatedAt":
+		keys[0].value = after.UpdatedAt
+	case "createdAt":
+		keys[0].value = after.CreatedAt
+	case "id":
+		keys[0].value = after.Id
+		return keys
+	}
+	if keys[0].column != "created_at" {
+		keys = append(keys, sqlSortKey{column: "created_at", descending: true, value: after.CreatedAt})
+	}
+	return append(keys, sqlSortKey{column: "id", value: after.Id})
+}
+
+// newSQLListQuery builds the SELECT for opts with the same ordering as
+// sortUsers, starting after the cursor. It uses $n placeholders.
+func newSQLListQuery(columns string, opts ListOptions, limit int, after *sqlCursor) (string, []interface{}) {
+	var where []string
+	var args []interface{}
+	placeholder := func(arg interface{}) string {
+		args = append(args, arg)
+		return "$" + strconv.Itoa(len(args))
+	}
+	addCondition := func(condition string, arg interface{}) {
+		where = append(where, strings.Replace(condition, "?", placeholder(arg), 1))
+	}
+
+	if !opts.IncludeDeleted {
+		where = append(where, "deleted_at IS NULL")
+	}
+
+	if opts.NamePrefix != "" {
+		addCondition(`name LIKE ? ESCAPE '\'`, escapeLike(opts.NamePrefix)+"%")
+	}
+	if !opts.CreatedSince.IsZero() {
+		addCondition("created_at >= ?", opts.CreatedSince)
+	}
+	if !opts.CreatedBefore.IsZero() {
+		addCondition("created_at < ?", opts.CreatedBefore)
+	}
+	if !opts.UpdatedSince.IsZero() {
+		addCondition("updated_at >= ?", opts.UpdatedSince)
+	}
+	if !opts.UpdatedBefore.IsZero() {
+		addCondition("updated_at < ?", opts.UpdatedBefore)
+	}
+
+	keys := sqlSortKeys(opts.sort(), after)
+
+	// The keys mix directions, so the row comparison
+	// (k1, k2, k3) > (v1, v2, v3) is spelled out key by key.
+	if after != nil {
+		var alternatives []string
+		for i, key := range keys {
+			var conditions []string
+			for _, previous := range keys[:i] {
+				conditions = append(conditions, previous.column+" = "+placeholder(previous.value))
+			}
+			operator := " > "
+			if key.descending {
+				operator = " < "
+			}
+			conditions = append(conditions, key.column+operator+placeholder(key.value))
+			alternatives = append(alternatives, strings.Join(conditions, " AND "))
+		}
+		where = append(where, "("+strings.Join(alternatives, " OR ")+")")
+	}
+
+	query := "SELECT " + columns + " FROM users"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	var orderBy []string
+	for _, key := range keys {
+		direction := "ASC"
+		if key.descending {
+			direction = "DESC"
+		}
+		orderBy = append(orderBy, key.column+" "+direction)
+	}
+	query += " ORDER BY " + strings.Join(orderBy, ", ")
+
+	query += " LIMIT " + placeholder(limit)
+	return query, args
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// nullTime stores the zero time as NULL.
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// newSQLRevisionArgs returns the arguments of sqlInsertRevision. createdAt
+// converts revision.CreatedAt to the column type.
+func newSQLRevisionArgs(revision *Revision, createdAt func(t time.Time) interface{}) ([]interface{}, error) {
+	snapshot, err := json.Marshal(revision.User)
+	if err != nil {
+		return nil, err
+	}
+	var revertedFrom interface{}
+	if revision.RevertedFrom != 0 {
+		revertedFrom = revision.RevertedFrom
+	}
+	return []interface{}{revision.User.Id, revision.Version, revision.Action, revision.Actor, createdAt(revision.CreatedAt), string(snapshot), revertedFrom}, nil
+}
+
+// scanSQLRevision scans the sqlRevisionColumns of row into a revision of the
+// user with id. createdAt returns the scan destination of
+// revision.CreatedAt.
+func scanSQLRevision(row rowScanner, id string, createdAt func(t *time.Time) interface{}) (*Revision, error) {
+	revision := &Revision{}
+	var snapshot string
+	var revertedFrom sql.NullInt64
+	err := row.Scan(&revision.Version, &revision.Action, &revision.Actor, createdAt(&revision.CreatedAt), &snapshot, &revertedFrom)
+	if err != nil {
+		return nil, err
+	}
+	revision.RevertedFrom = revertedFrom.Int64
+	if err := json.Unmarshal([]byte(snapshot), &revision.User); err != nil {
+		return nil, err
+	}
+	revision.User.Id = id
+	return revision, nil
+}
+
+// sqlNotFoundError translates sql.ErrNoRows into ErrNotFound.
+func sqlNotFoundError(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// sqlRevisionNotFoundError translates sql.ErrNoRows into ErrRevisionNotFound.
+func sqlRevisionNotFoundError(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrRevisionNotFound
+	}
+	return err
+}
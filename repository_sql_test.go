@@ -0,0 +1,69 @@
+package usrsvc
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNewSQLListQuery(t *testing.T) {
+	createdAt := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name          string
+		opts          ListOptions
+		after         *sqlCursor
+		expectedQuery string
+		expectedArgs  []interface{}
+	}{
+		{
+			name:          "Query_WhenFirstPage_StartFromTheTop",
+			opts:          ListOptions{NamePrefix: "a_b", Sort: SortByNameAsc},
+			expectedQuery: `SELECT id FROM users WHERE deleted_at IS NULL AND name LIKE $1 ESCAPE '\' ORDER BY name ASC, created_at DESC, id ASC LIMIT $2`,
+			expectedArgs:  []interface{}{`a\_b%`, 21},
+		},
+		{
+			name:          "Query_WhenPassingCursor_StartAfterItsKeys",
+			opts:          ListOptions{Sort: SortByNameAsc},
+			after:         &sqlCursor{Sort: SortByNameAsc, Name: "Alice", CreatedAt: createdAt, Id: "u1"},
+			expectedQuery: `SELECT id FROM users WHERE deleted_at IS NULL AND (name > $1 OR name = $2 AND created_at < $3 OR name = $4 AND created_at = $5 AND id > $6) ORDER BY name ASC, created_at DESC, id ASC LIMIT $7`,
+			expectedArgs:  []interface{}{"Alice", "Alice", createdAt, "Alice", createdAt, "u1", 21},
+		},
+		{
+			name:          "Query_WhenSortingByIdDesc_UseTheIdOnly",
+			opts:          ListOptions{Sort: SortByIdDesc, IncludeDeleted: true},
+			after:         &sqlCursor{Sort: SortByIdDesc, CreatedAt: createdAt, Id: "u1"},
+			expectedQuery: `SELECT id FROM users WHERE (id < $1) ORDER BY id DESC LIMIT $2`,
+			expectedArgs:  []interface{}{"u1", 21},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, args := newSQLListQuery("id", tt.opts, 21, tt.after)
+			if query != tt.expectedQuery {
+				t.Errorf("Unexpected query	query:%s	expected:%s", query, tt.expectedQuery)
+			}
+			if len(args) != len(tt.expectedArgs) {
+				t.Fatalf("Unexpected args	args:%v", args)
+			}
+			for i, arg := range args {
+				if arg != tt.expectedArgs[i] {
+					t.Errorf("Unexpected arg	i:%d	arg:%v	expected:%v", i, arg, tt.expectedArgs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSQLCursor_WhenPassingCursorOfAnotherSort_ReturnError(t *testing.T) {
+	cursor := encodeSQLCursor(SortByNameAsc, &User{Id: "u1", Name: "Alice", CreatedAt: time.Now()})
+	if _, err := decodeSQLCursor(cursor, SortByNameAsc); err != nil {
+		t.Errorf("err:%v", err)
+	}
+	for _, c := range []string{cursor, "not-a-cursor", encodeOffsetCursor(20)} {
+		if _, err := decodeSQLCursor(c, SortByCreatedAtDesc); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("ErrInvalidCursor must be returned	cursor:%v	err:%v", c, err)
+		}
+	}
+}
@@ -0,0 +1,505 @@
+package usrsvc
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+//go:embed migrations/sqlite/*.sql
+var sqliteMigrations embed.FS
+
+type sqliteRepository struct {
+	db *sql.DB
+}
+
+var _ IUserRepository = &sqliteRepository{}
+var _ RevisionRepository = &sqliteRepository{}
+
+// OpenSQLite opens the SQLite database file at path in WAL mode. Writers
+// wait up to busyTimeout for the lock instead of failing with SQLITE_BUSY,
+// transactions take the write lock when they begin, and foreign keys are
+// enforced.
+func OpenSQLite(path string, busyTimeout time.Duration) (*sql.DB, error) {
+	q := url.Values{}
+	q.Add("_pragma", "journal_mode(WAL)")
+	q.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", busyTimeout.Milliseconds()))
+	q.Add("_pragma", "synchronous(NORMAL)")
+	q.Add("_pragma", "case_sensitive_like(1)")
+	q.Add("_pragma", "foreign_keys(1)")
+	q.Set("_txlock", "immediate")
+	return sql.Open("sqlite", "file:"+path+"?"+q.Encode())
+}
+
+// MigrateSQLite brings the schema of db up to date with the embedded
+// migrations/sqlite files.
+func MigrateSQLite(ctx context.Context, db *sql.DB) error {
+	migrations, err := fs.Sub(sqliteMigrations, "migrations/sqlite")
+	if err != nil {
+		return err
+	}
+	return migrate(ctx, db, migrations, "")
+}
+
+// NewSQLiteRepository returns an IUserRepository which stores users in the
+// users table of db, opened by OpenSQLite and migrated by MigrateSQLite.
+func NewSQLiteRepository(db *sql.DB) IUserRepository {
+	return newSQLiteRepository(db)
+}
+
+func newSQLiteRepository(db *sql.DB) *sqliteRepository {
+	return &sqliteRepository{db: db}
+}
+
+const sqliteTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// sqliteTime stores a time.Time as fixed-width UTC text.
+type sqliteTime time.Time
+
+func (t sqliteTime) Value() (driver.Value, error) {
+	return time.Time(t).UTC().Format(sqliteTimeLayout), nil
+}
+
+// Scan reads NULL as the zero time.
+func (t *sqliteTime) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case nil:
+		*t = sqliteTime{}
+		return nil
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("sqlite: could not scan time	src:%v", src)
+	}
+	parsed, err := time.Parse(sqliteTimeLayout, s)
+	if err != nil {
+		return err
+	}
+	*t = sqliteTime(parsed)
+	return nil
+}
+
+// nullSQLiteTime stores the zero time as NULL.
+func nullSQLiteTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return sqliteTime(t)
+}
+
+func scanSQLiteUser(row rowScanner) (*User, error) {
+	user := &User{}
+	err := row.Scan(&user.Id, &user.Name, (*sqliteTime)(&user.CreatedAt), (*sqliteTime)(&user.UpdatedAt), &user.Version, (*sqliteTime)(&user.DeletedAt))
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (repository *sqliteRepository) Create(ctx context.Context, user *User) error {
+
+	err := user.isValid()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	user.Version = 1
+
+	err = repository.inTransaction(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx,
+			`INSERT INTO users (`+sqlUserColumns+`) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (id) DO NOTHING`,
+			user.Id, user.Name, sqliteTime(user.CreatedAt), sqliteTime(user.UpdatedAt), user.Version, nullSQLiteTime(user.DeletedAt))
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrConflict
+		}
+		return insertSQLiteRevision(ctx, tx, newRevision(ctx, RevisionActionCreate, user))
+	})
+	if err != nil {
+		return fmt.Errorf("sqlite: could not create User: %v	err:%w", user, err)
+	}
+
+	return nil
+}
+
+func (repository *sqliteRepository) CreateMulti(ctx context.Context, userList []*User) ([]*UserResult, error) {
+
+	if len(userList) == 0 {
+		return nil, fmt.Errorf("%w: sqlite: userList can not be empty", ErrInvalidUser)
+	}
+
+	for _, u := range userList {
+		err := u.isValid()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var results = make([]*UserResult, len(userList))
+	err := repository.inTransaction(ctx, func(tx *sql.Tx) error {
+		// Taken ids are skipped rather than overwritten, as in Create.
+		stmt, err := tx.PrepareContext(ctx, `INSERT INTO users (`+sqlUserColumns+`) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (id) DO NOTHING`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for i, u := range userList {
+			results[i] = &UserResult{Id: u.Id}
+			result, err := stmt.ExecContext(ctx, u.Id, u.Name, sqliteTime(u.CreatedAt), sqliteTime(u.UpdatedAt), u.Version, nullSQLiteTime(u.DeletedAt))
+			if err != nil {
+				return fmt.Errorf("sqlite: could not create User: %v	err:%w", u, err)
+			}
+			if n, err := result.RowsAffected(); err != nil {
+				return err
+			} else if n == 0 {
+				results[i].Err = fmt.Errorf("sqlite: could not create User	id:%s	err: %w", u.Id, ErrConflict)
+				continue
+			}
+			if err := insertSQLiteRevision(ctx, tx, newRevision(ctx, RevisionActionCreate, u)); err != nil {
+				return fmt.Errorf("sqlite: could not create User: %v	err:%w", u, err)
+			}
+			results[i].User = u
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (repository *sqliteRepository) Find(ctx context.Context, id string) (*User, error) {
+	if id == "" {
+		return nil, fmt.Errorf("sqlite: could not find User	id:%s	err: %w", id, ErrNotFound)
+	}
+	row := repository.db.QueryRowContext(ctx, `SELECT `+sqlUserColumns+` FROM users WHERE id = $1`, id)
+	user, err := scanSQLiteUser(row)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: could not find User	id:%s	err: %w", id, sqlNotFoundError(err))
+	}
+	return user, nil
+}
+
+func (repository *sqliteRepository) FindMulti(ctx context.Context, ids []string) ([]*UserResult, error) {
+
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("%w: sqlite: ids can not be empty", ErrInvalidUser)
+	}
+
+	for _, id := range ids {
+		if id == "" {
+			return nil, fmt.Errorf("%w: sqlite: id can not be empty", ErrInvalidUser)
+		}
+	}
+
+	var results = make([]*UserResult, len(ids))
+	err := repository.inTransaction(ctx, func(tx *sql.Tx) error {
+		stmt, err := tx.PrepareContext(ctx, `SELECT `+sqlUserColumns+` FROM users WHERE id = $1`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for i, id := range ids {
+			results[i] = &UserResult{Id: id}
+			user, err := scanSQLiteUser(stmt.QueryRowContext(ctx, id))
+			if errors.Is(err, sql.ErrNoRows) {
+				results[i].Err = fmt.Errorf("sqlite: could not find User	id:%s	err: %w", id, ErrNotFound)
+				continue
+			} else if err != nil {
+				return fmt.Errorf("sqlite: could not find User	id:%s	err: %w", id, err)
+			}
+			results[i].User = user
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (repository *sqliteRepository) Delete(ctx context.Context, id string) error {
+	_, err := repository.FindAndDelete(ctx, id, 0)
+	return err
+}
+
+func (repository *sqliteRepository) FindAndDelete(ctx context.Context, id string, version int64) (*User, error) {
+	if id == "" {
+		return nil, fmt.Errorf("sqlite: user doesn't exist id%s	err: %w", id, ErrNotFound)
+	}
+
+	var user *User
+	err := repository.inTransaction(ctx, func(tx *sql.Tx) error {
+		var err error
+		user, err = findSQLiteUserVersion(ctx, tx, id, version)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, id)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: could not delete User	id:%s	err: %w", id, err)
+	}
+	return user, nil
+}
+
+func (repository *sqliteRepository) DeleteMulti(ctx context.Context, userList []*User) ([]*UserResult, error) {
+
+	if len(userList) == 0 {
+		return nil, fmt.Errorf("%w: sqlite: userList can not be empty", ErrInvalidUser)
+	}
+
+	for _, u := range userList {
+		err := u.isValid()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := repository.inTransaction(ctx, func(tx *sql.Tx) error {
+		stmt, err := tx.PrepareContext(ctx, `DELETE FROM users WHERE id = $1`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, u := range userList {
+			if _, err := stmt.ExecContext(ctx, u.Id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deletedUserResults(userList), nil
+}
+
+func (repository *sqliteRepository) Update(ctx context.Context, user *User) error {
+	if user.Id == "" {
+		return fmt.Errorf("%w: user id empty User: %v", ErrInvalidUser, user)
+	}
+	var updatedUser *User
+	err := repository.inTransaction(ctx, func(tx *sql.Tx) error {
+		var err error
+		updatedUser, err = updateSQLiteUser(ctx, tx, user, time.Now())
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("sqlite: could not update User: %v	err:%w", user, err)
+	}
+	*user = *updatedUser
+	return nil
+}
+
+func (repository *sqliteRepository) UpdateMulti(ctx context.Context, userList []*User) ([]*UserResult, error) {
+	if err := validateUpdateList(userList); err != nil {
+		return nil, fmt.Errorf("sqlite: could not update Users	err: %w", err)
+	}
+
+	results := make([]*UserResult, len(userList))
+	err := repository.inTransaction(ctx, func(tx *sql.Tx) error {
+		now := time.Now()
+		for i, u := range userList {
+			results[i] = &UserResult{Id: u.Id}
+			updatedUser, err := updateSQLiteUser(ctx, tx, u, now)
+			if isUserError(err) {
+				results[i].Err = fmt.Errorf("sqlite: could not update User	id:%s	err: %w", u.Id, err)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			results[i].User = updatedUser
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: could not update Users	err: %w", err)
+	}
+	return results, nil
+}
+
+// updateSQLiteUser stores user like Update and returns it as stored.
+func updateSQLiteUser(ctx context.Context, tx *sql.Tx, user *User, now time.Time) (*User, error) {
+	storedUser, err := findSQLiteUserVersion(ctx, tx, user.Id, user.Version)
+	if err != nil {
+		return nil, err
+	}
+	updatedUser := *user
+	updatedUser.Version = storedUser.Version + 1
+	updatedUser.UpdatedAt = now
+	_, err = tx.ExecContext(ctx,
+		`UPDATE users SET name = $2, created_at = $3, updated_at = $4, version = $5, deleted_at = $6 WHERE id = $1`,
+		updatedUser.Id, updatedUser.Name, sqliteTime(updatedUser.CreatedAt), sqliteTime(updatedUser.UpdatedAt), updatedUser.Version, nullSQLiteTime(updatedUser.DeletedAt))
+	if err != nil {
+		return nil, err
+	}
+	if err := insertSQLiteRevision(ctx, tx, newRevision(ctx, updateAction(storedUser, &updatedUser), &updatedUser)); err != nil {
+		return nil, err
+	}
+	return &updatedUser, nil
+}
+
+// findSQLiteUserVersion reads the user and checks its version. The
+// transaction already holds the write lock, see OpenSQLite.
+func findSQLiteUserVersion(ctx context.Context, tx *sql.Tx, id string, version int64) (*User, error) {
+	row := tx.QueryRowContext(ctx, `SELECT `+sqlUserColumns+` FROM users WHERE id = $1`, id)
+	user, err := scanSQLiteUser(row)
+	if err != nil {
+		return nil, sqlNotFoundError(err)
+	}
+	if version != 0 && version != user.Version {
+		return nil, fmt.Errorf("%w	version:%d	storedVersion:%d", ErrVersionMismatch, version, user.Version)
+	}
+	return user, nil
+}
+
+func insertSQLiteRevision(ctx context.Context, tx *sql.Tx, revision *Revision) error {
+	args, err := newSQLRevisionArgs(revision, func(t time.Time) interface{} { return sqliteTime(t) })
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, sqlInsertRevision, args...)
+	return err
+}
+
+func (repository *sqliteRepository) inTransaction(ctx context.Context, f func(tx *sql.Tx) error) error {
+	tx, err := repository.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := f(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (repository *sqliteRepository) ListRevisions(ctx context.Context, id string, after int64, limit int) ([]*Revision, error) {
+	rows, err := repository.db.QueryContext(ctx, sqlListRevisions, id, after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: could not retrieve Revision list	id:%s	Err:%w", id, err)
+	}
+	defer rows.Close()
+
+	var revisions []*Revision
+	for rows.Next() {
+		revision, err := scanSQLRevision(rows, id, sqliteTimeDest)
+		if err != nil {
+			return nil, fmt.Errorf("sqlite: could not retrieve Revision list	id:%s	Err:%w", id, err)
+		}
+		revisions = append(revisions, revision)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("sqlite: could not retrieve Revision list	id:%s	Err:%w", id, err)
+	}
+	return revisions, nil
+}
+
+func (repository *sqliteRepository) FindRevision(ctx context.Context, id string, version int64) (*Revision, error) {
+	row := repository.db.QueryRowContext(ctx, sqlFindRevision, id, version)
+	revision, err := scanSQLRevision(row, id, sqliteTimeDest)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: could not find Revision	id:%s	version:%d	err: %w", id, version, sqlRevisionNotFoundError(err))
+	}
+	return revision, nil
+}
+
+func sqliteTimeDest(t *time.Time) interface{} {
+	return (*sqliteTime)(t)
+}
+
+func (repository *sqliteRepository) List(ctx context.Context) ([]*User, error) {
+	page, err := repository.ListWithOptions(ctx, ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return page.Users, nil
+}
+
+func (repository *sqliteRepository) ListDeleted(ctx context.Context, deletedBefore time.Time, limit int) ([]*User, error) {
+	rows, err := repository.db.QueryContext(ctx, sqlListDeleted, sqliteTime(deletedBefore), limit)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: could not retrieve deleted User list	Err:%w", err)
+	}
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		user, err := scanSQLiteUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("sqlite: could not retrieve deleted User list	Err:%w", err)
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("sqlite: could not retrieve deleted User list	Err:%w", err)
+	}
+	return users, nil
+}
+
+func (repository *sqliteRepository) ListWithOptions(ctx context.Context, opts ListOptions) (*UserPage, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	after, err := decodeSQLCursor(opts.Cursor, opts.sort())
+	if err != nil {
+		return nil, err
+	}
+
+	limit := opts.limit()
+	// Fetch one more row to know whether there is a next page.
+	query, args := newSQLListQuery(sqlUserColumns, opts, limit+1, after)
+	for i, arg := range args {
+		if t, ok := arg.(time.Time); ok {
+			args[i] = sqliteTime(t)
+		}
+	}
+	rows, err := repository.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: could not retrieve User list	Err:%w", err)
+	}
+	defer rows.Close()
+
+	page := &UserPage{}
+	for rows.Next() {
+		if len(page.Users) == limit {
+			page.NextCursor = encodeSQLCursor(opts.sort(), page.Users[limit-1])
+			break
+		}
+		user, err := scanSQLiteUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("sqlite: could not retrieve User list	Err:%w", err)
+		}
+		page.Users = append(page.Users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("sqlite: could not retrieve User list	Err:%w", err)
+	}
+
+	return page, nil
+}
@@ -0,0 +1,83 @@
+package usrsvc
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openTestSQLite(ctx context.Context, t *testing.T) *sql.DB {
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "users.db"), 5*time.Second)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	// Migrating twice must be a no-op.
+	for i := 0; i < 2; i++ {
+		if err := MigrateSQLite(ctx, db); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+	}
+	return db
+}
+
+func TestUserSQLiteRepository_WhenUpdatingConcurrently_WaitForTheLock(t *testing.T) {
+	ctx := context.Background()
+	repository := NewSQLiteRepository(openTestSQLite(ctx, t))
+	user := createTestUser(ctx, t, repository)
+
+	const updates = 10
+	var wg sync.WaitGroup
+	for i := 0; i < updates; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u := *user
+			u.Version = 0
+			if err := repository.Update(ctx, &u); err != nil {
+				t.Errorf("err:%v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	storedUser, err := repository.Find(ctx, user.Id)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	if storedUser.Version != user.Version+updates {
+		t.Errorf("Every update must be applied	storedUser:%v", storedUser)
+	}
+}
+
+func TestUserSQLiteRepository_WhenCreatingBetweenPages_ContinueAfterTheLastUser(t *testing.T) {
+	ctx := context.Background()
+	repository := NewSQLiteRepository(openTestSQLite(ctx, t))
+
+	var users []*User
+	for i := 0; i < 3; i++ {
+		users = append(users, createTestUser(ctx, t, repository))
+	}
+
+	opts := ListOptions{Limit: 2, Sort: SortByCreatedAtDesc}
+	firstPage, err := repository.ListWithOptions(ctx, opts)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	// A newer user sorts first and would shift an offset by one.
+	createTestUser(ctx, t, repository)
+	opts.Cursor = firstPage.NextCursor
+	secondPage, err := repository.ListWithOptions(ctx, opts)
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+
+	if len(firstPage.Users) != 2 || len(secondPage.Users) != 1 || secondPage.Users[0].Id != users[0].Id || secondPage.NextCursor != "" {
+		t.Errorf("Second page must hold the oldest user only	firstPage:%v	secondPage:%v", firstPage.Users, secondPage.Users)
+	}
+}
@@ -0,0 +1,339 @@
+package usrsvc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RevisionAction is the kind of change recorded by a Revision.
+type RevisionAction string
+
+const (
+	RevisionActionCreate  RevisionAction = "create"
+	RevisionActionUpdate  RevisionAction = "update"
+	RevisionActionDelete  RevisionAction = "delete"
+	RevisionActionRestore RevisionAction = "restore"
+	RevisionActionRevert  RevisionAction = "revert"
+)
+
+// Revision is a snapshot of a user, written by Create and by every Update.
+// Version is the version of the user after the change and numbers the
+// revisions of a user. Revisions are never changed, but they hold the data
+// of the user, so they are erased with it by a hard delete or a purge.
+type Revision struct {
+	Version   int64          `datastore:",noindex" json:"version"`
+	Action    RevisionAction `datastore:",noindex" json:"action"`
+	Actor     string         `datastore:",noindex" json:"actor,omitempty"`
+	CreatedAt time.Time      `datastore:",noindex" json:"createdAt"`
+	User      User           `datastore:",noindex" json:"user"`
+	// RevertedFrom is the version restored by a revert.
+	RevertedFrom int64 `datastore:",noindex" json:"revertedFrom,omitempty"`
+}
+
+// RevisionRepository is implemented by repositories which keep the
+// revisions of users. Soft deletes and restores are updates, so they are
+// recorded too, while hard deletes remove the revisions along with the
+// user, in the same transaction where the store allows it. CreateMulti
+// records the create revision of every user it stores.
+type RevisionRepository interface {
+	// ListRevisions returns up to limit revisions of the user with a version
+	// greater than after, oldest first.
+	ListRevisions(ctx context.Context, id string, after int64, limit int) ([]*Revision, error)
+
+	// FindRevision returns the revision of the user with version, or
+	// ErrRevisionNotFound.
+	FindRevision(ctx context.Context, id string, version int64) (*Revision, error)
+}
+
+// newRevision returns the revision recording that user was changed by
+// action. The actor is taken from ctx, and updates made with a ctx of
+// WithRevertedVersion are recorded as reverts.
+func newRevision(ctx context.Context, action RevisionAction, user *User) *Revision {
+	revision := &Revision{
+		Version:   user.Version,
+		Action:    action,
+		Actor:     ActorFromContext(ctx),
+		CreatedAt: user.UpdatedAt,
+		User:      *user,
+	}
+	if version, ok := RevertedVersionFromContext(ctx); ok && action == RevisionActionUpdate {
+		revision.Action = RevisionActionRevert
+		revision.RevertedFrom = version
+	}
+	return revision
+}
+
+// updateAction tells whether an update of storedUser to user soft deletes
+// it, restores it, or only changes it.
+func updateAction(storedUser *User, user *User) RevisionAction {
+	switch {
+	case !storedUser.isDeleted() && user.isDeleted():
+		return RevisionActionDelete
+	case storedUser.isDeleted() && !user.isDeleted():
+		return RevisionActionRestore
+	default:
+		return RevisionActionUpdate
+	}
+}
+
+type actorKey struct{}
+
+type revertKey struct{}
+
+// WithRevertedVersion returns a copy of ctx which records updates as
+// reverts to version.
+func WithRevertedVersion(ctx context.Context, version int64) context.Context {
+	return context.WithValue(ctx, revertKey{}, version)
+}
+
+// RevertedVersionFromContext returns the version set by WithRevertedVersion.
+func RevertedVersionFromContext(ctx context.Context) (int64, bool) {
+	version, ok := ctx.Value(revertKey{}).(int64)
+	return version, ok
+}
+
+// WithActor returns a copy of ctx carrying actor, who is recorded in the
+// revisions written with it.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor set by WithActor, or "".
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// WithActorFunc sets how handlers identify who makes a change. By default
+// nobody is identified, since headers such as the one of IAPActor can be
+// set by any client which does not go through a trusted proxy.
+func WithActorFunc(f func(r *http.Request) string) ServiceOption {
+	return func(s *Service) {
+		s.actor = f
+	}
+}
+
+// IAPActor returns the email of the user authenticated by Identity-Aware
+// Proxy. The header can only be trusted when every request goes through it.
+func IAPActor(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("X-Goog-Authenticated-User-Email"), "accounts.google.com:")
+}
+
+// revision list
+type userRevisionListResponse struct {
+	Revisions  []*Revision `json:"revisions"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+}
+
+// revision find
+type userRevisionFindResponse struct {
+	Revision *Revision `json:"revision"`
+}
+
+// revert
+type userRevertResponse struct {
+	User *User `json:"user"`
+}
+
+// revisionRepository returns the repository of s as a RevisionRepository.
+func (s *Service) revisionRepository() (RevisionRepository, error) {
+	repository, ok := s.repository.(RevisionRepository)
+	if !ok {
+		return nil, fmt.Errorf("%w: the repository does not keep revisions", errors.ErrUnsupported)
+	}
+	return repository, nil
+}
+
+func (s *Service) getUserRevisionList(w http.ResponseWriter, r *http.Request) {
+	ctx := s.newContext(r)
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	after, limit, err := parseRevisionListParameters(r.URL.Query())
+	if err != nil {
+		writeErrorResponse(w, r, err, err.Error())
+		return
+	}
+
+	repository, err := s.revisionRepository()
+	if err != nil {
+		writeErrorResponse(w, r, err, "Can not list revisions")
+		return
+	}
+
+	// Fetch one more revision to know whether there is a next page.
+	revisions, err := repository.ListRevisions(ctx, id, after, limit+1)
+	if err != nil {
+		log.Printf("ListRevisions	err:%v", err)
+		writeErrorResponse(w, r, err, "Can not list revisions")
+		return
+	}
+
+	// Users stored before revisions were kept have none, so only a missing
+	// user is an error.
+	if len(revisions) == 0 && after == 0 {
+		if _, err := s.repository.Find(ctx, id); err != nil {
+			log.Printf("FindUser	err:%v", err)
+			writeErrorResponse(w, r, err, "Can not find user")
+			return
+		}
+	}
+
+	res := userRevisionListResponse{
+		Revisions: []*Revision{},
+	}
+	if len(revisions) > limit {
+		revisions = revisions[:limit]
+		res.NextCursor = encodeOffsetCursor(int(revisions[limit-1].Version))
+		w.Header().Set("Link", nextPageLink(r, res.NextCursor))
+	}
+	res.Revisions = append(res.Revisions, revisions...)
+	json.NewEncoder(w).Encode(res)
+}
+
+// parseRevisionListParameters returns the version after which the page
+// starts and its size. The cursor is the last version of the previous page.
+func parseRevisionListParameters(query url.Values) (int64, int, error) {
+	for name := range query {
+		if name != "limit" && name != "cursor" {
+			return 0, 0, fmt.Errorf("%w: unknown parameter %q", ErrInvalidListOptions, name)
+		}
+	}
+
+	limit := defaultListLimit
+	if v := query.Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return 0, 0, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidListOptions, maxListLimit)
+		}
+	}
+
+	after, err := decodeOffsetCursor(query.Get("cursor"))
+	if err != nil {
+		return 0, 0, err
+	}
+	return int64(after), limit, nil
+}
+
+func (s *Service) findUserRevision(w http.ResponseWriter, r *http.Request) {
+	ctx := s.newContext(r)
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	version, err := strconv.ParseInt(vars["version"], 10, 64)
+	if err != nil || version < 1 {
+		writeInvalidParameterResponse(w, r, "revision must be a positive version number")
+		return
+	}
+
+	repository, err := s.revisionRepository()
+	if err != nil {
+		writeErrorResponse(w, r, err, "Can not find revision")
+		return
+	}
+
+	revision, err := repository.FindRevision(ctx, id, version)
+	if err != nil {
+		log.Printf("FindRevision	err:%v", err)
+		writeErrorResponse(w, r, err, "Can not find revision")
+		return
+	}
+
+	res := userRevisionFindResponse{
+		Revision: revision,
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func (s *Service) revertUser(w http.ResponseWriter, r *http.Request) {
+	ctx := s.newContext(r)
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	version, err := strconv.ParseInt(vars["version"], 10, 64)
+	if err != nil || version < 1 {
+		writeInvalidParameterResponse(w, r, "revision must be a positive version number")
+		return
+	}
+
+	repository, err := s.revisionRepository()
+	if err != nil {
+		writeErrorResponse(w, r, err, "Can not revert user")
+		return
+	}
+
+	user, err := s.findActiveUser(withFreshRead(ctx), id)
+	if err != nil {
+		log.Printf("FindUser	err:%v", err)
+		writeErrorResponse(w, r, err, "Can not find user")
+		return
+	}
+
+	if !matchIfMatch(r, user) {
+		writeErrorResponse(w, r, ErrVersionMismatch, "If-Match does not match the user version")
+		return
+	}
+
+	revision, err := repository.FindRevision(ctx, id, version)
+	if err != nil {
+		log.Printf("FindRevision	err:%v", err)
+		writeErrorResponse(w, r, err, "Can not find revision")
+		return
+	}
+
+	revertedUser, err := revertUserTo(user, &revision.User)
+	if err != nil {
+		writeErrorResponse(w, r, err, "Can not revert user")
+		return
+	}
+
+	// Update fails if the user changed since Find.
+	err = s.repository.Update(WithRevertedVersion(ctx, version), revertedUser)
+	if err != nil {
+		log.Printf("RevertUser	err:%v", err)
+		writeErrorResponse(w, r, err, "Can not revert user")
+		return
+	}
+
+	writeETag(w, revertedUser)
+	res := userRevertResponse{
+		User: revertedUser,
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// revertUserTo returns user with the fields of snapshot which clients can
+// change. Like a patch, the result must pass validation.
+func revertUserTo(user *User, snapshot *User) (*User, error) {
+	doc, err := userDocument(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	currentDoc, err := userDocument(user)
+	if err != nil {
+		return nil, err
+	}
+	// A revert neither deletes nor restores the user.
+	for _, name := range append([]string{"deletedAt"}, readOnlyUserFields...) {
+		if value, ok := currentDoc[name]; ok {
+			doc[name] = value
+		} else {
+			delete(doc, name)
+		}
+	}
+	return userFromDocument(user, doc)
+}
@@ -0,0 +1,62 @@
+package usrsvc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// revisionlessRepository hides the RevisionRepository methods of a
+// repository.
+type revisionlessRepository struct {
+	IUserRepository
+}
+
+func TestUserRevisionRoutes(t *testing.T) {
+	newContext := WithContextFunc(func(r *http.Request) context.Context {
+		return r.Context()
+	})
+
+	tests := []struct {
+		name               string
+		repository         IUserRepository
+		path               string
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{name: "Revisions_WhenCreatedThroughIAP_RecordTheActor", repository: NewMemoryRepository(), path: "/revisions", expectedStatusCode: http.StatusOK, expectedBody: `"actor":"operator@example.com"`},
+		{name: "Revision_WhenCreatedThroughIAP_RecordTheActor", repository: NewMemoryRepository(), path: "/revisions/1", expectedStatusCode: http.StatusOK, expectedBody: `"actor":"operator@example.com"`},
+		{name: "Revisions_WhenCached_ReadTheRevisions", repository: NewCachingRepository(NewMemoryRepository()), path: "/revisions", expectedStatusCode: http.StatusOK, expectedBody: `"action":"create"`},
+		{name: "Revisions_WhenRepositoryKeepsNoRevision_ReturnError", repository: revisionlessRepository{NewMemoryRepository()}, path: "/revisions", expectedStatusCode: http.StatusNotImplemented, expectedBody: ErrorCodeUnsupported},
+		{name: "Revision_WhenCachedRepositoryKeepsNoRevision_ReturnError", repository: NewCachingRepository(revisionlessRepository{NewMemoryRepository()}), path: "/revisions/1", expectedStatusCode: http.StatusNotImplemented, expectedBody: ErrorCodeUnsupported},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := mux.NewRouter()
+			RegisterService(r, NewService(tt.repository, newContext, WithActorFunc(IAPActor)))
+
+			req := httptest.NewRequest("POST", "/v1/users", strings.NewReader(`{"user":{"name":"Alice"}}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Goog-Authenticated-User-Email", "accounts.google.com:operator@example.com")
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+			var created userCreateResponse
+			decodeResponseBody(rr.Body.Bytes(), &created)
+			if created.User == nil {
+				t.Fatalf("User should be created	body:%v", rr.Body.String())
+			}
+
+			rr = httptest.NewRecorder()
+			r.ServeHTTP(rr, httptest.NewRequest("GET", fmt.Sprintf("/v1/users/%s%s", created.User.Id, tt.path), nil))
+			if rr.Code != tt.expectedStatusCode || !strings.Contains(rr.Body.String(), tt.expectedBody) {
+				t.Errorf("Unexpected response	code:%v	body:%v", rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
@@ -2,14 +2,20 @@ package usrsvc
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"google.golang.org/appengine"
@@ -19,10 +25,95 @@ var (
 	contentTypeApplicationJson = http.CanonicalHeaderKey("Content-Type")
 )
 
+// Service serves the user APIs on top of an IUserRepository.
+type Service struct {
+	repository IUserRepository
+	newContext func(r *http.Request) context.Context
+	actor      func(r *http.Request) string
+	retention  time.Duration
+	admins     map[string]bool
+
+	idempotencyStore  IdempotencyStore
+	idempotencyWindow time.Duration
+
+	userIdPattern *regexp.Regexp
+	idGenerator   IDGenerator
+}
+
+// ServiceOption configures a Service created by NewService.
+type ServiceOption func(s *Service)
+
+// WithContextFunc replaces appengine.NewContext as the way handlers derive
+// a context from the incoming request.
+func WithContextFunc(f func(r *http.Request) context.Context) ServiceOption {
+	return func(s *Service) {
+		s.newContext = f
+	}
+}
+
+// NewService returns a Service which stores users in the given repository.
+// It panics if WithAdmins is given without WithActorFunc, because admins
+// could not be told apart from other callers.
+func NewService(repository IUserRepository, opts ...ServiceOption) *Service {
+	s := &Service{
+		repository: repository,
+		newContext: appengine.NewContext,
+		retention:  defaultRetention,
+
+		idempotencyStore:  NewMemoryIdempotencyStore(),
+		idempotencyWindow: defaultIdempotencyWindow,
+
+		userIdPattern: defaultUserIdPattern,
+		idGenerator:   NewUUIDv4Generator(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.actor == nil {
+		if len(s.admins) > 0 {
+			panic("usrsvc: WithAdmins requires WithActorFunc")
+		}
+		s.actor = func(r *http.Request) string { return "" }
+	}
+
+	// Every context carries the actor recorded in revisions.
+	newContext := s.newContext
+	s.newContext = func(r *http.Request) context.Context {
+		return WithActor(newContext(r), s.actor(r))
+	}
+	return s
+}
+
+// Register registers the user APIs backed by the App Engine datastore.
+// Idempotency-Keys are kept in memcache, so that every instance sees them.
+// The admins are the comma separated actors of USRSVC_ADMINS and the cron
+// jobs, which purge the deleted users.
 func Register(r *mux.Router) {
-	addMiddleware(r)
-	addV1Routes(r.PathPrefix("/v1").Subrouter())
+	admins := append(strings.Split(os.Getenv("USRSVC_ADMINS"), ","), appEngineCronActor)
+	RegisterService(r, NewService(NewDatastoreRepository(),
+		WithIdempotencyStore(NewAppEngineMemcacheIdempotencyStore()),
+		WithActorFunc(appEngineActor),
+		WithAdmins(admins...),
+	))
+}
+
+// appEngineCronActor is the actor of the requests of App Engine cron jobs.
+const appEngineCronActor = "appengine-cron"
 
+// appEngineActor returns appEngineCronActor for cron requests, which do not
+// go through Identity-Aware Proxy, and the IAP user otherwise. App Engine
+// strips X-Appengine-Cron from external requests.
+func appEngineActor(r *http.Request) string {
+	if r.Header.Get("X-Appengine-Cron") == "true" {
+		return appEngineCronActor
+	}
+	return IAPActor(r)
+}
+
+// RegisterService registers the user APIs served by s.
+func RegisterService(r *mux.Router, s *Service) {
+	addMiddleware(r)
+	s.addV1Routes(r.PathPrefix("/v1").Subrouter())
 }
 
 func addMiddleware(r *mux.Router) {
@@ -33,12 +124,21 @@ func addMiddleware(r *mux.Router) {
 	r.Use(recoveryHandler)
 }
 
-func addV1Routes(r *mux.Router) {
-	r.HandleFunc("/users", createUser).Methods("POST")
-	r.HandleFunc("/users", getUserList).Methods("GET")
-	r.HandleFunc("/users/{id}", findUser).Methods("GET")
-	r.HandleFunc("/users/{id}", deleteUser).Methods("DELETE")
-	r.HandleFunc("/users/{id}", updateUser).Methods("PUT")
+func (s *Service) addV1Routes(r *mux.Router) {
+	r.HandleFunc("/users", s.idempotent(s.createUser)).Methods("POST")
+	r.HandleFunc("/users", s.getUserList).Methods("GET")
+	r.HandleFunc("/users/{id}", s.findUser).Methods("GET")
+	r.HandleFunc("/users/{id}", s.deleteUser).Methods("DELETE")
+	r.HandleFunc("/users/{id}", s.updateUser).Methods("PUT")
+	r.HandleFunc("/users/{id}", s.patchUser).Methods("PATCH")
+	r.HandleFunc("/users/{id:[^/:]+}:restore", s.restoreUser).Methods("POST")
+	r.HandleFunc("/users/{id}/revisions", s.getUserRevisionList).Methods("GET")
+	r.HandleFunc("/users/{id}/revisions/{version:[0-9]+}", s.findUserRevision).Methods("GET")
+	r.HandleFunc("/users/{id}/revisions/{version:[0-9]+}:revert", s.revertUser).Methods("POST")
+	r.HandleFunc("/users:purge", s.purgeUsers).Methods("POST")
+	r.HandleFunc("/users:batchCreate", s.batchCreateUsers).Methods("POST")
+	r.HandleFunc("/users:batchGet", s.batchGetUsers).Methods("POST")
+	r.HandleFunc("/users:batchDelete", s.batchDeleteUsers).Methods("POST")
 }
 
 type requester interface {
@@ -70,14 +170,15 @@ type userFindResponse struct {
 	User *User `json:"user"`
 }
 
-// list
-type userListResponse struct {
-	Users []*User `json:"users"`
+// delete
+type userDeleteResponse struct {
+	User *User `json:"user"`
 }
 
-// error
-type errorResponse struct {
-	ErrorMessage string `json:"errorMessage"`
+// list
+type userListResponse struct {
+	Users      []*User `json:"users"`
+	NextCursor string  `json:"nextCursor,omitempty"`
 }
 
 func encodeRequestBody(payload interface{}) io.Reader {
@@ -107,95 +208,142 @@ func decodeRequestBody(body io.ReadCloser, v interface{}) error {
 	return nil
 }
 
-func writeErrorResponse(w http.ResponseWriter, message string) {
-	w.WriteHeader(http.StatusInternalServerError)
-	res := &errorResponse{
-		ErrorMessage: message,
-	}
-	json.NewEncoder(w).Encode(res)
-}
-
-//
-func newRepository() *datastoreRepository {
-	return &datastoreRepository{}
-}
-
-func createUser(w http.ResponseWriter, r *http.Request) {
+func (s *Service) createUser(w http.ResponseWriter, r *http.Request) {
 	log.Printf("content-type:%v", r.Header.Get("Content-Type"))
-	ctx := appengine.NewContext(r)
+	ctx := s.newContext(r)
 
 	var p userCreateRequest
 	err := decodeRequestBody(r.Body, &p)
 	if err != nil {
-		writeErrorResponse(w, err.Error())
+		writeBadRequestResponse(w, r, err.Error())
 		return
 	}
 
 	if p.User == nil {
 		log.Printf("Invalid request payloads	payloads:%v", p)
-		writeErrorResponse(w, "Invalid parameter")
+		writeBadRequestResponse(w, r, "Invalid parameter")
 		return
 	}
 
-	if p.User.Name == "" {
-		writeErrorResponse(w, "User name is empty")
+	id, err := s.idGenerator.NewID()
+	if err != nil {
+		log.Printf("NewID	err:%v", err)
+		writeErrorResponse(w, r, err, "Can not create user")
 		return
 	}
 
 	user := &User{
-		Id:        uuid.New().String(),
+		Id:        id,
 		Name:      p.User.Name,
 		CreatedAt: time.Now(),
 	}
 
-	repository := newRepository()
-	err = repository.Create(ctx, user)
+	err = user.isValid()
+	if err != nil {
+		writeErrorResponse(w, r, err, "Invalid user")
+		return
+	}
+
+	err = s.repository.Create(ctx, user)
 	if err != nil {
 		log.Printf("UserCreateError	err:%v", err)
+		writeErrorResponse(w, r, err, "Can not create user")
+		return
 	}
 
+	writeETag(w, user)
 	res := &userCreateResponse{User: user}
 	json.NewEncoder(w).Encode(res)
 }
 
-func findUser(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+func (s *Service) findUser(w http.ResponseWriter, r *http.Request) {
+	ctx := s.newContext(r)
 
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	repository := newRepository()
-	user, err := repository.Find(ctx, id)
+	include, err := includeDeleted(r)
+	if err != nil {
+		writeInvalidParameterResponse(w, r, err.Error())
+		return
+	}
 
+	var user *User
+	if include {
+		if err := s.requireAdmin(ctx); err != nil {
+			writeErrorResponse(w, r, err, "Only admins can include deleted users")
+			return
+		}
+		user, err = s.repository.Find(ctx, id)
+	} else {
+		user, err = s.findActiveUser(ctx, id)
+	}
 	if err != nil {
 		log.Printf("FindUser	err:%v", err)
-		writeErrorResponse(w, "Can not find user")
+		writeErrorResponse(w, r, err, "Can not find user")
 		return
 	}
 
+	writeETag(w, user)
 	res := userFindResponse{
 		User: user,
 	}
 	json.NewEncoder(w).Encode(res)
 }
 
-func deleteUser(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+func (s *Service) deleteUser(w http.ResponseWriter, r *http.Request) {
+	ctx := s.newContext(r)
 
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	repository := newRepository()
-	err := repository.Delete(ctx, id)
+	user, err := s.findActiveUser(withFreshRead(ctx), id)
+	if err != nil {
+		log.Printf("FindUser	err:%v", err)
+		writeErrorResponse(w, r, err, "Can not find user")
+		return
+	}
+
+	if !matchIfMatch(r, user) {
+		writeErrorResponse(w, r, ErrVersionMismatch, "If-Match does not match the user version")
+		return
+	}
+
+	// Users are soft deleted, so that they can be restored until purged.
+	// Update fails if the user changed since Find.
+	user.DeletedAt = time.Now()
+	err = s.repository.Update(ctx, user)
 	if err != nil {
 		log.Printf("DeleteUser	err:%v", err)
-		writeErrorResponse(w, "Can not delete user")
+		writeErrorResponse(w, r, err, "Can not delete user")
+		return
+	}
+
+	// The deleted user is only returned on Prefer: return=representation.
+	if !preferRepresentation(r) {
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
+
+	res := userDeleteResponse{
+		User: user,
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func preferRepresentation(r *http.Request) bool {
+	for _, prefer := range r.Header["Prefer"] {
+		for _, p := range strings.Split(prefer, ",") {
+			if strings.TrimSpace(p) == "return=representation" {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-func updateUser(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+func (s *Service) updateUser(w http.ResponseWriter, r *http.Request) {
+	ctx := s.newContext(r)
 
 	vars := mux.Vars(r)
 	id := vars["id"]
@@ -203,51 +351,222 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 	var p userUpdateRequest
 	err := decodeRequestBody(r.Body, &p)
 	if err != nil {
-		writeErrorResponse(w, err.Error())
+		writeBadRequestResponse(w, r, err.Error())
 		return
 	}
 
 	if p.User == nil {
 		log.Printf("Invalid request payloads	payloads:%v", p)
-		writeErrorResponse(w, "Invalid parameter")
+		writeBadRequestResponse(w, r, "Invalid parameter")
 		return
 	}
 
-	repository := newRepository()
-	user, err := repository.Find(ctx, id)
+	if ifNoneMatchAny(r) {
+		s.createUserWithId(ctx, w, r, id, p.User)
+		return
+	}
+
+	user, err := s.findActiveUser(withFreshRead(ctx), id)
 
 	if err != nil || user == nil {
 		log.Printf("FindUser	err:%v", err)
-		writeErrorResponse(w, "Can not find user")
+		writeErrorResponse(w, r, err, "Can not find user")
+		return
+	}
+
+	if !matchIfMatch(r, user) {
+		writeErrorResponse(w, r, ErrVersionMismatch, "If-Match does not match the user version")
 		return
 	}
 
 	user.Name = p.User.Name
 
-	err = repository.Update(ctx, user)
-	if err != nil || user == nil {
-		log.Printf("DeleteUser	err:%v", err)
-		writeErrorResponse(w, "Can not update user")
+	err = user.isValid()
+	if err != nil {
+		writeErrorResponse(w, r, err, "Invalid user")
+		return
+	}
+
+	err = s.repository.Update(ctx, user)
+	if err != nil {
+		log.Printf("UpdateUser	err:%v", err)
+		writeErrorResponse(w, r, err, "Can not update user")
 		return
 	}
 
+	writeETag(w, user)
 	res := userUpdateResponse{
 		User: user,
 	}
 	json.NewEncoder(w).Encode(res)
 }
 
-func getUserList(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+func (s *Service) patchUser(w http.ResponseWriter, r *http.Request) {
+	ctx := s.newContext(r)
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != contentTypeMergePatchJson && contentType != contentTypeJsonPatchJson {
+		writeUnsupportedMediaTypeResponse(w, r, fmt.Sprintf("PATCH requires %s or %s", contentTypeMergePatchJson, contentTypeJsonPatchJson))
+		return
+	}
+
+	var mergePatch interface{}
+	var operations []patchOperation
+	var err error
+	if contentType == contentTypeMergePatchJson {
+		err = decodeRequestBody(r.Body, &mergePatch)
+	} else {
+		err = decodeRequestBody(r.Body, &operations)
+	}
+	if err != nil {
+		writeBadRequestResponse(w, r, err.Error())
+		return
+	}
+
+	user, err := s.findActiveUser(withFreshRead(ctx), id)
+	if err != nil {
+		log.Printf("FindUser	err:%v", err)
+		writeErrorResponse(w, r, err, "Can not find user")
+		return
+	}
 
-	repository := newRepository()
-	users, err := repository.List(ctx)
+	if !matchIfMatch(r, user) {
+		writeErrorResponse(w, r, ErrVersionMismatch, "If-Match does not match the user version")
+		return
+	}
+
+	var patchedUser *User
+	if contentType == contentTypeMergePatchJson {
+		patchedUser, err = applyMergePatch(user, mergePatch)
+	} else {
+		patchedUser, err = applyJSONPatch(user, operations)
+	}
+	if err != nil {
+		writeErrorResponse(w, r, err, "Can not apply patch")
+		return
+	}
+
+	err = s.repository.Update(ctx, patchedUser)
 	if err != nil {
-		log.Fatalf("ListUser	err:%v", err)
+		log.Printf("PatchUser	err:%v", err)
+		writeErrorResponse(w, r, err, "Can not update user")
+		return
+	}
+
+	writeETag(w, patchedUser)
+	res := userUpdateResponse{
+		User: patchedUser,
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func (s *Service) getUserList(w http.ResponseWriter, r *http.Request) {
+	ctx := s.newContext(r)
+
+	opts, err := parseListOptions(r.URL.Query())
+	if err != nil {
+		writeInvalidParameterResponse(w, r, err.Error())
+		return
+	}
+	if opts.IncludeDeleted {
+		if err := s.requireAdmin(ctx); err != nil {
+			writeErrorResponse(w, r, err, "Only admins can include deleted users")
+			return
+		}
+	}
+
+	page, err := s.repository.ListWithOptions(ctx, opts)
+	if err != nil {
+		log.Printf("ListUser	err:%v", err)
+		writeErrorResponse(w, r, err, "Can not list users")
+		return
+	}
+
+	if page.NextCursor != "" {
+		w.Header().Set("Link", nextPageLink(r, page.NextCursor))
 	}
 
 	res := userListResponse{
-		Users: users,
+		Users:      page.Users,
+		NextCursor: page.NextCursor,
 	}
 	json.NewEncoder(w).Encode(res)
 }
+
+var listQueryParameters = []string{
+	"limit",
+	"cursor",
+	"namePrefix",
+	"createdSince",
+	"createdBefore",
+	"updatedSince",
+	"updatedBefore",
+	"sort",
+	"includeDeleted",
+}
+
+func parseListOptions(query url.Values) (ListOptions, error) {
+	for name := range query {
+		known := false
+		for _, p := range listQueryParameters {
+			if p == name {
+				known = true
+			}
+		}
+		if !known {
+			return ListOptions{}, fmt.Errorf("unknown parameter %q", name)
+		}
+	}
+
+	opts := ListOptions{
+		Cursor:     query.Get("cursor"),
+		NamePrefix: query.Get("namePrefix"),
+		Sort:       ListSort(query.Get("sort")),
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return opts, fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+		}
+		opts.Limit = limit
+	}
+	if v := query.Get("includeDeleted"); v != "" {
+		include, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("includeDeleted must be a boolean")
+		}
+		opts.IncludeDeleted = include
+	}
+
+	times := map[string]*time.Time{
+		"createdSince":  &opts.CreatedSince,
+		"createdBefore": &opts.CreatedBefore,
+		"updatedSince":  &opts.UpdatedSince,
+		"updatedBefore": &opts.UpdatedBefore,
+	}
+	for name, t := range times {
+		if v := query.Get(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return opts, fmt.Errorf("%s must be an RFC 3339 timestamp", name)
+			}
+			*t = parsed
+		}
+	}
+
+	if err := opts.validate(); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+func nextPageLink(r *http.Request, cursor string) string {
+	u := *r.URL
+	query := u.Query()
+	query.Set("cursor", cursor)
+	u.RawQuery = query.Encode()
+	return fmt.Sprintf("<%s>; rel=\"next\"", u.RequestURI())
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"google.golang.org/appengine"
@@ -15,22 +17,30 @@ import (
 
 type responseHandlerFunc func(t *testing.T, rr *httptest.ResponseRecorder, apiTest apiTest)
 
-type httpHandlerFunc func(w http.ResponseWriter, r *http.Request)
+type httpHandlerFunc func(s *Service, w http.ResponseWriter, r *http.Request)
 
-type setupFunc func(ctx context.Context, t *testing.T, apiTest apiTest)
+type setupFunc func(ctx context.Context, t *testing.T, repository BatchUserRepository, apiTest apiTest)
 
 type apiTest struct {
 	name                string
 	method              string
 	url                 string
 	urlVars             map[string]string
+	headers             map[string]string
 	request             requester
 	setupFunc           setupFunc
 	expectedStatusCode  int
+	expectedErrorCode   string
 	httpHandlerFunc     httpHandlerFunc
 	responseHandlerFunc responseHandlerFunc
 }
 
+// testAdmin is the admin of the services under test, and adminHeaders
+// authenticate it.
+const testAdmin = "admin@example.com"
+
+var adminHeaders = map[string]string{"X-Goog-Authenticated-User-Email": "accounts.google.com:" + testAdmin}
+
 var apiTests = []apiTest{
 
 	// Create
@@ -40,132 +50,1012 @@ var apiTests = []apiTest{
 		url:                 "/users/v1",
 		urlVars:             nil,
 		request:             userCreateRequest{User: &User{Name: ""}},
-		expectedStatusCode:  http.StatusInternalServerError,
-		httpHandlerFunc:     createUser,
+		expectedStatusCode:  http.StatusUnprocessableEntity,
+		expectedErrorCode:   ErrorCodeInvalidUser,
+		httpHandlerFunc:     (*Service).createUser,
+		responseHandlerFunc: nil,
+	},
+
+	{
+		name:                "Create_WhenPassingNoUser_ReturnError",
+		method:              "POST",
+		url:                 "/users/v1",
+		urlVars:             nil,
+		request:             userCreateRequest{},
+		expectedStatusCode:  http.StatusBadRequest,
+		expectedErrorCode:   ErrorCodeInvalidRequestBody,
+		httpHandlerFunc:     (*Service).createUser,
+		responseHandlerFunc: nil,
+	},
+
+	{
+		name:                "Create_WhenPassingTooLongName_ReturnError",
+		method:              "POST",
+		url:                 "/users/v1",
+		urlVars:             nil,
+		request:             userCreateRequest{User: &User{Name: strings.Repeat("a", maxUserNameLength+1)}},
+		expectedStatusCode:  http.StatusUnprocessableEntity,
+		expectedErrorCode:   ErrorCodeInvalidUser,
+		httpHandlerFunc:     (*Service).createUser,
+		responseHandlerFunc: testInvalidUserNameResponse,
+	},
+
+	{
+		name:                "Create_ByUser_ReturnCreatedUser",
+		method:              "POST",
+		url:                 "/users/v1",
+		urlVars:             nil,
+		request:             userCreateRequest{User: &User{Name: fake.FirstName()}},
+		expectedStatusCode:  http.StatusOK,
+		httpHandlerFunc:     (*Service).createUser,
+		responseHandlerFunc: testUserCreateResponse,
+	},
+
+	// Find
+	{
+		name:   "Find_ByNotExistingUser_ReturnError",
+		method: "GET",
+		url:    "/users/v1/DummyId",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		request:            nil,
+		expectedStatusCode: http.StatusNotFound,
+		expectedErrorCode:  ErrorCodeUserNotFound,
+		httpHandlerFunc:    (*Service).findUser,
+	},
+
+	{
+		name:   "Find_ByExistingUser_ReturnTheUser",
+		method: "GET",
+		url:    "/users/v1/DummyId",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		request:             nil,
+		setupFunc:           setupDummyUser,
+		expectedStatusCode:  http.StatusOK,
+		httpHandlerFunc:     (*Service).findUser,
+		responseHandlerFunc: testUserFindResponse,
+	},
+
+	{
+		name:   "Find_WhenUserIsDeleted_ReturnError",
+		method: "GET",
+		url:    "/users/v1/DummyId",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		request:            nil,
+		setupFunc:          setupDeletedDummyUser,
+		expectedStatusCode: http.StatusNotFound,
+		expectedErrorCode:  ErrorCodeUserNotFound,
+		httpHandlerFunc:    (*Service).findUser,
+	},
+
+	{
+		name:   "Find_WhenIncludingDeletedUser_ReturnTheUser",
+		method: "GET",
+		url:    "/users/v1/DummyId?includeDeleted=true",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		headers:             adminHeaders,
+		request:             nil,
+		setupFunc:           setupDeletedDummyUser,
+		expectedStatusCode:  http.StatusOK,
+		httpHandlerFunc:     (*Service).findUser,
+		responseHandlerFunc: testUserFindResponse,
+	},
+
+	{
+		name:   "Find_WhenIncludingDeletedUserAsNonAdmin_ReturnError",
+		method: "GET",
+		url:    "/users/v1/DummyId?includeDeleted=true",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		headers:            map[string]string{"X-Goog-Authenticated-User-Email": "accounts.google.com:user@example.com"},
+		request:            nil,
+		setupFunc:          setupDeletedDummyUser,
+		expectedStatusCode: http.StatusForbidden,
+		expectedErrorCode:  ErrorCodeForbidden,
+		httpHandlerFunc:    (*Service).findUser,
+	},
+
+	{
+		name:   "Find_WhenPassingInvalidIncludeDeleted_ReturnError",
+		method: "GET",
+		url:    "/users/v1/DummyId?includeDeleted=maybe",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		request:            nil,
+		setupFunc:          setupDummyUser,
+		expectedStatusCode: http.StatusBadRequest,
+		expectedErrorCode:  ErrorCodeInvalidParameter,
+		httpHandlerFunc:    (*Service).findUser,
+	},
+
+	// Update
+	{
+		name:   "Update_WhenPasingNonExistingUser_ReturnError",
+		method: "PUT",
+		url:    "/users/v1/DummyId",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		request:             userUpdateRequest{User: &User{Id: "DummyId", Name: "ChangedName"}},
+		expectedStatusCode:  http.StatusNotFound,
+		expectedErrorCode:   ErrorCodeUserNotFound,
+		httpHandlerFunc:     (*Service).updateUser,
 		responseHandlerFunc: nil,
 	},
 
 	{
-		name:                "Create_ByUser_ReturnCreatedUser",
-		method:              "POST",
-		url:                 "/users/v1",
+		name:   "Update_WhenPasingExistingUser_ReturnNonError",
+		method: "PUT",
+		url:    "/users/v1/DummyId",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		request:             userUpdateRequest{User: &User{Id: "DummyId", Name: "ChangedName"}},
+		setupFunc:           setupDummyUser,
+		expectedStatusCode:  http.StatusOK,
+		httpHandlerFunc:     (*Service).updateUser,
+		responseHandlerFunc: testUserUpdateResponse,
+	},
+
+	{
+		name:   "Update_WhenUserIsDeleted_ReturnError",
+		method: "PUT",
+		url:    "/users/v1/DummyId",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		request: userUpdateRequest{
+			User: &User{
+				Name: "UpdatedName",
+			},
+		},
+		setupFunc:          setupDeletedDummyUser,
+		expectedStatusCode: http.StatusNotFound,
+		expectedErrorCode:  ErrorCodeUserNotFound,
+		httpHandlerFunc:    (*Service).updateUser,
+	},
+
+	{
+		name:   "Update_WhenPassingStaleIfMatch_ReturnError",
+		method: "PUT",
+		url:    "/users/v1/DummyId",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		headers: map[string]string{
+			"If-Match": `"5"`,
+		},
+		request:            userUpdateRequest{User: &User{Id: "DummyId", Name: "ChangedName"}},
+		setupFunc:          setupDummyUser,
+		expectedStatusCode: http.StatusPreconditionFailed,
+		expectedErrorCode:  ErrorCodeVersionMismatch,
+		httpHandlerFunc:    (*Service).updateUser,
+	},
+
+	{
+		name:   "Update_WhenPassingMatchingIfMatch_ReturnUpdatedUser",
+		method: "PUT",
+		url:    "/users/v1/DummyId",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		headers: map[string]string{
+			"If-Match": `"1"`,
+		},
+		request:             userUpdateRequest{User: &User{Id: "DummyId", Name: "ChangedName"}},
+		setupFunc:           setupDummyUser,
+		expectedStatusCode:  http.StatusOK,
+		httpHandlerFunc:     (*Service).updateUser,
+		responseHandlerFunc: testUserUpdateResponse,
+	},
+
+	{
+		name:   "Update_WhenPassingIfNoneMatchForMissingUser_ReturnCreatedUser",
+		method: "PUT",
+		url:    "/users/v1/DummyId",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		headers: map[string]string{
+			"If-None-Match": "*",
+		},
+		request:             userUpdateRequest{User: &User{Name: "CreatedName"}},
+		expectedStatusCode:  http.StatusCreated,
+		httpHandlerFunc:     (*Service).updateUser,
+		responseHandlerFunc: testUserPutCreateResponse,
+	},
+
+	{
+		name:   "Update_WhenPassingIfNoneMatchForExistingUser_ReturnError",
+		method: "PUT",
+		url:    "/users/v1/DummyId",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		headers: map[string]string{
+			"If-None-Match": "*",
+		},
+		request:            userUpdateRequest{User: &User{Name: "CreatedName"}},
+		setupFunc:          setupDummyUser,
+		expectedStatusCode: http.StatusConflict,
+		expectedErrorCode:  ErrorCodeUserConflict,
+		httpHandlerFunc:    (*Service).updateUser,
+	},
+
+	{
+		name:   "Update_WhenPassingIfNoneMatchForDeletedUser_ReturnError",
+		method: "PUT",
+		url:    "/users/v1/DummyId",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		headers: map[string]string{
+			"If-None-Match": "*",
+		},
+		request:            userUpdateRequest{User: &User{Name: "CreatedName"}},
+		setupFunc:          setupDeletedDummyUser,
+		expectedStatusCode: http.StatusConflict,
+		expectedErrorCode:  ErrorCodeUserConflict,
+		httpHandlerFunc:    (*Service).updateUser,
+	},
+
+	{
+		name:   "Update_WhenPassingIfNoneMatchWithInvalidId_ReturnError",
+		method: "PUT",
+		url:    "/users/v1/-DummyId",
+		urlVars: map[string]string{
+			"id": "-DummyId",
+		},
+		headers: map[string]string{
+			"If-None-Match": "*",
+		},
+		request:            userUpdateRequest{User: &User{Name: "CreatedName"}},
+		expectedStatusCode: http.StatusUnprocessableEntity,
+		expectedErrorCode:  ErrorCodeInvalidUser,
+		httpHandlerFunc:    (*Service).updateUser,
+	},
+
+	// Patch
+	{
+		name:   "Patch_WhenPassingName_ReturnPatchedUser",
+		method: "PATCH",
+		url:    "/users/v1/DummyId",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		headers: map[string]string{
+			"Content-Type": contentTypeMergePatchJson,
+		},
+		request:             map[string]interface{}{"name": "ChangedName"},
+		setupFunc:           setupDummyUser,
+		expectedStatusCode:  http.StatusOK,
+		httpHandlerFunc:     (*Service).patchUser,
+		responseHandlerFunc: testUserPatchResponse,
+	},
+
+	{
+		name:   "Patch_WhenPassingUnknownField_ReturnError",
+		method: "PATCH",
+		url:    "/users/v1/DummyId",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		headers: map[string]string{
+			"Content-Type": contentTypeMergePatchJson,
+		},
+		request:            map[string]interface{}{"age": 20},
+		setupFunc:          setupDummyUser,
+		expectedStatusCode: http.StatusUnprocessableEntity,
+		expectedErrorCode:  ErrorCodeInvalidUser,
+		httpHandlerFunc:    (*Service).patchUser,
+	},
+
+	{
+		name:   "Patch_WhenPassingReadOnlyField_ReturnError",
+		method: "PATCH",
+		url:    "/users/v1/DummyId",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		headers: map[string]string{
+			"Content-Type": contentTypeMergePatchJson,
+		},
+		request:            map[string]interface{}{"id": "OtherId"},
+		setupFunc:          setupDummyUser,
+		expectedStatusCode: http.StatusUnprocessableEntity,
+		expectedErrorCode:  ErrorCodeInvalidUser,
+		httpHandlerFunc:    (*Service).patchUser,
+	},
+
+	{
+		name:   "Patch_WhenRemovingName_ReturnError",
+		method: "PATCH",
+		url:    "/users/v1/DummyId",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		headers: map[string]string{
+			"Content-Type": contentTypeMergePatchJson,
+		},
+		request:            map[string]interface{}{"name": nil},
+		setupFunc:          setupDummyUser,
+		expectedStatusCode: http.StatusUnprocessableEntity,
+		expectedErrorCode:  ErrorCodeInvalidUser,
+		httpHandlerFunc:    (*Service).patchUser,
+	},
+
+	{
+		name:   "Patch_WhenPassingNonExistingUser_ReturnError",
+		method: "PATCH",
+		url:    "/users/v1/DummyId",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		headers: map[string]string{
+			"Content-Type": contentTypeMergePatchJson,
+		},
+		request:            map[string]interface{}{"name": "ChangedName"},
+		expectedStatusCode: http.StatusNotFound,
+		expectedErrorCode:  ErrorCodeUserNotFound,
+		httpHandlerFunc:    (*Service).patchUser,
+	},
+
+	{
+		name:   "Patch_WhenPassingJsonContentType_ReturnError",
+		method: "PATCH",
+		url:    "/users/v1/DummyId",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		request:            map[string]interface{}{"name": "ChangedName"},
+		setupFunc:          setupDummyUser,
+		expectedStatusCode: http.StatusUnsupportedMediaType,
+		expectedErrorCode:  ErrorCodeUnsupportedMedia,
+		httpHandlerFunc:    (*Service).patchUser,
+	},
+
+	{
+		name:   "Patch_WhenPassingJsonPatch_ReturnPatchedUser",
+		method: "PATCH",
+		url:    "/users/v1/DummyId",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		headers: map[string]string{
+			"Content-Type": contentTypeJsonPatchJson,
+		},
+		request: []map[string]interface{}{
+			{"op": "test", "path": "/id", "value": "DummyId"},
+			{"op": "replace", "path": "/name", "value": "ChangedName"},
+		},
+		setupFunc:          setupDummyUser,
+		expectedStatusCode: http.StatusOK,
+		httpHandlerFunc:    (*Service).patchUser,
+	},
+
+	{
+		name:   "Patch_WhenPassingFailingJsonPatchTest_ReturnError",
+		method: "PATCH",
+		url:    "/users/v1/DummyId",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		headers: map[string]string{
+			"Content-Type": contentTypeJsonPatchJson,
+		},
+		request: []map[string]interface{}{
+			{"op": "replace", "path": "/name", "value": "ChangedName"},
+			{"op": "test", "path": "/version", "value": 5},
+		},
+		setupFunc:           setupDummyUser,
+		expectedStatusCode:  http.StatusUnprocessableEntity,
+		expectedErrorCode:   ErrorCodePatchFailed,
+		httpHandlerFunc:     (*Service).patchUser,
+		responseHandlerFunc: testPatchFailedResponse,
+	},
+
+	// Delete
+	{
+		name:   "Delete_WhenPassingStaleIfMatch_ReturnError",
+		method: "DELETE",
+		url:    "/users/v1/DummyId",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		headers: map[string]string{
+			"If-Match": `"5"`,
+		},
+		request:            nil,
+		setupFunc:          setupDummyUser,
+		expectedStatusCode: http.StatusPreconditionFailed,
+		expectedErrorCode:  ErrorCodeVersionMismatch,
+		httpHandlerFunc:    (*Service).deleteUser,
+	},
+
+	{
+		name:   "Delete_WhenPasingNotExistingUser_ReturnError",
+		method: "DELETE",
+		url:    "/users/v1/DummyId",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		request:            nil,
+		expectedStatusCode: http.StatusNotFound,
+		expectedErrorCode:  ErrorCodeUserNotFound,
+		httpHandlerFunc:    (*Service).deleteUser,
+	},
+
+	{
+		name:   "Delete_WhenPasingExistingUser_ReturnNonError",
+		method: "DELETE",
+		url:    "/users/v1/DummyId",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		request:            nil,
+		setupFunc:          setupDummyUser,
+		expectedStatusCode: http.StatusNoContent,
+		httpHandlerFunc:    (*Service).deleteUser,
+	},
+
+	{
+		name:   "Delete_WhenPreferringRepresentation_ReturnDeletedUser",
+		method: "DELETE",
+		url:    "/users/v1/DummyId",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		headers: map[string]string{
+			"If-Match": `"1"`,
+			"Prefer":   "return=representation",
+		},
+		request:             nil,
+		setupFunc:           setupDummyUser,
+		expectedStatusCode:  http.StatusOK,
+		httpHandlerFunc:     (*Service).deleteUser,
+		responseHandlerFunc: testUserDeleteResponse,
+	},
+
+	{
+		name:   "Delete_WhenUserIsDeleted_ReturnError",
+		method: "DELETE",
+		url:    "/users/v1/DummyId",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		request:            nil,
+		setupFunc:          setupDeletedDummyUser,
+		expectedStatusCode: http.StatusNotFound,
+		expectedErrorCode:  ErrorCodeUserNotFound,
+		httpHandlerFunc:    (*Service).deleteUser,
+	},
+
+	// Restore
+	{
+		name:   "Restore_WhenUserIsDeleted_ReturnRestoredUser",
+		method: "POST",
+		url:    "/v1/users/DummyId:restore",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		headers:             adminHeaders,
+		request:             nil,
+		setupFunc:           setupDeletedDummyUser,
+		expectedStatusCode:  http.StatusOK,
+		httpHandlerFunc:     (*Service).restoreUser,
+		responseHandlerFunc: testUserRestoreResponse,
+	},
+
+	{
+		name:   "Restore_WhenUserIsNotDeleted_ReturnTheUser",
+		method: "POST",
+		url:    "/v1/users/DummyId:restore",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		headers:             adminHeaders,
+		request:             nil,
+		setupFunc:           setupDummyUser,
+		expectedStatusCode:  http.StatusOK,
+		httpHandlerFunc:     (*Service).restoreUser,
+		responseHandlerFunc: testUserRestoreResponse,
+	},
+
+	{
+		name:   "Restore_WhenPassingStaleIfMatch_ReturnError",
+		method: "POST",
+		url:    "/v1/users/DummyId:restore",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		headers: map[string]string{
+			"If-Match":                        `"5"`,
+			"X-Goog-Authenticated-User-Email": adminHeaders["X-Goog-Authenticated-User-Email"],
+		},
+		request:            nil,
+		setupFunc:          setupDeletedDummyUser,
+		expectedStatusCode: http.StatusPreconditionFailed,
+		expectedErrorCode:  ErrorCodeVersionMismatch,
+		httpHandlerFunc:    (*Service).restoreUser,
+	},
+
+	{
+		name:   "Restore_WhenPasingNotExistingUser_ReturnError",
+		method: "POST",
+		url:    "/v1/users/DummyId:restore",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		headers:            adminHeaders,
+		request:            nil,
+		expectedStatusCode: http.StatusNotFound,
+		expectedErrorCode:  ErrorCodeUserNotFound,
+		httpHandlerFunc:    (*Service).restoreUser,
+	},
+
+	{
+		name:   "Restore_WhenActorIsNotAdmin_ReturnError",
+		method: "POST",
+		url:    "/v1/users/DummyId:restore",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		request:            nil,
+		setupFunc:          setupDeletedDummyUser,
+		expectedStatusCode: http.StatusForbidden,
+		expectedErrorCode:  ErrorCodeForbidden,
+		httpHandlerFunc:    (*Service).restoreUser,
+	},
+
+	// Purge
+	{
+		name:                "Purge_WhenRetentionExpired_PurgeDeletedUsers",
+		method:              "POST",
+		url:                 "/v1/users:purge",
+		urlVars:             map[string]string{"id": "DummyId"},
+		headers:             adminHeaders,
+		request:             nil,
+		setupFunc:           setupDeletedDummyUser,
+		expectedStatusCode:  http.StatusOK,
+		httpHandlerFunc:     (*Service).purgeUsers,
+		responseHandlerFunc: testUserPurgeResponse,
+	},
+
+	{
+		name:               "Purge_WhenActorIsNotAdmin_ReturnError",
+		method:             "POST",
+		url:                "/v1/users:purge",
+		urlVars:            map[string]string{"id": "DummyId"},
+		request:            nil,
+		setupFunc:          setupDeletedDummyUser,
+		expectedStatusCode: http.StatusForbidden,
+		expectedErrorCode:  ErrorCodeForbidden,
+		httpHandlerFunc:    (*Service).purgeUsers,
+	},
+
+	// Revisions
+	{
+		name:   "Revisions_WhenUserIsUpdated_ReturnEveryRevision",
+		method: "GET",
+		url:    "/v1/users/DummyId/revisions",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		request:             nil,
+		setupFunc:           setupUpdatedDummyUser,
+		expectedStatusCode:  http.StatusOK,
+		httpHandlerFunc:     (*Service).getUserRevisionList,
+		responseHandlerFunc: testUserRevisionListResponse,
+	},
+
+	{
+		name:   "Revisions_WhenPassingLimit_ReturnFirstPage",
+		method: "GET",
+		url:    "/v1/users/DummyId/revisions?limit=1",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		request:             nil,
+		setupFunc:           setupUpdatedDummyUser,
+		expectedStatusCode:  http.StatusOK,
+		httpHandlerFunc:     (*Service).getUserRevisionList,
+		responseHandlerFunc: testUserRevisionListPageResponse,
+	},
+
+	{
+		name:   "Revisions_WhenUserHasNoRevision_ReturnEmptyList",
+		method: "GET",
+		url:    "/v1/users/DummyId/revisions",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		request:             nil,
+		setupFunc:           setupDummyUserWithoutRevision,
+		expectedStatusCode:  http.StatusOK,
+		httpHandlerFunc:     (*Service).getUserRevisionList,
+		responseHandlerFunc: testEmptyUserRevisionListResponse,
+	},
+
+	{
+		name:   "Revisions_WhenPasingNotExistingUser_ReturnError",
+		method: "GET",
+		url:    "/v1/users/DummyId/revisions",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		request:            nil,
+		expectedStatusCode: http.StatusNotFound,
+		expectedErrorCode:  ErrorCodeUserNotFound,
+		httpHandlerFunc:    (*Service).getUserRevisionList,
+	},
+
+	{
+		name:   "Revisions_WhenPassingUnknownParameter_ReturnError",
+		method: "GET",
+		url:    "/v1/users/DummyId/revisions?sort=name",
+		urlVars: map[string]string{
+			"id": "DummyId",
+		},
+		request:            nil,
+		setupFunc:          setupUpdatedDummyUser,
+		expectedStatusCode: http.StatusBadRequest,
+		expectedErrorCode:  ErrorCodeInvalidParameter,
+		httpHandlerFunc:    (*Service).getUserRevisionList,
+	},
+
+	{
+		name:   "Revision_WhenPassingExistingVersion_ReturnTheRevision",
+		method: "GET",
+		url:    "/v1/users/DummyId/revisions/1",
+		urlVars: map[string]string{
+			"id":      "DummyId",
+			"version": "1",
+		},
+		request:             nil,
+		setupFunc:           setupUpdatedDummyUser,
+		expectedStatusCode:  http.StatusOK,
+		httpHandlerFunc:     (*Service).findUserRevision,
+		responseHandlerFunc: testUserRevisionFindResponse,
+	},
+
+	{
+		name:   "Revision_WhenPassingNotExistingVersion_ReturnError",
+		method: "GET",
+		url:    "/v1/users/DummyId/revisions/3",
+		urlVars: map[string]string{
+			"id":      "DummyId",
+			"version": "3",
+		},
+		request:            nil,
+		setupFunc:          setupUpdatedDummyUser,
+		expectedStatusCode: http.StatusNotFound,
+		expectedErrorCode:  ErrorCodeRevisionNotFound,
+		httpHandlerFunc:    (*Service).findUserRevision,
+	},
+
+	// Revert
+	{
+		name:   "Revert_WhenPassingOldRevision_ReturnRevertedUser",
+		method: "POST",
+		url:    "/v1/users/DummyId/revisions/1:revert",
+		urlVars: map[string]string{
+			"id":      "DummyId",
+			"version": "1",
+		},
+		headers: map[string]string{
+			"If-Match": `"2"`,
+		},
+		request:             nil,
+		setupFunc:           setupUpdatedDummyUser,
+		expectedStatusCode:  http.StatusOK,
+		httpHandlerFunc:     (*Service).revertUser,
+		responseHandlerFunc: testUserRevertResponse,
+	},
+
+	{
+		name:   "Revert_WhenPassingStaleIfMatch_ReturnError",
+		method: "POST",
+		url:    "/v1/users/DummyId/revisions/1:revert",
+		urlVars: map[string]string{
+			"id":      "DummyId",
+			"version": "1",
+		},
+		headers: map[string]string{
+			"If-Match": `"1"`,
+		},
+		request:            nil,
+		setupFunc:          setupUpdatedDummyUser,
+		expectedStatusCode: http.StatusPreconditionFailed,
+		expectedErrorCode:  ErrorCodeVersionMismatch,
+		httpHandlerFunc:    (*Service).revertUser,
+	},
+
+	{
+		name:   "Revert_WhenPassingNotExistingRevision_ReturnError",
+		method: "POST",
+		url:    "/v1/users/DummyId/revisions/3:revert",
+		urlVars: map[string]string{
+			"id":      "DummyId",
+			"version": "3",
+		},
+		request:            nil,
+		setupFunc:          setupUpdatedDummyUser,
+		expectedStatusCode: http.StatusNotFound,
+		expectedErrorCode:  ErrorCodeRevisionNotFound,
+		httpHandlerFunc:    (*Service).revertUser,
+	},
+
+	{
+		name:   "Revert_WhenUserIsDeleted_ReturnError",
+		method: "POST",
+		url:    "/v1/users/DummyId/revisions/1:revert",
+		urlVars: map[string]string{
+			"id":      "DummyId",
+			"version": "1",
+		},
+		request:            nil,
+		setupFunc:          setupDeletedDummyUser,
+		expectedStatusCode: http.StatusNotFound,
+		expectedErrorCode:  ErrorCodeUserNotFound,
+		httpHandlerFunc:    (*Service).revertUser,
+	},
+
+	// Batch
+	{
+		name:                "BatchCreate_WhenSomeUsersAreInvalid_ReturnPerItemResults",
+		method:              "POST",
+		url:                 "/v1/users:batchCreate",
+		urlVars:             nil,
+		request:             userBatchCreateRequest{Users: []*User{{Name: "Alice"}, {Name: ""}}},
+		expectedStatusCode:  http.StatusOK,
+		httpHandlerFunc:     (*Service).batchCreateUsers,
+		responseHandlerFunc: testUserBatchCreateResponse,
+	},
+
+	{
+		name:               "BatchCreate_WhenPassingNoUser_ReturnError",
+		method:             "POST",
+		url:                "/v1/users:batchCreate",
+		urlVars:            nil,
+		request:            userBatchCreateRequest{},
+		expectedStatusCode: http.StatusBadRequest,
+		expectedErrorCode:  ErrorCodeInvalidRequestBody,
+		httpHandlerFunc:    (*Service).batchCreateUsers,
+	},
+
+	{
+		name:                "BatchGet_WhenSomeUsersAreMissing_ReturnPerItemResults",
+		method:              "POST",
+		url:                 "/v1/users:batchGet",
+		urlVars:             map[string]string{"id": "DummyId"},
+		request:             userBatchIdsRequest{Ids: []string{"DummyId", "MissingId", ""}},
+		setupFunc:           setupDummyUser,
+		expectedStatusCode:  http.StatusOK,
+		httpHandlerFunc:     (*Service).batchGetUsers,
+		responseHandlerFunc: testUserBatchResponse,
+	},
+
+	{
+		name:                "BatchGet_WhenUserIsDeleted_ReturnError",
+		method:              "POST",
+		url:                 "/v1/users:batchGet",
+		urlVars:             map[string]string{"id": "DummyId"},
+		request:             userBatchIdsRequest{Ids: []string{"DummyId"}},
+		setupFunc:           setupDeletedDummyUser,
+		expectedStatusCode:  http.StatusOK,
+		httpHandlerFunc:     (*Service).batchGetUsers,
+		responseHandlerFunc: testUserBatchNotFoundResponse,
+	},
+
+	{
+		name:               "BatchGet_WhenPassingNoId_ReturnError",
+		method:             "POST",
+		url:                "/v1/users:batchGet",
+		urlVars:            nil,
+		request:            userBatchIdsRequest{},
+		expectedStatusCode: http.StatusBadRequest,
+		expectedErrorCode:  ErrorCodeInvalidRequestBody,
+		httpHandlerFunc:    (*Service).batchGetUsers,
+	},
+
+	{
+		name:                "BatchDelete_WhenSomeUsersAreMissing_ReturnPerItemResults",
+		method:              "POST",
+		url:                 "/v1/users:batchDelete",
+		urlVars:             map[string]string{"id": "DummyId"},
+		request:             userBatchIdsRequest{Ids: []string{"DummyId", "MissingId", ""}},
+		setupFunc:           setupDummyUser,
+		expectedStatusCode:  http.StatusOK,
+		httpHandlerFunc:     (*Service).batchDeleteUsers,
+		responseHandlerFunc: testUserBatchResponse,
+	},
+
+	// List
+	{
+		name:                "List_ReturnUserList",
+		method:              "GET",
+		url:                 "/users/v1/list",
+		urlVars:             nil,
+		request:             nil,
+		setupFunc:           setupDummyUserListWithApiTestCase,
+		expectedStatusCode:  http.StatusOK,
+		httpHandlerFunc:     (*Service).getUserList,
+		responseHandlerFunc: testUserListResponse,
+	},
+
+	{
+		name:                "List_WhenPassingLimit_ReturnFirstPage",
+		method:              "GET",
+		url:                 "/users/v1/list?limit=5",
+		urlVars:             nil,
+		request:             nil,
+		setupFunc:           setupDummyUserListWithApiTestCase,
+		expectedStatusCode:  http.StatusOK,
+		httpHandlerFunc:     (*Service).getUserList,
+		responseHandlerFunc: testUserListPageResponse,
+	},
+
+	{
+		name:                "List_WhenPassingNamePrefixAndSort_ReturnMatchingUsers",
+		method:              "GET",
+		url:                 "/users/v1/list?namePrefix=Al&sort=-name",
 		urlVars:             nil,
-		request:             userCreateRequest{User: &User{Name: fake.FirstName()}},
+		request:             nil,
+		setupFunc:           setupNamedUsers,
 		expectedStatusCode:  http.StatusOK,
-		httpHandlerFunc:     createUser,
-		responseHandlerFunc: testUserCreateResponse,
+		httpHandlerFunc:     (*Service).getUserList,
+		responseHandlerFunc: testUserListFilteredResponse,
 	},
 
-	// Find
 	{
-		name:   "Find_ByNotExistingUser_ReturnError",
-		method: "GET",
-		url:    "/users/v1/DummyId",
-		urlVars: map[string]string{
-			"id": "DummyId",
-		},
-		request:            nil,
-		expectedStatusCode: http.StatusInternalServerError,
-		httpHandlerFunc:    findUser,
+		name:                "List_WhenUserIsDeleted_HideIt",
+		method:              "GET",
+		url:                 "/users/v1/list",
+		urlVars:             map[string]string{"id": "DummyId"},
+		request:             nil,
+		setupFunc:           setupDeletedDummyUser,
+		expectedStatusCode:  http.StatusOK,
+		httpHandlerFunc:     (*Service).getUserList,
+		responseHandlerFunc: testEmptyUserListResponse,
 	},
 
 	{
-		name:   "Find_ByExistingUser_ReturnTheUser",
-		method: "GET",
-		url:    "/users/v1/DummyId",
-		urlVars: map[string]string{
-			"id": "DummyId",
-		},
+		name:                "List_WhenIncludingDeletedUsers_ReturnThem",
+		method:              "GET",
+		url:                 "/users/v1/list?includeDeleted=true",
+		urlVars:             map[string]string{"id": "DummyId"},
+		headers:             adminHeaders,
 		request:             nil,
-		setupFunc:           setupDummyUser,
+		setupFunc:           setupDeletedDummyUser,
 		expectedStatusCode:  http.StatusOK,
-		httpHandlerFunc:     findUser,
-		responseHandlerFunc: testUserFindResponse,
+		httpHandlerFunc:     (*Service).getUserList,
+		responseHandlerFunc: testUserListResponse,
 	},
 
-	// Update
 	{
-		name:   "Update_WhenPasingNonExistingUser_ReturnError",
-		method: "PUT",
-		url:    "/users/v1/DummyId",
-		urlVars: map[string]string{
-			"id": "DummyId",
-		},
-		request:             userUpdateRequest{User: &User{Id: "DummyId", Name: "ChangedName"}},
-		expectedStatusCode:  http.StatusInternalServerError,
-		httpHandlerFunc:     updateUser,
-		responseHandlerFunc: nil,
+		name:               "List_WhenIncludingDeletedUsersAsNonAdmin_ReturnError",
+		method:             "GET",
+		url:                "/users/v1/list?includeDeleted=true",
+		urlVars:            map[string]string{"id": "DummyId"},
+		request:            nil,
+		setupFunc:          setupDeletedDummyUser,
+		expectedStatusCode: http.StatusForbidden,
+		expectedErrorCode:  ErrorCodeForbidden,
+		httpHandlerFunc:    (*Service).getUserList,
 	},
 
 	{
-		name:   "Update_WhenPasingExistingUser_ReturnNonError",
-		method: "PUT",
-		url:    "/users/v1/DummyId",
-		urlVars: map[string]string{
-			"id": "DummyId",
-		},
-		request:             userUpdateRequest{User: &User{Id: "DummyId", Name: "ChangedName"}},
-		setupFunc:           setupDummyUser,
-		expectedStatusCode:  http.StatusOK,
-		httpHandlerFunc:     updateUser,
-		responseHandlerFunc: testUserUpdateResponse,
+		name:               "List_WhenPassingUnknownParameter_ReturnError",
+		method:             "GET",
+		url:                "/users/v1/list?age=20",
+		urlVars:            nil,
+		request:            nil,
+		expectedStatusCode: http.StatusBadRequest,
+		expectedErrorCode:  ErrorCodeInvalidParameter,
+		httpHandlerFunc:    (*Service).getUserList,
 	},
 
-	// Delete
 	{
-		name:   "Delete_WhenPasingNotExistingUser_ReturnError",
-		method: "DELETE",
-		url:    "/users/v1/DummyId",
-		urlVars: map[string]string{
-			"id": "DummyId",
-		},
+		name:               "List_WhenPassingNamePrefixWithoutNameSort_ReturnError",
+		method:             "GET",
+		url:                "/users/v1/list?namePrefix=Al",
+		urlVars:            nil,
 		request:            nil,
-		expectedStatusCode: http.StatusInternalServerError,
-		httpHandlerFunc:    deleteUser,
+		expectedStatusCode: http.StatusBadRequest,
+		expectedErrorCode:  ErrorCodeInvalidParameter,
+		httpHandlerFunc:    (*Service).getUserList,
 	},
 
 	{
-		name:   "Delete_WhenPasingExistingUser_ReturnNonError",
-		method: "DELETE",
-		url:    "/users/v1/DummyId",
-		urlVars: map[string]string{
-			"id": "DummyId",
-		},
+		name:               "List_WhenPassingInvalidLimit_ReturnError",
+		method:             "GET",
+		url:                "/users/v1/list?limit=0",
+		urlVars:            nil,
 		request:            nil,
-		setupFunc:          setupDummyUser,
-		expectedStatusCode: http.StatusOK,
-		httpHandlerFunc:    deleteUser,
+		expectedStatusCode: http.StatusBadRequest,
+		expectedErrorCode:  ErrorCodeInvalidParameter,
+		httpHandlerFunc:    (*Service).getUserList,
 	},
+}
 
-	// List
-	{
-		name:                "List_ReturnUserList",
-		method:              "GET",
-		url:                 "/users/v1/list",
-		urlVars:             nil,
-		request:             nil,
-		setupFunc:           setupDummyUserListWithApiTestCase,
-		expectedStatusCode:  http.StatusOK,
-		httpHandlerFunc:     getUserList,
-		responseHandlerFunc: testUserListResponse,
-	},
+func setupDummyUser(ctx context.Context, t *testing.T, repository BatchUserRepository, testCase apiTest) {
+	user := newDummyUser()
+	user.Id = testCase.urlVars["id"]
+	user.Version = 1
+	createDummyUser(ctx, t, repository, user)
+}
+
+// setupDummyUserWithoutRevision creates a user as stored before revisions
+// were kept.
+func setupDummyUserWithoutRevision(ctx context.Context, t *testing.T, repository BatchUserRepository, testCase apiTest) {
+	setupDummyUser(ctx, t, repository, testCase)
+
+	id := testCase.urlVars["id"]
+	switch repository := repository.(type) {
+	case *memoryRepository:
+		delete(repository.revisions, id)
+	case *datastoreRepository:
+		if err := deleteRevisions(ctx, newKey(ctx, id)); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+	}
+}
+
+// setupDeletedDummyUser creates a user soft deleted longer ago than the
+// default retention.
+func setupDeletedDummyUser(ctx context.Context, t *testing.T, repository BatchUserRepository, testCase apiTest) {
+	user := newDummyUser()
+	user.Id = testCase.urlVars["id"]
+	user.Version = 2
+	user.DeletedAt = time.Now().Add(-defaultRetention - time.Hour)
+	createDummyUser(ctx, t, repository, user)
 }
 
-func setupDummyUser(ctx context.Context, t *testing.T, testCase apiTest) {
+// setupUpdatedDummyUser creates a user through Create and renames it, so
+// that it has two revisions.
+func setupUpdatedDummyUser(ctx context.Context, t *testing.T, repository BatchUserRepository, testCase apiTest) {
 	user := newDummyUser()
 	user.Id = testCase.urlVars["id"]
-	createDummyUser(ctx, t, user)
+	if err := repository.Create(ctx, user); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	user.Name = "Renamed"
+	if err := repository.Update(ctx, user); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+}
+
+func setupDummyUserListWithApiTestCase(ctx context.Context, t *testing.T, repository BatchUserRepository, testCase apiTest) {
+	setupDummyUserList(ctx, t, repository)
 }
 
-func setupDummyUserListWithApiTestCase(ctx context.Context, t *testing.T, testCase apiTest) {
-	setupDummyUserList(ctx, t)
+func setupNamedUsers(ctx context.Context, t *testing.T, repository BatchUserRepository, testCase apiTest) {
+	var userList []*User
+	for _, name := range []string{"Alice", "Bob", "Alan"} {
+		user := newDummyUser()
+		user.Name = name
+		userList = append(userList, user)
+	}
+	createDummyUsers(ctx, t, repository, userList)
 }
 
 func TestUsersApiHandler(t *testing.T) {
 
 	inst, err := aetest.NewInstance(nil)
 	if err != nil {
-		t.Fatalf("err:%v", err)
+		t.Skipf("aetest is not available	err:%v", err)
 	}
 	defer inst.Close()
 
@@ -174,14 +1064,36 @@ func TestUsersApiHandler(t *testing.T) {
 		t.Fatalf("err:%v", err)
 	}
 	ctx := appengine.NewContext(req)
+	repository := newRepository()
+
+	for _, tt := range apiTests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetDatastore(ctx, t, repository)
+			if tt.setupFunc != nil {
+				tt.setupFunc(ctx, t, repository, tt)
+			}
+			body := encodeRequestBody(tt.request)
+			t.Logf("inst.NewRequest	method:%v	url:%v	urlVars:%v	body:%v", tt.method, tt.url, tt.urlVars, body)
+			req, err := inst.NewRequest(tt.method, tt.url, body)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			testApi(t, NewService(repository, WithActorFunc(IAPActor), WithAdmins(testAdmin)), req, tt)
+		})
+	}
+}
+
+func TestUsersApiHandlerWithMemoryRepository(t *testing.T) {
+	ctx := context.Background()
 
 	for _, tt := range apiTests {
 		t.Run(tt.name, func(t *testing.T) {
-			resetDatastore(ctx, t)
+			repository := newMemoryRepository()
 			if tt.setupFunc != nil {
-				tt.setupFunc(ctx, t, tt)
+				tt.setupFunc(ctx, t, repository, tt)
 			}
-			testApi(t, inst, tt)
+			req := httptest.NewRequest(tt.method, tt.url, encodeRequestBody(tt.request))
+			testApi(t, NewService(repository, WithActorFunc(IAPActor), WithAdmins(testAdmin)), req, tt)
 		})
 	}
 }
@@ -199,6 +1111,15 @@ func testUserCreateResponse(t *testing.T, rr *httptest.ResponseRecorder, apiTest
 	}
 }
 
+func testInvalidUserNameResponse(t *testing.T, rr *httptest.ResponseRecorder, apiTest apiTest) {
+	var response problemResponse
+	decodeResponseBody(rr.Body.Bytes(), &response)
+
+	if len(response.Errors) != 1 || response.Errors[0].Field != "name" || response.Errors[0].Code != "TOO_LONG" {
+		t.Errorf("Problem should report the name field	response:%#v", response)
+	}
+}
+
 func testUserFindResponse(t *testing.T, rr *httptest.ResponseRecorder, apiTest apiTest) {
 	var response userFindResponse
 	decodeResponseBody(rr.Body.Bytes(), &response)
@@ -207,6 +1128,27 @@ func testUserFindResponse(t *testing.T, rr *httptest.ResponseRecorder, apiTest a
 	if response.User.Id != expectedId {
 		t.Errorf("FoundUserId should be the same with expectedId	expectedId:%v	foundUser:%v", expectedId, response.User)
 	}
+
+	if etag := rr.Header().Get("ETag"); etag != response.User.etag() {
+		t.Errorf("ETag should be the user version	etag:%v	foundUser:%v", etag, response.User)
+	}
+}
+
+func testUserPutCreateResponse(t *testing.T, rr *httptest.ResponseRecorder, apiTest apiTest) {
+	req := (apiTest.request).(userUpdateRequest)
+	var response userCreateResponse
+	decodeResponseBody(rr.Body.Bytes(), &response)
+
+	if response.User == nil || response.User.Id != apiTest.urlVars["id"] || response.User.Name != req.User.Name || response.User.Version != 1 {
+		t.Errorf("User should be created with the id	response:%v", response)
+		return
+	}
+	if etag := rr.Header().Get("ETag"); etag != response.User.etag() {
+		t.Errorf("ETag should be the user version	etag:%v	user:%v", etag, response.User)
+	}
+	if location := rr.Header().Get("Location"); location != apiTest.url {
+		t.Errorf("Location should be the user	location:%v", location)
+	}
 }
 
 func testUserUpdateResponse(t *testing.T, rr *httptest.ResponseRecorder, apiTest apiTest) {
@@ -217,6 +1159,172 @@ func testUserUpdateResponse(t *testing.T, rr *httptest.ResponseRecorder, apiTest
 	if response.User.Name != req.User.Name {
 		t.Errorf("User should have the name	response:%v", response)
 	}
+
+	if etag := rr.Header().Get("ETag"); etag != `"2"` || response.User.Version != 2 {
+		t.Errorf("Updated user should have the next version	etag:%v	response:%v", etag, response)
+	}
+}
+
+func testUserPatchResponse(t *testing.T, rr *httptest.ResponseRecorder, apiTest apiTest) {
+	req := (apiTest.request).(map[string]interface{})
+	var response userUpdateResponse
+	decodeResponseBody(rr.Body.Bytes(), &response)
+
+	if response.User.Name != req["name"] || response.User.Id != apiTest.urlVars["id"] {
+		t.Errorf("User should have the patched name	response:%v", response)
+	}
+
+	if etag := rr.Header().Get("ETag"); etag != `"2"` || response.User.Version != 2 {
+		t.Errorf("Patched user should have the next version	etag:%v	response:%v", etag, response)
+	}
+}
+
+func testPatchFailedResponse(t *testing.T, rr *httptest.ResponseRecorder, apiTest apiTest) {
+	var response problemResponse
+	decodeResponseBody(rr.Body.Bytes(), &response)
+
+	if response.Operation == nil || *response.Operation != 1 {
+		t.Errorf("Problem should report the failing operation	response:%#v", response)
+	}
+}
+
+func testUserDeleteResponse(t *testing.T, rr *httptest.ResponseRecorder, apiTest apiTest) {
+	var response userDeleteResponse
+	decodeResponseBody(rr.Body.Bytes(), &response)
+
+	expectedId := apiTest.urlVars["id"]
+	if response.User == nil || response.User.Id != expectedId {
+		t.Errorf("DeletedUserId should be the same with expectedId	expectedId:%v	response:%v", expectedId, response)
+	}
+
+	if response.User != nil && !response.User.isDeleted() {
+		t.Errorf("Deleted user should have deletedAt	response:%v", response)
+	}
+}
+
+func testUserRestoreResponse(t *testing.T, rr *httptest.ResponseRecorder, apiTest apiTest) {
+	var response userRestoreResponse
+	decodeResponseBody(rr.Body.Bytes(), &response)
+
+	if response.User == nil || response.User.Id != apiTest.urlVars["id"] || response.User.isDeleted() {
+		t.Errorf("Restored user should not be deleted	response:%v", response)
+	}
+
+	if etag := rr.Header().Get("ETag"); response.User == nil || etag != response.User.etag() {
+		t.Errorf("ETag should be the user version	etag:%v	response:%v", etag, response)
+	}
+}
+
+func testUserPurgeResponse(t *testing.T, rr *httptest.ResponseRecorder, apiTest apiTest) {
+	var response userPurgeResponse
+	decodeResponseBody(rr.Body.Bytes(), &response)
+
+	if response.Purged != 1 {
+		t.Errorf("Deleted user should be purged	response:%v", response)
+	}
+}
+
+func testUserRevisionListResponse(t *testing.T, rr *httptest.ResponseRecorder, apiTest apiTest) {
+	var response userRevisionListResponse
+	decodeResponseBody(rr.Body.Bytes(), &response)
+
+	if len(response.Revisions) != 2 || response.Revisions[0].Action != RevisionActionCreate || response.Revisions[1].User.Name != "Renamed" || response.NextCursor != "" {
+		t.Errorf("Revisions should be the creation and the rename	response:%+v", response)
+	}
+}
+
+func testUserRevisionListPageResponse(t *testing.T, rr *httptest.ResponseRecorder, apiTest apiTest) {
+	var response userRevisionListResponse
+	decodeResponseBody(rr.Body.Bytes(), &response)
+
+	if len(response.Revisions) != 1 || response.Revisions[0].Version != 1 || response.NextCursor == "" {
+		t.Errorf("Revisions should have the first revision and a next cursor	response:%+v", response)
+	}
+
+	if link := rr.Header().Get("Link"); !strings.Contains(link, "cursor="+response.NextCursor) || !strings.Contains(link, `rel="next"`) {
+		t.Errorf("Link header should point to the next page	link:%v", link)
+	}
+}
+
+func testEmptyUserRevisionListResponse(t *testing.T, rr *httptest.ResponseRecorder, apiTest apiTest) {
+	if body := strings.TrimSpace(rr.Body.String()); body != `{"revisions":[]}` {
+		t.Errorf("Revisions should be an empty list	body:%v", body)
+	}
+}
+
+func testUserRevisionFindResponse(t *testing.T, rr *httptest.ResponseRecorder, apiTest apiTest) {
+	var response userRevisionFindResponse
+	decodeResponseBody(rr.Body.Bytes(), &response)
+
+	if response.Revision == nil || response.Revision.Version != 1 || response.Revision.User.Id != apiTest.urlVars["id"] || response.Revision.User.Name == "Renamed" {
+		t.Errorf("Revision should hold the created user	response:%+v", response)
+	}
+}
+
+func testUserRevertResponse(t *testing.T, rr *httptest.ResponseRecorder, apiTest apiTest) {
+	var response userRevertResponse
+	decodeResponseBody(rr.Body.Bytes(), &response)
+
+	if response.User == nil || response.User.Id != apiTest.urlVars["id"] || response.User.Name == "Renamed" || response.User.Version != 3 {
+		t.Errorf("Reverted user should have the name of revision 1 and a new version	response:%v", response)
+	}
+
+	if etag := rr.Header().Get("ETag"); response.User == nil || etag != response.User.etag() {
+		t.Errorf("ETag should be the user version	etag:%v	response:%v", etag, response)
+	}
+}
+
+func testUserBatchCreateResponse(t *testing.T, rr *httptest.ResponseRecorder, apiTest apiTest) {
+	var response userBatchResponse
+	decodeResponseBody(rr.Body.Bytes(), &response)
+
+	if len(response.Results) != 2 {
+		t.Fatalf("Every user should have a result	response:%v", response)
+	}
+	if result := response.Results[0]; result.User == nil || result.User.Id == "" || result.Id != result.User.Id || result.User.Name != "Alice" {
+		t.Errorf("Valid user should be created	result:%+v", result)
+	}
+	if result := response.Results[1]; result.Error == nil || result.Error.Code != ErrorCodeInvalidUser || result.Error.Status != http.StatusUnprocessableEntity {
+		t.Errorf("Invalid user should have an error	result:%+v", result)
+	}
+}
+
+// testUserBatchResponse checks the results of DummyId, MissingId and an
+// empty id.
+func testUserBatchResponse(t *testing.T, rr *httptest.ResponseRecorder, apiTest apiTest) {
+	var response userBatchResponse
+	decodeResponseBody(rr.Body.Bytes(), &response)
+
+	if len(response.Results) != 3 {
+		t.Fatalf("Every id should have a result	response:%v", response)
+	}
+	if result := response.Results[0]; result.User == nil || result.User.Id != "DummyId" || result.Error != nil {
+		t.Errorf("Existing user should be returned	result:%+v", result)
+	}
+	if result := response.Results[1]; result.Id != "MissingId" || result.Error == nil || result.Error.Code != ErrorCodeUserNotFound {
+		t.Errorf("Missing user should have an error	result:%+v", result)
+	}
+	if result := response.Results[2]; result.Error == nil || result.Error.Code != ErrorCodeInvalidUser {
+		t.Errorf("Empty id should have an error	result:%+v", result)
+	}
+}
+
+func testUserBatchNotFoundResponse(t *testing.T, rr *httptest.ResponseRecorder, apiTest apiTest) {
+	var response userBatchResponse
+	decodeResponseBody(rr.Body.Bytes(), &response)
+
+	if len(response.Results) != 1 || response.Results[0].Error == nil || response.Results[0].Error.Status != http.StatusNotFound {
+		t.Errorf("Deleted user should not be found	response:%v", response)
+	}
+}
+
+func testEmptyUserListResponse(t *testing.T, rr *httptest.ResponseRecorder, apiTest apiTest) {
+	var response userListResponse
+	decodeResponseBody(rr.Body.Bytes(), &response)
+
+	if len(response.Users) != 0 {
+		t.Errorf("UserList should be empty	response:%v", response)
+	}
 }
 
 func testUserListResponse(t *testing.T, rr *httptest.ResponseRecorder, apiTest apiTest) {
@@ -228,25 +1336,141 @@ func testUserListResponse(t *testing.T, rr *httptest.ResponseRecorder, apiTest a
 	}
 }
 
-func testApi(t *testing.T, inst aetest.Instance, apiTest apiTest) {
-	body := encodeRequestBody(apiTest.request)
+func testUserListPageResponse(t *testing.T, rr *httptest.ResponseRecorder, apiTest apiTest) {
+	var response userListResponse
+	decodeResponseBody(rr.Body.Bytes(), &response)
 
-	t.Logf("inst.NewRequest	method:%v	url:%v	urlVars:%v	body:%v", apiTest.method, apiTest.url, apiTest.urlVars, body)
-	req, err := inst.NewRequest(apiTest.method, apiTest.url, body)
-	if err != nil {
-		t.Errorf("err:%v", err)
+	if len(response.Users) != 5 || response.NextCursor == "" {
+		t.Errorf("UserList should have 5 users and a next cursor	response:%v", response)
+	}
+
+	if link := rr.Header().Get("Link"); !strings.Contains(link, "cursor="+response.NextCursor) || !strings.Contains(link, `rel="next"`) {
+		t.Errorf("Link header should point to the next page	link:%v", link)
+	}
+}
+
+func testUserListFilteredResponse(t *testing.T, rr *httptest.ResponseRecorder, apiTest apiTest) {
+	var response userListResponse
+	decodeResponseBody(rr.Body.Bytes(), &response)
+
+	if len(response.Users) != 2 || response.Users[0].Name != "Alice" || response.Users[1].Name != "Alan" {
+		t.Errorf("UserList should have the matching users sorted by -name	response:%v", response)
 	}
+}
+
+func testApi(t *testing.T, s *Service, req *http.Request, apiTest apiTest) {
 	req = mux.SetURLVars(req, apiTest.urlVars)
+	for k, v := range apiTest.headers {
+		req.Header.Set(k, v)
+	}
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(apiTest.httpHandlerFunc)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiTest.httpHandlerFunc(s, w, r)
+	})
 	handler.ServeHTTP(rr, req)
 
 	if status := rr.Code; status != apiTest.expectedStatusCode {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, apiTest.expectedStatusCode)
 	}
 
+	if apiTest.expectedErrorCode != "" {
+		testProblemResponse(t, rr, apiTest)
+	}
+
 	if apiTest.responseHandlerFunc != nil {
 		apiTest.responseHandlerFunc(t, rr, apiTest)
 	}
 }
+
+func testProblemResponse(t *testing.T, rr *httptest.ResponseRecorder, apiTest apiTest) {
+	if contentType := rr.Header().Get("Content-Type"); contentType != contentTypeProblemJson {
+		t.Errorf("handler returned wrong content type: got %v want %v", contentType, contentTypeProblemJson)
+	}
+
+	var response problemResponse
+	decodeResponseBody(rr.Body.Bytes(), &response)
+	if response.Code != apiTest.expectedErrorCode || response.Status != apiTest.expectedStatusCode {
+		t.Errorf("Problem should have the expected code and status	expectedErrorCode:%v	response:%#v", apiTest.expectedErrorCode, response)
+	}
+}
+
+func TestContentTypeMiddleware(t *testing.T) {
+	r := mux.NewRouter()
+	RegisterService(r, NewService(NewMemoryRepository()))
+
+	tests := []struct {
+		url                 string
+		expectedContentType string
+	}{
+		{url: "/v1/users", expectedContentType: "application/json"},
+		{url: "/v1/users/DummyId", expectedContentType: contentTypeProblemJson},
+	}
+
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("GET", tt.url, nil))
+		if contentType := rr.Header().Get("Content-Type"); contentType != tt.expectedContentType {
+			t.Errorf("wrong content type	url:%v	got:%v	want:%v", tt.url, contentType, tt.expectedContentType)
+		}
+	}
+}
+
+func TestAcceptContentType(t *testing.T) {
+	r := mux.NewRouter()
+	RegisterService(r, NewService(NewMemoryRepository(), WithContextFunc(func(r *http.Request) context.Context {
+		return r.Context()
+	}), WithAdmins(testAdmin), WithActorFunc(func(r *http.Request) string {
+		return testAdmin
+	})))
+
+	tests := []struct {
+		name               string
+		method             string
+		url                string
+		contentType        string
+		body               string
+		expectedStatusCode int
+	}{
+		{name: "WhenPostingWithoutBody_SkipTheCheck", method: "POST", url: "/v1/users:purge", expectedStatusCode: http.StatusOK},
+		{name: "WhenRestoringWithoutBody_RouteToRestore", method: "POST", url: "/v1/users/DummyId:restore", expectedStatusCode: http.StatusNotFound},
+		{name: "WhenPostingTextBody_ReturnError", method: "POST", url: "/v1/users", contentType: "text/plain", body: "name", expectedStatusCode: http.StatusUnsupportedMediaType},
+		{name: "WhenPostingJsonBody_ServeTheRequest", method: "POST", url: "/v1/users", contentType: "application/json", body: `{"user":{"name":"Alice"}}`, expectedStatusCode: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+			if rr.Code != tt.expectedStatusCode {
+				t.Errorf("wrong status code	got:%v	want:%v", rr.Code, tt.expectedStatusCode)
+			}
+		})
+	}
+}
+
+func TestNewService_WhenAdminsHaveNoActorFunc_Panic(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("NewService must refuse admins which can't be identified")
+		}
+	}()
+	NewService(NewMemoryRepository(), WithAdmins(testAdmin))
+}
+
+func TestNewService_WhenNoActorFuncIsSet_IgnoreTheIAPHeader(t *testing.T) {
+	s := NewService(NewMemoryRepository(), WithContextFunc(func(r *http.Request) context.Context {
+		return r.Context()
+	}))
+	req := httptest.NewRequest("GET", "/v1/users", nil)
+	for key, value := range adminHeaders {
+		req.Header.Set(key, value)
+	}
+	if actor := ActorFromContext(s.newContext(req)); actor != "" {
+		t.Errorf("Client supplied headers must not be trusted by default	actor:%v", actor)
+	}
+}
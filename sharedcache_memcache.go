@@ -0,0 +1,40 @@
+package usrsvc
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/appengine/memcache"
+)
+
+type appEngineMemcache struct{}
+
+// NewAppEngineMemcache returns a SharedCache backed by App Engine memcache.
+// It needs the context of an App Engine request.
+func NewAppEngineMemcache() SharedCache {
+	return appEngineMemcache{}
+}
+
+func (appEngineMemcache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	item, err := memcache.Get(ctx, key)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return item.Value, true, nil
+}
+
+func (appEngineMemcache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return memcache.Set(ctx, &memcache.Item{Key: key, Value: value, Expiration: ttl})
+}
+
+func (appEngineMemcache) Add(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	err := memcache.Add(ctx, &memcache.Item{Key: key, Value: value, Expiration: ttl})
+	if errors.Is(err, memcache.ErrNotStored) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,201 @@
+package usrsvc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultRetention is how long soft deleted users are kept before
+// PurgeDeletedUsers removes them.
+const defaultRetention = 30 * 24 * time.Hour
+
+// isDeleted reports whether u is soft deleted.
+func (u *User) isDeleted() bool {
+	return !u.DeletedAt.IsZero()
+}
+
+// WithRetention sets how long soft deleted users are kept before
+// POST /v1/users:purge removes them.
+func WithRetention(retention time.Duration) ServiceOption {
+	return func(s *Service) {
+		s.retention = retention
+	}
+}
+
+// WithAdmins sets the actors allowed to list, restore and purge soft
+// deleted users. By default nobody is.
+func WithAdmins(actors ...string) ServiceOption {
+	return func(s *Service) {
+		s.admins = map[string]bool{}
+		for _, actor := range actors {
+			if actor = strings.TrimSpace(actor); actor != "" {
+				s.admins[actor] = true
+			}
+		}
+	}
+}
+
+// requireAdmin fails with ErrForbidden unless the actor of ctx is an admin.
+func (s *Service) requireAdmin(ctx context.Context) error {
+	actor := ActorFromContext(ctx)
+	if !s.admins[actor] {
+		return fmt.Errorf("%w: actor is not an admin	actor:%s", ErrForbidden, actor)
+	}
+	return nil
+}
+
+// sortDeletedUsers sorts users like ListDeleted, by DeletedAt then Id.
+func sortDeletedUsers(users []*User) {
+	sort.Slice(users, func(i, j int) bool {
+		if c := compareTime(users[i].DeletedAt, users[j].DeletedAt); c != 0 {
+			return c < 0
+		}
+		return users[i].Id < users[j].Id
+	})
+}
+
+// findActiveUser finds the user with id, treating soft deleted users as not
+// found.
+func (s *Service) findActiveUser(ctx context.Context, id string) (*User, error) {
+	user, err := s.repository.Find(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if user.isDeleted() {
+		return nil, fmt.Errorf("user is deleted	id:%s	err: %w", id, ErrNotFound)
+	}
+	return user, nil
+}
+
+// includeDeleted parses the includeDeleted query parameter of r.
+func includeDeleted(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("includeDeleted")
+	if v == "" {
+		return false, nil
+	}
+	include, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, errors.New("includeDeleted must be a boolean")
+	}
+	return include, nil
+}
+
+// restore
+type userRestoreResponse struct {
+	User *User `json:"user"`
+}
+
+// purge
+type userPurgeResponse struct {
+	Purged int `json:"purged"`
+}
+
+func (s *Service) restoreUser(w http.ResponseWriter, r *http.Request) {
+	ctx := s.newContext(r)
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	// Restoring needs the same rights as seeing deleted users.
+	if err := s.requireAdmin(ctx); err != nil {
+		writeErrorResponse(w, r, err, "Only admins can restore users")
+		return
+	}
+
+	user, err := s.repository.Find(withFreshRead(ctx), id)
+	if err != nil {
+		log.Printf("FindUser	err:%v", err)
+		writeErrorResponse(w, r, err, "Can not find user")
+		return
+	}
+
+	if !matchIfMatch(r, user) {
+		writeErrorResponse(w, r, ErrVersionMismatch, "If-Match does not match the user version")
+		return
+	}
+
+	// Restoring a user which is not deleted is a no-op.
+	if user.isDeleted() {
+		user.DeletedAt = time.Time{}
+		err = s.repository.Update(ctx, user)
+		if err != nil {
+			log.Printf("RestoreUser	err:%v", err)
+			writeErrorResponse(w, r, err, "Can not restore user")
+			return
+		}
+	}
+
+	writeETag(w, user)
+	res := userRestoreResponse{
+		User: user,
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func (s *Service) purgeUsers(w http.ResponseWriter, r *http.Request) {
+	ctx := s.newContext(r)
+
+	if err := s.requireAdmin(ctx); err != nil {
+		writeErrorResponse(w, r, err, "Only admins can purge users")
+		return
+	}
+
+	purged, err := PurgeDeletedUsers(ctx, s.repository, time.Now().Add(-s.retention))
+	if err != nil {
+		log.Printf("PurgeUsers	purged:%d	err:%v", purged, err)
+		writeErrorResponse(w, r, err, "Can not purge users")
+		return
+	}
+
+	res := userPurgeResponse{
+		Purged: purged,
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// purgePageSize is how many users PurgeDeletedUsers deletes at a time.
+const purgePageSize = maxListLimit
+
+// PurgeDeletedUsers permanently deletes the users of repository which were
+// soft deleted before deletedBefore, and returns how many it deleted.
+// Users restored or changed meanwhile are kept.
+func PurgeDeletedUsers(ctx context.Context, repository IUserRepository, deletedBefore time.Time) (int, error) {
+	purged := 0
+	for {
+		// Purged users leave the index, so every page starts from the
+		// oldest deletion.
+		expiredUsers, err := repository.ListDeleted(ctx, deletedBefore, purgePageSize)
+		if err != nil {
+			return purged, err
+		}
+
+		pagePurged := 0
+		for _, u := range expiredUsers {
+			_, err := repository.FindAndDelete(ctx, u.Id, u.Version)
+			if errors.Is(err, ErrNotFound) || errors.Is(err, ErrVersionMismatch) {
+				continue
+			}
+			if err != nil {
+				return purged, err
+			}
+			pagePurged++
+		}
+		purged += pagePurged
+
+		// A page of skipped users would be listed again, so it ends the
+		// purge as well.
+		if len(expiredUsers) < purgePageSize || pagePurged == 0 {
+			return purged, nil
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package usrsvc
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPurgeDeletedUsers_WhenUsersSpanSeveralPages_PurgeEveryExpiredUser(t *testing.T) {
+	ctx := context.Background()
+	repository := NewMemoryRepository()
+	now := time.Now()
+
+	expired := 2*purgePageSize + 30
+	var keptIds []string
+	for i := 0; i < expired+20; i++ {
+		user := createTestUser(ctx, t, repository)
+		switch {
+		case i < expired:
+			user.DeletedAt = now.Add(-time.Duration(i+2) * time.Hour)
+		case i < expired+10:
+			user.DeletedAt = now
+			keptIds = append(keptIds, user.Id)
+		default:
+			keptIds = append(keptIds, user.Id)
+			continue
+		}
+		if err := repository.Update(ctx, user); err != nil {
+			t.Fatalf("err:%v", err)
+		}
+	}
+
+	purged, err := PurgeDeletedUsers(ctx, repository, now.Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	if purged != expired {
+		t.Errorf("Every expired user should be purged	purged:%d	expired:%d", purged, expired)
+	}
+	for _, id := range keptIds {
+		if _, err := repository.Find(ctx, id); err != nil {
+			t.Errorf("Users deleted recently and active users must be kept	id:%s	err:%v", id, err)
+		}
+	}
+}
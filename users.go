@@ -2,25 +2,69 @@ package usrsvc
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxUserNameLength = 100
 )
 
 type User struct {
 	Id        string    `datastore:"-" json:"id" `
-	Name      string    `datastore:",noindex" json:"name"`
+	Name      string    `json:"name"`
 	CreatedAt time.Time `json:"createdAt"`
-	UpdatedAt time.Time `datastore:",noindex" json:"updatedAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// Version is incremented by every update. It is 0 for users stored
+	// before versioning and 1 after Create.
+	Version int64 `datastore:",noindex" json:"version"`
+	// DeletedAt is set when the user is soft deleted.
+	DeletedAt time.Time `json:"deletedAt,omitzero"`
 	// Key *datastore.Key `datastore:"__key__" json:"-"`
 }
 
+// FieldError describes why a single field of a User is invalid.
+type FieldError struct {
+	Field  string `json:"field"`
+	Code   string `json:"code"`
+	Detail string `json:"detail"`
+}
+
+// ValidationError is returned when a User fails validation.
+// It matches ErrInvalidUser with errors.Is.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	var details []string
+	for _, f := range e.Fields {
+		details = append(details, fmt.Sprintf("%s: %s", f.Field, f.Detail))
+	}
+	return fmt.Sprintf("%v: %s", ErrInvalidUser, strings.Join(details, ", "))
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalidUser
+}
+
 func (u *User) isValid() error {
+	var fields []FieldError
 	if u.Id == "" {
-		return fmt.Errorf("datastore: user id empty User: %v", u)
+		fields = append(fields, FieldError{Field: "id", Code: "REQUIRED", Detail: "user id is empty"})
 	}
 
 	if u.Name == "" {
-		return fmt.Errorf("datastore: user name empty User: %v", u)
+		fields = append(fields, FieldError{Field: "name", Code: "REQUIRED", Detail: "user name is empty"})
+	} else if utf8.RuneCountInString(u.Name) > maxUserNameLength {
+		fields = append(fields, FieldError{Field: "name", Code: "TOO_LONG", Detail: fmt.Sprintf("user name must be at most %d characters", maxUserNameLength)})
+	}
+
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
 	}
 	return nil
 }
@@ -32,7 +76,91 @@ type IUserRepository interface {
 
 	List(ctx context.Context) ([]*User, error)
 
+	ListWithOptions(ctx context.Context, opts ListOptions) (*UserPage, error)
+
+	// ListDeleted returns at most limit users soft deleted before
+	// deletedBefore, ordered by DeletedAt then Id. It reads an index of the
+	// deleted users instead of scanning every user.
+	ListDeleted(ctx context.Context, deletedBefore time.Time, limit int) ([]*User, error)
+
 	Delete(ctx context.Context, id string) error
 
+	// FindAndDelete deletes the user atomically and returns it. When version
+	// is not 0 it must match the stored version, otherwise ErrVersionMismatch
+	// is returned and the user is kept.
+	FindAndDelete(ctx context.Context, id string, version int64) (*User, error)
+
+	// Update overwrites an existing user. When user.Version is not 0 it must
+	// match the stored version, otherwise ErrVersionMismatch is returned.
+	// On success user.Version is incremented.
 	Update(ctx context.Context, user *User) error
 }
+
+// BatchUserRepository is implemented by repositories which also read and
+// write users in batches. CreateMulti stores users as they are, along with
+// their create revision.
+type BatchUserRepository interface {
+	IUserRepository
+
+	// CreateMulti returns one result per user, in the order of userList. A
+	// user whose id is taken, even by a soft deleted user, is not stored and
+	// only sets the Err of its result to ErrConflict.
+	CreateMulti(ctx context.Context, userList []*User) ([]*UserResult, error)
+
+	// FindMulti returns one result per id, in the order of ids. A missing
+	// user only sets the Err of its result to ErrNotFound, so the error is
+	// returned when the lookup fails as a whole.
+	FindMulti(ctx context.Context, ids []string) ([]*UserResult, error)
+
+	// DeleteMulti returns one result per user, in the order of userList,
+	// holding the deleted user or the error of deleting it. Deleting a
+	// missing user is not an error.
+	DeleteMulti(ctx context.Context, userList []*User) ([]*UserResult, error)
+
+	// UpdateMulti updates every user of userList like Update, in as few
+	// transactions as the store allows, and returns one result per user in
+	// the order of userList holding the updated user. A missing user or a
+	// version mismatch only sets the Err of its result. Ids must be unique.
+	UpdateMulti(ctx context.Context, userList []*User) ([]*UserResult, error)
+}
+
+// UserResult pairs a requested id with its user, or with the error of that
+// id alone.
+type UserResult struct {
+	Id   string
+	User *User
+	Err  error
+}
+
+// validateUpdateList checks that the users of UpdateMulti have unique ids.
+func validateUpdateList(userList []*User) error {
+	if len(userList) == 0 {
+		return fmt.Errorf("%w: userList can not be empty", ErrInvalidUser)
+	}
+	ids := make(map[string]bool, len(userList))
+	for _, u := range userList {
+		if u.Id == "" {
+			return fmt.Errorf("%w: user id empty User: %v", ErrInvalidUser, u)
+		}
+		if ids[u.Id] {
+			return fmt.Errorf("%w: user id is repeated	id:%s", ErrInvalidUser, u.Id)
+		}
+		ids[u.Id] = true
+	}
+	return nil
+}
+
+// isUserError reports whether err only concerns one user of a batch.
+func isUserError(err error) bool {
+	return errors.Is(err, ErrNotFound) || errors.Is(err, ErrVersionMismatch)
+}
+
+// deletedUserResults returns the results of deleting every user of userList
+// without error.
+func deletedUserResults(userList []*User) []*UserResult {
+	results := make([]*UserResult, len(userList))
+	for i, u := range userList {
+		results[i] = &UserResult{Id: u.Id, User: u}
+	}
+	return results
+}
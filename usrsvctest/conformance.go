@@ -0,0 +1,1249 @@
+// Package usrsvctest checks implementations of usrsvc.IUserRepository.
+package usrsvctest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	usrsvc "github.com/yusuke0913/app-engine-golang-user-crud-api"
+)
+
+// revisionUserRepository is implemented by repositories which keep the
+// revisions of users.
+type revisionUserRepository interface {
+	usrsvc.IUserRepository
+	usrsvc.RevisionRepository
+}
+
+type conformanceTest struct {
+	name string
+	f    func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository)
+}
+
+type multiConformanceTest struct {
+	name string
+	f    func(ctx context.Context, t *testing.T, repository usrsvc.BatchUserRepository)
+}
+
+type revisionConformanceTest struct {
+	name string
+	f    func(ctx context.Context, t *testing.T, repository revisionUserRepository)
+}
+
+// RunRepositoryConformance checks that an IUserRepository implementation
+// matches the contract of the datastore repository.
+// factory is called once per case and must return an empty repository.
+// Cases for CreateMulti/FindMulti/DeleteMulti and for revisions only run
+// when the repository implements them.
+func RunRepositoryConformance(t *testing.T, ctx context.Context, factory func() usrsvc.IUserRepository) {
+	for _, tt := range conformanceTests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.f(ctx, t, factory())
+		})
+	}
+
+	for _, tt := range multiConformanceTests {
+		t.Run(tt.name, func(t *testing.T) {
+			repository, ok := factory().(usrsvc.BatchUserRepository)
+			if !ok {
+				t.Skip("repository does not implement the Multi helpers")
+			}
+			tt.f(ctx, t, repository)
+		})
+	}
+
+	for _, tt := range revisionConformanceTests {
+		t.Run(tt.name, func(t *testing.T) {
+			repository, ok := factory().(revisionUserRepository)
+			if !ok {
+				t.Skip("repository does not keep revisions")
+			}
+			tt.f(ctx, t, repository)
+		})
+	}
+}
+
+var conformanceTests = []conformanceTest{
+
+	// Create
+	{
+		name: "Create_WhenPassingEmptyId_ReturnError",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			user := newConformanceUser()
+			user.Id = ""
+			if err := repository.Create(ctx, user); !errors.Is(err, usrsvc.ErrInvalidUser) {
+				t.Errorf("ErrInvalidUser must be thrown	err:%v", err)
+			}
+		},
+	},
+
+	{
+		name: "Create_WhenPassingEmptyName_ReturnError",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			user := newConformanceUser()
+			user.Name = ""
+			if err := repository.Create(ctx, user); !errors.Is(err, usrsvc.ErrInvalidUser) {
+				t.Errorf("ErrInvalidUser must be thrown	err:%v", err)
+			}
+		},
+	},
+
+	{
+		name: "Create_WhenPassingValidUser_SetTimestamps",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			user := newConformanceUser()
+			if err := repository.Create(ctx, user); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if user.CreatedAt.IsZero() || user.UpdatedAt.IsZero() {
+				t.Errorf("CreatedAt and UpdatedAt must be set	user:%v", user)
+			}
+			if user.Version != 1 {
+				t.Errorf("Version must start at 1	user:%v", user)
+			}
+		},
+	},
+
+	{
+		name: "Create_WhenPassingExistingId_ReturnConflict",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			user := createConformanceUser(ctx, t, repository)
+			duplicatedUser := newConformanceUser()
+			duplicatedUser.Id = user.Id
+			if err := repository.Create(ctx, duplicatedUser); !errors.Is(err, usrsvc.ErrConflict) {
+				t.Errorf("ErrConflict must be thrown	err:%v", err)
+			}
+
+			foundUser, err := repository.Find(ctx, user.Id)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if foundUser.Name != user.Name {
+				t.Errorf("Existing user must not be overwritten	user:%v	foundUser:%v", user, foundUser)
+			}
+		},
+	},
+
+	// Find
+	{
+		name: "Find_WhenPassingEmptyId_ReturnError",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			user, err := repository.Find(ctx, "")
+			if !errors.Is(err, usrsvc.ErrNotFound) {
+				t.Errorf("ErrNotFound must be thrown	err:%v", err)
+			}
+			if user != nil {
+				t.Errorf("User should be nil	user:%v", user)
+			}
+		},
+	},
+
+	{
+		name: "Find_WhenPassingNotExistingId_ReturnError",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			user, err := repository.Find(ctx, uuid.New().String())
+			if !errors.Is(err, usrsvc.ErrNotFound) {
+				t.Errorf("ErrNotFound must be thrown	err:%v", err)
+			}
+			if user != nil {
+				t.Errorf("User should be nil	user:%v", user)
+			}
+		},
+	},
+
+	{
+		name: "Find_WhenPassingExistingId_ReturnTheUser",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			user := createConformanceUser(ctx, t, repository)
+			foundUser, err := repository.Find(ctx, user.Id)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if foundUser.Id != user.Id || foundUser.Name != user.Name {
+				t.Errorf("Found user must be the same with created user	user:%v	foundUser:%v", user, foundUser)
+			}
+		},
+	},
+
+	// List
+	{
+		name: "List_WhenEmpty_ReturnEmptyList",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			users, err := repository.List(ctx)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if len(users) != 0 {
+				t.Errorf("User list should be empty	users:%v", users)
+			}
+		},
+	},
+
+	{
+		name: "List_ReturnNewestUsersFirst",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			for i := 0; i < 5; i++ {
+				createConformanceUser(ctx, t, repository)
+			}
+			users, err := repository.List(ctx)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if len(users) != 5 {
+				t.Fatalf("User list should have all users	len:%d", len(users))
+			}
+			for i := 1; i < len(users); i++ {
+				if users[i].CreatedAt.After(users[i-1].CreatedAt) {
+					t.Errorf("User list must be ordered by -CreatedAt	users:%v", users)
+				}
+				if users[i].Id == "" {
+					t.Errorf("Listed user must have an id	user:%v", users[i])
+				}
+			}
+		},
+	},
+
+	{
+		name: "List_ReturnAtMost20Users",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			for i := 0; i < 21; i++ {
+				createConformanceUser(ctx, t, repository)
+			}
+			users, err := repository.List(ctx)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if len(users) != 20 {
+				t.Errorf("User list should be limited to 20 users	len:%d", len(users))
+			}
+		},
+	},
+
+	{
+		name: "ListWithOptions_WhenPagingWithCursor_ReturnEveryUserOnce",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			for i := 0; i < 25; i++ {
+				createConformanceUser(ctx, t, repository)
+			}
+
+			seen := map[string]bool{}
+			opts := usrsvc.ListOptions{Limit: 10}
+			var pageSizes []int
+			for {
+				page, err := repository.ListWithOptions(ctx, opts)
+				if err != nil {
+					t.Fatalf("err:%v", err)
+				}
+				pageSizes = append(pageSizes, len(page.Users))
+				for _, u := range page.Users {
+					if seen[u.Id] {
+						t.Errorf("User must be listed only once	user:%v", u)
+					}
+					seen[u.Id] = true
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				opts.Cursor = page.NextCursor
+			}
+
+			if len(seen) != 25 {
+				t.Errorf("Every user must be listed	len:%d", len(seen))
+			}
+			if fmt.Sprint(pageSizes) != "[10 10 5]" {
+				t.Errorf("Pages must be filled up to the limit	pageSizes:%v", pageSizes)
+			}
+		},
+	},
+
+	{
+		name: "ListWithOptions_WhenPassingInvalidCursor_ReturnError",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			_, err := repository.ListWithOptions(ctx, usrsvc.ListOptions{Cursor: "invalid cursor"})
+			if !errors.Is(err, usrsvc.ErrInvalidCursor) {
+				t.Errorf("ErrInvalidCursor must be thrown	err:%v", err)
+			}
+		},
+	},
+
+	{
+		name: "ListWithOptions_WhenSortingById_ReturnUsersInIdOrder",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			for _, id := range []string{"b-user", "c-user", "a-user"} {
+				user := newConformanceUser()
+				user.Id = id
+				if err := repository.Create(ctx, user); err != nil {
+					t.Fatalf("err:%v", err)
+				}
+			}
+
+			tests := []struct {
+				sort     usrsvc.ListSort
+				expected string
+			}{
+				{sort: usrsvc.SortByIdAsc, expected: "[a-user b-user c-user]"},
+				{sort: usrsvc.SortByIdDesc, expected: "[c-user b-user a-user]"},
+			}
+			for _, tt := range tests {
+				var ids []string
+				opts := usrsvc.ListOptions{Limit: 2, Sort: tt.sort}
+				for {
+					page, err := repository.ListWithOptions(ctx, opts)
+					if err != nil {
+						t.Fatalf("err:%v", err)
+					}
+					for _, u := range page.Users {
+						ids = append(ids, u.Id)
+					}
+					if page.NextCursor == "" {
+						break
+					}
+					opts.Cursor = page.NextCursor
+				}
+				if fmt.Sprint(ids) != tt.expected {
+					t.Errorf("Users should be sorted by id	sort:%v	ids:%v", tt.sort, ids)
+				}
+			}
+		},
+	},
+
+	{
+		name: "ListWithOptions_WhenPassingNamePrefix_ReturnMatchingUsersByName",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			for _, name := range []string{"Bob", "Alice", "Alan", "Al"} {
+				user := newConformanceUser()
+				user.Name = name
+				if err := repository.Create(ctx, user); err != nil {
+					t.Fatalf("err:%v", err)
+				}
+			}
+
+			tests := []struct {
+				sort     usrsvc.ListSort
+				expected string
+			}{
+				{sort: usrsvc.SortByNameAsc, expected: "[Al Alan Alice]"},
+				{sort: usrsvc.SortByNameDesc, expected: "[Alice Alan Al]"},
+			}
+			for _, tt := range tests {
+				page, err := repository.ListWithOptions(ctx, usrsvc.ListOptions{NamePrefix: "Al", Sort: tt.sort})
+				if err != nil {
+					t.Fatalf("err:%v", err)
+				}
+				var names []string
+				for _, u := range page.Users {
+					names = append(names, u.Name)
+				}
+				if fmt.Sprint(names) != tt.expected {
+					t.Errorf("Users must be filtered and sorted by name	sort:%v	names:%v	expected:%v", tt.sort, names, tt.expected)
+				}
+			}
+		},
+	},
+
+	{
+		name: "ListWithOptions_WhenPassingCreatedAtRange_ReturnUsersInRange",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			var userList []*usrsvc.User
+			for i := 0; i < 3; i++ {
+				userList = append(userList, createConformanceUser(ctx, t, repository))
+				time.Sleep(time.Millisecond)
+			}
+
+			page, err := repository.ListWithOptions(ctx, usrsvc.ListOptions{
+				CreatedSince:  userList[1].CreatedAt.Truncate(time.Microsecond),
+				CreatedBefore: userList[2].CreatedAt.Truncate(time.Microsecond),
+				Sort:          usrsvc.SortByCreatedAtAsc,
+			})
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if len(page.Users) != 1 || page.Users[0].Id != userList[1].Id {
+				t.Errorf("Only the user created in range must be listed	users:%v	expected:%v", page.Users, userList[1])
+			}
+		},
+	},
+
+	{
+		name: "ListWithOptions_WhenUserIsSoftDeleted_HideItUnlessIncludingDeleted",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			var userList []*usrsvc.User
+			for i := 0; i < 3; i++ {
+				userList = append(userList, createConformanceUser(ctx, t, repository))
+				time.Sleep(time.Millisecond)
+			}
+			deletedUser := userList[1]
+			deletedUser.DeletedAt = time.Now()
+			if err := repository.Update(ctx, deletedUser); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+
+			foundUser, err := repository.Find(ctx, deletedUser.Id)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if foundUser.DeletedAt.IsZero() {
+				t.Errorf("DeletedAt must be stored	foundUser:%v", foundUser)
+			}
+
+			page, err := repository.ListWithOptions(ctx, usrsvc.ListOptions{Limit: 1})
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			var ids []string
+			for {
+				for _, u := range page.Users {
+					ids = append(ids, u.Id)
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				page, err = repository.ListWithOptions(ctx, usrsvc.ListOptions{Limit: 1, Cursor: page.NextCursor})
+				if err != nil {
+					t.Fatalf("err:%v", err)
+				}
+			}
+			if len(ids) != 2 || ids[0] != userList[2].Id || ids[1] != userList[0].Id {
+				t.Errorf("Soft deleted user must be skipped	ids:%v	deletedUser:%v", ids, deletedUser)
+			}
+
+			page, err = repository.ListWithOptions(ctx, usrsvc.ListOptions{IncludeDeleted: true})
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if len(page.Users) != 3 {
+				t.Errorf("Soft deleted user must be listed with IncludeDeleted	users:%v", page.Users)
+			}
+		},
+	},
+
+	{
+		name: "ListDeleted_ReturnUsersDeletedBeforeTheTimeOldestFirst",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			var userList []*usrsvc.User
+			for i := 0; i < 4; i++ {
+				userList = append(userList, createConformanceUser(ctx, t, repository))
+			}
+			now := time.Now().Truncate(time.Second)
+			for i, deletedAt := range []time.Time{now.Add(-2 * time.Hour), now, now.Add(-3 * time.Hour)} {
+				userList[i].DeletedAt = deletedAt
+				if err := repository.Update(ctx, userList[i]); err != nil {
+					t.Fatalf("err:%v", err)
+				}
+			}
+
+			deletedBefore := now.Add(-time.Hour)
+			deletedUsers, err := repository.ListDeleted(ctx, deletedBefore, 10)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if len(deletedUsers) != 2 || deletedUsers[0].Id != userList[2].Id || deletedUsers[1].Id != userList[0].Id {
+				t.Errorf("Users deleted before the time must be listed oldest first	deletedUsers:%v", deletedUsers)
+			}
+			if len(deletedUsers) > 0 && deletedUsers[0].Version != userList[2].Version {
+				t.Errorf("Listed users must hold their version	deletedUser:%v", deletedUsers[0])
+			}
+
+			deletedUsers, err = repository.ListDeleted(ctx, deletedBefore, 1)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if len(deletedUsers) != 1 || deletedUsers[0].Id != userList[2].Id {
+				t.Errorf("At most limit users must be listed	deletedUsers:%v", deletedUsers)
+			}
+
+			userList[2].DeletedAt = time.Time{}
+			if err := repository.Update(ctx, userList[2]); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			deletedUsers, err = repository.ListDeleted(ctx, deletedBefore, 10)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if len(deletedUsers) != 1 || deletedUsers[0].Id != userList[0].Id {
+				t.Errorf("Restored user must not be listed	deletedUsers:%v", deletedUsers)
+			}
+		},
+	},
+
+	{
+		name: "ListWithOptions_WhenPassingUnsupportedOptions_ReturnError",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			optsList := []usrsvc.ListOptions{
+				{Sort: "age"},
+				{NamePrefix: "Al"},
+				{UpdatedSince: time.Now(), Sort: usrsvc.SortByNameAsc},
+			}
+			for _, opts := range optsList {
+				if _, err := repository.ListWithOptions(ctx, opts); !errors.Is(err, usrsvc.ErrInvalidListOptions) {
+					t.Errorf("ErrInvalidListOptions must be thrown	opts:%v	err:%v", opts, err)
+				}
+			}
+		},
+	},
+
+	// Delete
+	{
+		name: "Delete_WhenPassingNonExistingUser_ReturnError",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			if err := repository.Delete(ctx, uuid.New().String()); !errors.Is(err, usrsvc.ErrNotFound) {
+				t.Errorf("ErrNotFound must be thrown	err:%v", err)
+			}
+		},
+	},
+
+	{
+		name: "Delete_WhenPassingExistingUser_ReturnNonError",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			user := createConformanceUser(ctx, t, repository)
+			if err := repository.Delete(ctx, user.Id); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if foundUser, err := repository.Find(ctx, user.Id); !errors.Is(err, usrsvc.ErrNotFound) {
+				t.Errorf("User should be not found	user:%v	err:%v", foundUser, err)
+			}
+		},
+	},
+
+	{
+		name: "FindAndDelete_WhenPassingCurrentVersion_ReturnDeletedUser",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			user := createConformanceUser(ctx, t, repository)
+			deletedUser, err := repository.FindAndDelete(ctx, user.Id, user.Version)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if deletedUser.Id != user.Id || deletedUser.Name != user.Name {
+				t.Errorf("Deleted user must be returned	user:%v	deletedUser:%v", user, deletedUser)
+			}
+			if foundUser, err := repository.Find(ctx, user.Id); !errors.Is(err, usrsvc.ErrNotFound) {
+				t.Errorf("User should be not found	user:%v	err:%v", foundUser, err)
+			}
+		},
+	},
+
+	{
+		name: "FindAndDelete_WhenPassingStaleVersion_KeepUser",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			user := createConformanceUser(ctx, t, repository)
+			if _, err := repository.FindAndDelete(ctx, user.Id, user.Version+1); !errors.Is(err, usrsvc.ErrVersionMismatch) {
+				t.Errorf("ErrVersionMismatch must be thrown	err:%v", err)
+			}
+			if _, err := repository.Find(ctx, user.Id); err != nil {
+				t.Errorf("User must be kept	err:%v", err)
+			}
+		},
+	},
+
+	{
+		name: "FindAndDelete_WhenPassingNonExistingUser_ReturnError",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			if _, err := repository.FindAndDelete(ctx, uuid.New().String(), 0); !errors.Is(err, usrsvc.ErrNotFound) {
+				t.Errorf("ErrNotFound must be thrown	err:%v", err)
+			}
+		},
+	},
+
+	// Update
+	{
+		name: "Update_WhenPassingEmptyId_ReturnError",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			user := newConformanceUser()
+			user.Id = ""
+			if err := repository.Update(ctx, user); !errors.Is(err, usrsvc.ErrInvalidUser) {
+				t.Errorf("ErrInvalidUser must be thrown	err:%v", err)
+			}
+		},
+	},
+
+	{
+		name: "Update_WhenPassingChangedNameUser_ReturnUpdatedUser",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			user := createConformanceUser(ctx, t, repository)
+			updatedUser := &usrsvc.User{
+				Id:        user.Id,
+				Name:      "ChangedName",
+				CreatedAt: user.CreatedAt,
+			}
+			if err := repository.Update(ctx, updatedUser); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if updatedUser.UpdatedAt.Before(user.UpdatedAt) {
+				t.Errorf("UpdatedAt must be refreshed	user:%v	updatedUser:%v", user, updatedUser)
+			}
+
+			foundUser, err := repository.Find(ctx, user.Id)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if foundUser.Name != updatedUser.Name {
+				t.Errorf("User name must be updated	updatedUser:%v	foundUser:%v", updatedUser, foundUser)
+			}
+		},
+	},
+
+	{
+		name: "Update_WhenPassingCurrentVersion_IncrementVersion",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			user := createConformanceUser(ctx, t, repository)
+			user.Name = "ChangedName"
+			if err := repository.Update(ctx, user); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if user.Version != 2 {
+				t.Errorf("Version must be incremented	user:%v", user)
+			}
+
+			foundUser, err := repository.Find(ctx, user.Id)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if foundUser.Version != 2 {
+				t.Errorf("Stored version must be incremented	foundUser:%v", foundUser)
+			}
+		},
+	},
+
+	{
+		name: "Update_WhenPassingStaleVersion_ReturnVersionMismatch",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			user := createConformanceUser(ctx, t, repository)
+			staleUser := *user
+			user.Name = "ChangedName"
+			if err := repository.Update(ctx, user); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+
+			staleUser.Name = "StaleName"
+			if err := repository.Update(ctx, &staleUser); !errors.Is(err, usrsvc.ErrVersionMismatch) {
+				t.Errorf("ErrVersionMismatch must be thrown	err:%v", err)
+			}
+
+			foundUser, err := repository.Find(ctx, user.Id)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if foundUser.Name != user.Name {
+				t.Errorf("Stale update must not be stored	foundUser:%v", foundUser)
+			}
+		},
+	},
+
+	{
+		name: "Update_WhenPassingNotExistingUser_ReturnError",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) {
+			if err := repository.Update(ctx, newConformanceUser()); !errors.Is(err, usrsvc.ErrNotFound) {
+				t.Errorf("ErrNotFound must be thrown	err:%v", err)
+			}
+		},
+	},
+}
+
+var multiConformanceTests = []multiConformanceTest{
+
+	// CreateMulti
+	{
+		name: "CreateMulti_WhenPassingEmptyList_ReturnError",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.BatchUserRepository) {
+			if _, err := repository.CreateMulti(ctx, nil); err == nil {
+				t.Errorf("Error must be thrown")
+			}
+		},
+	},
+
+	{
+		name: "CreateMulti_WhenPassingInvalidIds_ReturnError",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.BatchUserRepository) {
+			userList := newConformanceUserList()
+			for _, u := range userList {
+				u.Id = ""
+			}
+			if _, err := repository.CreateMulti(ctx, userList); err == nil {
+				t.Errorf("Error must be thrown")
+			}
+		},
+	},
+
+	{
+		name: "CreateMulti_WhenPassingValidUserList_ReturnNonError",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.BatchUserRepository) {
+			userList := newConformanceUserList()
+			results, err := repository.CreateMulti(ctx, userList)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			for i, result := range results {
+				if result.Err != nil || result.Id != userList[i].Id {
+					t.Errorf("User must be created	index:%d	result:%+v", i, result)
+				}
+			}
+			for _, u := range userList {
+				if _, err := repository.Find(ctx, u.Id); err != nil {
+					t.Errorf("err:%v", err)
+				}
+			}
+		},
+	},
+
+	{
+		name: "CreateMulti_WhenUsersHaveTheSameCreatedAt_ListThemInIdOrder",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.BatchUserRepository) {
+			now := time.Now().Truncate(time.Microsecond)
+			createdAt := map[string]time.Time{
+				"tie-b": now,
+				"older": now.Add(-time.Hour),
+				"tie-c": now,
+				"newer": now.Add(time.Hour),
+				"tie-a": now,
+			}
+			var userList []*usrsvc.User
+			for id, at := range createdAt {
+				user := newConformanceUser()
+				user.Id = id
+				user.CreatedAt = at
+				user.UpdatedAt = at
+				userList = append(userList, user)
+			}
+			if _, err := repository.CreateMulti(ctx, userList); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+
+			tests := []struct {
+				sort     usrsvc.ListSort
+				expected string
+			}{
+				{sort: usrsvc.SortByCreatedAtDesc, expected: "[newer tie-a tie-b tie-c older]"},
+				{sort: usrsvc.SortByCreatedAtAsc, expected: "[older tie-a tie-b tie-c newer]"},
+			}
+			for _, tt := range tests {
+				var ids []string
+				opts := usrsvc.ListOptions{Limit: 2, Sort: tt.sort}
+				for {
+					page, err := repository.ListWithOptions(ctx, opts)
+					if err != nil {
+						t.Fatalf("err:%v", err)
+					}
+					for _, u := range page.Users {
+						ids = append(ids, u.Id)
+					}
+					if page.NextCursor == "" {
+						break
+					}
+					opts.Cursor = page.NextCursor
+				}
+				if fmt.Sprint(ids) != tt.expected {
+					t.Errorf("Ties must be broken by id	sort:%v	ids:%v", tt.sort, ids)
+				}
+			}
+		},
+	},
+
+	{
+		name: "CreateMulti_WhenIdIsTaken_ReturnTheConflictOfThatUser",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.BatchUserRepository) {
+			user := createConformanceUser(ctx, t, repository)
+			deletedUser := createConformanceUser(ctx, t, repository)
+			deletedUser.DeletedAt = time.Now()
+			if err := repository.Update(ctx, deletedUser); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+
+			userList := newConformanceUserList()[:3]
+			userList[0].Id = user.Id
+			userList[2].Id = deletedUser.Id
+			results, err := repository.CreateMulti(ctx, userList)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if len(results) != len(userList) {
+				t.Fatalf("A result must be returned per user	results:%v", results)
+			}
+			for _, i := range []int{0, 2} {
+				if results[i].User != nil || !errors.Is(results[i].Err, usrsvc.ErrConflict) {
+					t.Errorf("ErrConflict must be set	index:%d	result:%+v", i, results[i])
+				}
+			}
+			if results[1].Err != nil {
+				t.Errorf("Free id must be created	result:%+v", results[1])
+			}
+
+			foundUser, err := repository.Find(ctx, user.Id)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if foundUser.Name != user.Name {
+				t.Errorf("Existing user must not be overwritten	user:%v	foundUser:%v", user, foundUser)
+			}
+			// The deleted user keeps its revisions, so it can still be updated.
+			deletedUser.DeletedAt = time.Time{}
+			if err := repository.Update(ctx, deletedUser); err != nil {
+				t.Errorf("Soft deleted user must not be overwritten	err:%v", err)
+			}
+		},
+	},
+
+	// FindMulti
+	{
+		name: "FindMulti_WhenPassingEmptyIds_ReturnError",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.BatchUserRepository) {
+			userList, err := repository.FindMulti(ctx, nil)
+			if err == nil {
+				t.Errorf("Error must be thrown")
+			}
+			if len(userList) > 0 {
+				t.Errorf("Found user list should be empty")
+			}
+		},
+	},
+
+	{
+		name: "FindMulti_WhenPassingInvalidIds_ReturnError",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.BatchUserRepository) {
+			userList, err := repository.FindMulti(ctx, []string{"", ""})
+			if !errors.Is(err, usrsvc.ErrInvalidUser) {
+				t.Errorf("ErrInvalidUser must be thrown	err:%v", err)
+			}
+			if len(userList) > 0 {
+				t.Errorf("Found user list should be empty")
+			}
+		},
+	},
+
+	{
+		name: "FindMulti_WhenPassingNotExistingId_ReturnTheErrorOfThatId",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.BatchUserRepository) {
+			user := createConformanceUser(ctx, t, repository)
+			missingId := uuid.New().String()
+			results, err := repository.FindMulti(ctx, []string{user.Id, missingId})
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if len(results) != 2 {
+				t.Fatalf("A result must be returned per id	results:%v", results)
+			}
+			if results[0].Id != user.Id || results[0].Err != nil || results[0].User == nil || results[0].User.Name != user.Name {
+				t.Errorf("Existing user must be found	result:%+v", results[0])
+			}
+			if results[1].Id != missingId || results[1].User != nil || !errors.Is(results[1].Err, usrsvc.ErrNotFound) {
+				t.Errorf("ErrNotFound must be set	result:%+v", results[1])
+			}
+		},
+	},
+
+	{
+		name: "FindMulti_WhenPassingValidIds_ReturnTheUserList",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.BatchUserRepository) {
+			userList := newConformanceUserList()
+			if _, err := repository.CreateMulti(ctx, userList); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			var ids []string
+			for _, u := range userList {
+				ids = append(ids, u.Id)
+			}
+			results, err := repository.FindMulti(ctx, ids)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if len(results) != len(userList) {
+				t.Fatalf("Results should have the same length	results:%v	userList:%v", results, userList)
+			}
+			for i, result := range results {
+				if result.Err != nil || result.User == nil || result.User.Id != userList[i].Id || result.User.Name != userList[i].Name {
+					t.Errorf("Found user must keep the requested order	index:%d	result:%+v	user:%v", i, result, userList[i])
+				}
+			}
+		},
+	},
+
+	// UpdateMulti
+	{
+		name: "UpdateMulti_WhenPassingRepeatedIds_ReturnError",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.BatchUserRepository) {
+			userList := newConformanceUserList()
+			if _, err := repository.CreateMulti(ctx, userList); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if _, err := repository.UpdateMulti(ctx, append(userList, userList[0])); !errors.Is(err, usrsvc.ErrInvalidUser) {
+				t.Errorf("ErrInvalidUser must be thrown	err:%v", err)
+			}
+		},
+	},
+
+	{
+		name: "UpdateMulti_WhenSomeUsersCanNotBeUpdated_ReturnTheirErrors",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.BatchUserRepository) {
+			userList := newConformanceUserList()
+			for _, u := range userList {
+				u.Version = 1
+			}
+			if _, err := repository.CreateMulti(ctx, userList); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			for _, u := range userList {
+				u.Name = "Updated"
+			}
+			userList[1].Version = 5
+			missingUser := newConformanceUser()
+			missingUser.Version = 1
+
+			results, err := repository.UpdateMulti(ctx, append(userList, missingUser))
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if len(results) != len(userList)+1 {
+				t.Fatalf("Results should have the same length	results:%v", results)
+			}
+			for i, result := range results {
+				switch {
+				case i == 1:
+					if !errors.Is(result.Err, usrsvc.ErrVersionMismatch) {
+						t.Errorf("Stale version must fail its user only	result:%+v", result)
+					}
+				case i == len(userList):
+					if !errors.Is(result.Err, usrsvc.ErrNotFound) {
+						t.Errorf("Missing user must fail its user only	result:%+v", result)
+					}
+				case result.Err != nil || result.User == nil || result.User.Id != userList[i].Id || result.User.Version != 2:
+					t.Errorf("Updated user must keep the requested order	index:%d	result:%+v", i, result)
+				}
+			}
+
+			for i, u := range userList {
+				foundUser, err := repository.Find(ctx, u.Id)
+				if err != nil {
+					t.Fatalf("err:%v", err)
+				}
+				if updated := foundUser.Name == "Updated"; updated != (i != 1) {
+					t.Errorf("Only the users without error must be updated	index:%d	foundUser:%v", i, foundUser)
+				}
+			}
+		},
+	},
+
+	// DeleteMulti
+	{
+		name: "DeleteMulti_WhenPassingEmptyList_ReturnError",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.BatchUserRepository) {
+			if _, err := repository.DeleteMulti(ctx, nil); err == nil {
+				t.Errorf("Error must be thrown")
+			}
+		},
+	},
+
+	{
+		name: "DeleteMulti_WhenPassingInvalidIds_ReturnError",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.BatchUserRepository) {
+			userList := newConformanceUserList()
+			for _, u := range userList {
+				u.Id = ""
+			}
+			if _, err := repository.DeleteMulti(ctx, userList); err == nil {
+				t.Errorf("Error must be thrown")
+			}
+		},
+	},
+
+	{
+		name: "DeleteMulti_WhenPassingValidUserList_ReturnNonError",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.BatchUserRepository) {
+			userList := newConformanceUserList()
+			if _, err := repository.CreateMulti(ctx, userList); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			results, err := repository.DeleteMulti(ctx, userList)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			for i, result := range results {
+				if result.Err != nil || result.Id != userList[i].Id {
+					t.Errorf("User must be deleted	index:%d	result:%+v", i, result)
+				}
+			}
+			for _, u := range userList {
+				if foundUser, err := repository.Find(ctx, u.Id); !errors.Is(err, usrsvc.ErrNotFound) {
+					t.Errorf("User should be not found	user:%v	err:%v", foundUser, err)
+				}
+			}
+		},
+	},
+
+	{
+		name: "DeleteMulti_WhenPassingNotExistingUser_ReturnNonError",
+		f: func(ctx context.Context, t *testing.T, repository usrsvc.BatchUserRepository) {
+			user := createConformanceUser(ctx, t, repository)
+			results, err := repository.DeleteMulti(ctx, []*usrsvc.User{user, newConformanceUser()})
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if len(results) != 2 || results[0].Err != nil || results[1].Err != nil {
+				t.Errorf("Deleting a missing user must not be an error	results:%v", results)
+			}
+			if foundUser, err := repository.Find(ctx, user.Id); !errors.Is(err, usrsvc.ErrNotFound) {
+				t.Errorf("User should be not found	user:%v	err:%v", foundUser, err)
+			}
+		},
+	},
+}
+
+var revisionConformanceTests = []revisionConformanceTest{
+
+	// CreateMulti
+	{
+		name: "CreateMulti_WhenCreated_RecordTheCreateRevision",
+		f: func(ctx context.Context, t *testing.T, repository revisionUserRepository) {
+			multi, ok := repository.(usrsvc.BatchUserRepository)
+			if !ok {
+				t.Skip("repository does not implement the Multi helpers")
+			}
+			userList := newConformanceUserList()
+			for _, u := range userList {
+				u.Version = 1
+			}
+			if _, err := multi.CreateMulti(ctx, userList); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			for _, u := range userList {
+				revisions, err := repository.ListRevisions(ctx, u.Id, 0, 10)
+				if err != nil {
+					t.Fatalf("err:%v", err)
+				}
+				if len(revisions) != 1 || revisions[0].Version != 1 || revisions[0].Action != usrsvc.RevisionActionCreate || revisions[0].User.Name != u.Name {
+					t.Errorf("Create revision must be recorded	user:%v	revisions:%v", u, revisions)
+				}
+			}
+		},
+	},
+
+	// ListRevisions
+	{
+		name: "ListRevisions_WhenUserIsChanged_ReturnEveryRevisionOldestFirst",
+		f: func(ctx context.Context, t *testing.T, repository revisionUserRepository) {
+			ctx = usrsvc.WithActor(ctx, "operator@example.com")
+			user := createConformanceUser(ctx, t, repository)
+			expectedRevisions := []usrsvc.Revision{{Version: 1, Action: usrsvc.RevisionActionCreate, CreatedAt: user.UpdatedAt, User: *user}}
+
+			changes := []struct {
+				action usrsvc.RevisionAction
+				change func(u *usrsvc.User)
+			}{
+				{usrsvc.RevisionActionUpdate, func(u *usrsvc.User) { u.Name = "ChangedName" }},
+				{usrsvc.RevisionActionDelete, func(u *usrsvc.User) { u.DeletedAt = time.Now() }},
+				{usrsvc.RevisionActionRestore, func(u *usrsvc.User) { u.DeletedAt = time.Time{} }},
+			}
+			for _, c := range changes {
+				c.change(user)
+				if err := repository.Update(ctx, user); err != nil {
+					t.Fatalf("err:%v", err)
+				}
+				expectedRevisions = append(expectedRevisions, usrsvc.Revision{Version: user.Version, Action: c.action, CreatedAt: user.UpdatedAt, User: *user})
+			}
+
+			revisions, err := repository.ListRevisions(ctx, user.Id, 0, 10)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if len(revisions) != len(expectedRevisions) {
+				t.Fatalf("Every change must be recorded	revisions:%v", revisions)
+			}
+			for i, revision := range revisions {
+				expected := expectedRevisions[i]
+				if revision.Version != expected.Version || revision.Action != expected.Action || revision.Actor != "operator@example.com" {
+					t.Errorf("Unexpected revision	i:%d	revision:%+v	expected:%+v", i, revision, expected)
+				}
+				if !revision.CreatedAt.Equal(expected.CreatedAt) {
+					t.Errorf("Revision must be timestamped with UpdatedAt	i:%d	revision:%+v	expected:%+v", i, revision, expected)
+				}
+				snapshot := revision.User
+				if snapshot.Id != user.Id || snapshot.Name != expected.User.Name || snapshot.Version != expected.Version || snapshot.DeletedAt.IsZero() != expected.User.DeletedAt.IsZero() {
+					t.Errorf("Revision must hold a snapshot of the user	i:%d	snapshot:%+v	expected:%+v", i, snapshot, expected.User)
+				}
+			}
+		},
+	},
+
+	{
+		name: "ListRevisions_WhenReverting_RecordTheRevert",
+		f: func(ctx context.Context, t *testing.T, repository revisionUserRepository) {
+			user := createConformanceUser(ctx, t, repository)
+			name := user.Name
+			user.Name = "ChangedName"
+			if err := repository.Update(ctx, user); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			user.Name = name
+			if err := repository.Update(usrsvc.WithRevertedVersion(ctx, 1), user); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+
+			revision, err := repository.FindRevision(ctx, user.Id, 3)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if revision.Action != usrsvc.RevisionActionRevert || revision.RevertedFrom != 1 || revision.User.Name != name {
+				t.Errorf("Revert must be recorded as a new revision	revision:%+v", revision)
+			}
+		},
+	},
+
+	{
+		name: "ListRevisions_WhenPassingAfterAndLimit_ReturnThePage",
+		f: func(ctx context.Context, t *testing.T, repository revisionUserRepository) {
+			user := createConformanceUser(ctx, t, repository)
+			for i := 0; i < 3; i++ {
+				user.Name = fmt.Sprintf("ChangedName-%d", i)
+				if err := repository.Update(ctx, user); err != nil {
+					t.Fatalf("err:%v", err)
+				}
+			}
+
+			revisions, err := repository.ListRevisions(ctx, user.Id, 1, 2)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if len(revisions) != 2 || revisions[0].Version != 2 || revisions[1].Version != 3 {
+				t.Errorf("Revisions 2 and 3 must be returned	revisions:%v", revisions)
+			}
+		},
+	},
+
+	{
+		name: "ListRevisions_WhenUpdateFails_WriteNoRevision",
+		f: func(ctx context.Context, t *testing.T, repository revisionUserRepository) {
+			user := createConformanceUser(ctx, t, repository)
+			staleUser := *user
+			staleUser.Version = 2
+			if err := repository.Update(ctx, &staleUser); !errors.Is(err, usrsvc.ErrVersionMismatch) {
+				t.Fatalf("ErrVersionMismatch must be thrown	err:%v", err)
+			}
+
+			revisions, err := repository.ListRevisions(ctx, user.Id, 0, 10)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if len(revisions) != 1 {
+				t.Errorf("Failed update must not be recorded	revisions:%v", revisions)
+			}
+		},
+	},
+
+	{
+		name: "ListRevisions_WhenUserIsDeletedAndCreatedAgain_ReturnOnlyTheNewRevisions",
+		f: func(ctx context.Context, t *testing.T, repository revisionUserRepository) {
+			user := createConformanceUser(ctx, t, repository)
+			user.Name = "ChangedName"
+			if err := repository.Update(ctx, user); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if err := repository.Delete(ctx, user.Id); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+
+			revisions, err := repository.ListRevisions(ctx, user.Id, 0, 10)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if len(revisions) != 0 {
+				t.Errorf("Delete must remove the revisions	revisions:%v", revisions)
+			}
+
+			if err := repository.Create(ctx, user); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			revisions, err = repository.ListRevisions(ctx, user.Id, 0, 10)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if len(revisions) != 1 || revisions[0].Action != usrsvc.RevisionActionCreate {
+				t.Errorf("Only the new user must be recorded	revisions:%v", revisions)
+			}
+		},
+	},
+
+	{
+		name: "ListRevisions_WhenSoftDeletedUserIsPurged_EraseEveryRevision",
+		f: func(ctx context.Context, t *testing.T, repository revisionUserRepository) {
+			user := createConformanceUser(ctx, t, repository)
+			user.DeletedAt = time.Now()
+			if err := repository.Update(ctx, user); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if _, err := repository.FindAndDelete(ctx, user.Id, user.Version); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+
+			revisions, err := repository.ListRevisions(ctx, user.Id, 0, 10)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if len(revisions) != 0 {
+				t.Errorf("Purging must erase the revisions	revisions:%v", revisions)
+			}
+			if _, err := repository.FindRevision(ctx, user.Id, user.Version); !errors.Is(err, usrsvc.ErrRevisionNotFound) {
+				t.Errorf("The delete revision must be erased too	err:%v", err)
+			}
+		},
+	},
+
+	// FindRevision
+	{
+		name: "FindRevision_WhenPassingExistingVersion_ReturnTheRevision",
+		f: func(ctx context.Context, t *testing.T, repository revisionUserRepository) {
+			user := createConformanceUser(ctx, t, repository)
+			name := user.Name
+			user.Name = "ChangedName"
+			if err := repository.Update(ctx, user); err != nil {
+				t.Fatalf("err:%v", err)
+			}
+
+			revision, err := repository.FindRevision(ctx, user.Id, 1)
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			if revision.Version != 1 || revision.User.Name != name || revision.User.Id != user.Id {
+				t.Errorf("Revision 1 must hold the created user	revision:%+v", revision)
+			}
+		},
+	},
+
+	{
+		name: "FindRevision_WhenPassingNotExistingVersion_ReturnError",
+		f: func(ctx context.Context, t *testing.T, repository revisionUserRepository) {
+			user := createConformanceUser(ctx, t, repository)
+			if revision, err := repository.FindRevision(ctx, user.Id, 2); !errors.Is(err, usrsvc.ErrRevisionNotFound) {
+				t.Errorf("ErrRevisionNotFound must be thrown	revision:%v	err:%v", revision, err)
+			}
+			if revision, err := repository.FindRevision(ctx, newConformanceUser().Id, 1); !errors.Is(err, usrsvc.ErrRevisionNotFound) {
+				t.Errorf("ErrRevisionNotFound must be thrown	revision:%v	err:%v", revision, err)
+			}
+		},
+	},
+}
+
+func newConformanceUser() *usrsvc.User {
+	id := uuid.New().String()
+	return &usrsvc.User{
+		Id:   id,
+		Name: fmt.Sprintf("User-%s", id[:8]),
+	}
+}
+
+func newConformanceUserList() []*usrsvc.User {
+	var userList []*usrsvc.User
+	for i := 0; i < 10; i++ {
+		userList = append(userList, newConformanceUser())
+	}
+	return userList
+}
+
+func createConformanceUser(ctx context.Context, t *testing.T, repository usrsvc.IUserRepository) *usrsvc.User {
+	user := newConformanceUser()
+	if err := repository.Create(ctx, user); err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	return user
+}